@@ -1,8 +1,9 @@
 #!/bin/bash
 
 source ./vars.sh
+export GO111MODULE=off
 mkdir -p $GOPATH/bin
-go get -u github.com/kardianos/govendor
+GO111MODULE=on GOBIN=$GOPATH/bin go install github.com/kardianos/govendor@latest
 
 cd $GOPATH/src/softwareupgrade
 $GOPATH/bin/govendor sync
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"softwareupgrade"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cNodeListFilename is the node list written by the collection, in the collection directory
+	cNodeListFilename = "nodelist.txt"
+)
+
+var (
+	// localAddressRegexp matches the local address of a peer in the output of admin.peers,
+	// which is the address of the node itself
+	localAddressRegexp = regexp.MustCompile(`"?localAddress"?\s*:\s*"([^"]+)"`)
+)
+
+// ParseLocalAddress returns the IP address of the node in the output of admin.peers, ie, the local address of its
+// first peer, which, for a node in a VPC, is its private IP. An empty string is returned if the node has no peers.
+func ParseLocalAddress(data []byte) string {
+	match := localAddressRegexp.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	address := string(match[1])
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return address
+}
+
+// getPublicIP returns the public IP of the given host, which is either an IP, an EC2 hostname, or a name that's resolved
+func getPublicIP(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if match := ec2HostnameRegexp.FindStringSubmatch(host); match != nil {
+		return strings.Join(match[1:], ".")
+	}
+	if ips, err := net.LookupIP(host); err == nil {
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return ip.String()
+			}
+		}
+	}
+	return ""
+}
+
+// GetConfigNodes returns the nodes of the given Upgrade configuration, sorted, with each node listed once,
+// or, if groups are given, the nodes of those groups only.
+func GetConfigNodes(config *softwareupgrade.UpgradeConfig, groups []string) (result []string) {
+	if len(groups) == 0 {
+		groups = config.GetGroupNames()
+	}
+	found := make(map[string]bool)
+	for _, groupName := range groups {
+		for _, node := range config.GetGroupNodes(strings.TrimSpace(groupName)) {
+			if !found[node] {
+				found[node] = true
+				result = append(result, node)
+			}
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// CollectPeers gets the output of admin.peers of each node, at most parallel nodes at the same time, and saves it
+// in dir, named after the node's host, with the given extension. The nodes that responded are saved to the node list,
+// nodelist.txt, in dir, with their public and private IPs, and the filename of the node list is returned.
+// Nodes that can't be reached, or don't run geth, are skipped. An error is returned, without collecting any peers,
+// if several nodes are on the same host, eg, with different SSH ports, as their peers would be saved to the same file.
+func CollectPeers(nodes []string, getPeers func(node string) (string, error), dir, extension string, parallel int) (listFilename string, err error) {
+	var (
+		mutex   sync.Mutex
+		entries = make(map[string]NodeEntry)
+		hosts   = make(map[string]string)
+		msg     string
+	)
+	for _, node := range nodes {
+		host, _, err := softwareupgrade.SplitNodeAddress(node, softwareupgrade.CDefaultSSHPort)
+		if err != nil {
+			continue
+		}
+		if other, ok := hosts[host]; ok {
+			msg = fmt.Sprintf("%sNodes %s and %s are on the same host: %s\n", msg, other, node, host)
+			continue
+		}
+		hosts[host] = node
+	}
+	if msg != "" {
+		return "", fmt.Errorf("%s", strings.TrimSuffix(msg, "\n"))
+	}
+
+	softwareupgrade.ForEachParallel(nodes, parallel, func(node string) {
+		host, _, err := softwareupgrade.SplitNodeAddress(node, softwareupgrade.CDefaultSSHPort)
+		if err != nil {
+			DebugLog.Println("Node %s: %v", node, err)
+			return
+		}
+		output, err := getPeers(node)
+		if err != nil {
+			DebugLog.Println("Node %s: skipped, %v", node, err)
+			return
+		}
+		filename := filepath.Join(dir, host+extension)
+		if _, err := softwareupgrade.SaveDataToFile(filename, []byte(output)); err != nil {
+			mutex.Lock()
+			msg = fmt.Sprintf("%sNode %s: unable to save %s: %v\n", msg, node, filename, err)
+			mutex.Unlock()
+			return
+		}
+		entry := NodeEntry{Hostname: host, PublicIP: getPublicIP(host), PrivateIP: ParseLocalAddress([]byte(output))}
+		DebugLog.Debugln("Node %s: peers: %d, public IP: %s, private IP: %s", node, len(ParsePeers([]byte(output))), entry.PublicIP, entry.PrivateIP)
+		mutex.Lock()
+		entries[node] = entry
+		mutex.Unlock()
+	})
+	if msg != "" {
+		return "", fmt.Errorf("%s", strings.TrimSuffix(msg, "\n"))
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("none of the %d nodes returned their peers", len(nodes))
+	}
+
+	// the node list is in the order of the nodes, regardless of the order they responded in
+	var b bytes.Buffer
+	for _, node := range nodes {
+		if entry, ok := entries[node]; ok {
+			fmt.Fprintf(&b, "%s,%s,%s\n", entry.Hostname, entry.PublicIP, entry.PrivateIP)
+		}
+	}
+	listFilename = filepath.Join(dir, cNodeListFilename)
+	if _, err = softwareupgrade.SaveDataToFile(listFilename, b.Bytes()); err != nil {
+		return "", fmt.Errorf("unable to save %s: %v", listFilename, err)
+	}
+	DebugLog.Println("Collected the peers of %d of %d nodes in %s", len(entries), len(nodes), dir)
+	return
+}
+
+// collectConfigPeers collects the peers of the nodes in the Upgrade configuration given by -json, over SSH,
+// and returns the filename of the node list
+func collectConfigPeers() (listFilename string, err error) {
+	data, err := softwareupgrade.ReadDataFromFile(jsonFilename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %v", jsonFilename, err)
+	}
+	var config softwareupgrade.UpgradeConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("unable to parse %s: %v", jsonFilename, err)
+	}
+	timeout := 5 * time.Second
+	if parsedTimeout, err := time.ParseDuration(config.Common.SSHTimeout); err == nil {
+		timeout = parsedTimeout
+	}
+	softwareupgrade.SetSSHTimeout(timeout)
+
+	var groups []string
+	if collectGroups != "" {
+		groups = strings.Split(collectGroups, ",")
+	}
+	nodes := GetConfigNodes(&config, groups)
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("no nodes found in %s", jsonFilename)
+	}
+	if collectDir == "" {
+		collectDir = fmt.Sprintf("Peers-%s", time.Now().Format("2006-01-02T15-04-05"))
+	}
+	if expandedDir, err := softwareupgrade.Expand(collectDir); err == nil {
+		collectDir = expandedDir
+	}
+	if err = os.MkdirAll(collectDir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create %s: %v", collectDir, err)
+	}
+	return CollectPeers(nodes, func(node string) (string, error) {
+		// the SSH settings of a node are the same for all its software
+		sshConfig := config.GetNodeUpgradeInfo(node, "").NewSSHConfig(node)
+		defer sshConfig.Close()
+		return softwareupgrade.GetGethPeers(sshConfig, gethBinary, gethIPC, int(collectTimeout.Seconds()))
+	}, collectDir, extension, collectParallel)
+}
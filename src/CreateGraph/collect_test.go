@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"softwareupgrade"
+	"testing"
+)
+
+func TestCollectPeers(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	sample, err := ioutil.ReadFile(filepath.Join("testdata", "ec2-13-232-223-9.ap-south-1.compute.amazonaws.com.json.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 18.209.9.107 is connected to the sample node through the sample node's private IP
+	outputs := map[string]string{
+		"ec2-13-232-223-9.ap-south-1.compute.amazonaws.com": string(sample),
+		"18.209.9.107:2222": `[{
+    network: {
+      localAddress: "10.0.0.84:21000",
+      remoteAddress: "10.0.9.238:60650"
+    }
+}]`,
+	}
+	nodes := []string{"18.209.9.107:2222", "ec2-13-232-223-9.ap-south-1.compute.amazonaws.com", "bootnode"}
+	collected, err := CollectPeers(nodes, func(node string) (string, error) {
+		if output, ok := outputs[node]; ok {
+			return output, nil
+		}
+		return "", errors.New("geth isn't running")
+	}, tempdir, ".json.raw", 2)
+	if err != nil {
+		t.Fatalf("Unable to collect peers: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(collected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "18.209.9.107,18.209.9.107,10.0.0.84\nec2-13-232-223-9.ap-south-1.compute.amazonaws.com,13.232.223.9,10.0.9.238\n"
+	if string(data) != expected {
+		t.Fatalf("Expected the nodes that responded, in order, got:\n%s", data)
+	}
+
+	// the collected peers are read like any other list of nodes
+	filenames, nodeList, err := getInputFiles("", collected, ".json.raw")
+	if err != nil || len(filenames) != 2 {
+		t.Fatalf("Expected 2 input files, got: %v, error: %v", filenames, err)
+	}
+	g := createGraph(filenames, ".json.raw", nodeList)
+	if len(g.Vertices()) != 7 || g.EdgeCount() != 6 {
+		t.Fatalf("Expected the nodes to be connected through the public IP, got: %v, %d", g.Vertices(), g.EdgeCount())
+	}
+
+	if _, err := CollectPeers([]string{"bootnode"}, func(node string) (string, error) {
+		return "", errors.New("geth isn't running")
+	}, tempdir, ".json.raw", 1); err == nil {
+		t.Fatal("Expected an error when no nodes return their peers")
+	}
+
+	// the peers of nodes on the same host would be saved to the same file
+	var collectedNodes []string
+	_, err = CollectPeers([]string{"18.209.9.107:2222", "18.209.9.107:2223"}, func(node string) (string, error) {
+		collectedNodes = append(collectedNodes, node)
+		return outputs["18.209.9.107:2222"], nil
+	}, tempdir, ".json.raw", 1)
+	if err == nil || len(collectedNodes) > 0 {
+		t.Fatalf("Expected nodes on the same host to be rejected before collecting, got: %v, collected: %v", err, collectedNodes)
+	}
+}
+
+func TestGetConfigNodes(t *testing.T) {
+	var config softwareupgrade.UpgradeConfig
+	if err := json.Unmarshal([]byte(`{
+		"common": {"software_group": {"Makers": ["quorum"], "Validators": ["quorum"], "Bootnodes": ["bootnode"]}},
+		"groupnodes": {"Makers": ["node2", "node1"], "Validators": ["node3", "node1"], "Bootnodes": ["node4"]}
+	}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := GetConfigNodes(&config, nil); !reflect.DeepEqual(nodes, []string{"node1", "node2", "node3", "node4"}) {
+		t.Fatalf("Expected each node once, sorted, got: %v", nodes)
+	}
+	if nodes := GetConfigNodes(&config, []string{"Makers", " Validators"}); !reflect.DeepEqual(nodes, []string{"node1", "node2", "node3"}) {
+		t.Fatalf("Expected the nodes of the given groups, got: %v", nodes)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "softwareupgrade"
+
+var (
+	// DebugLog provides access to the DebugLog declared in softwareupgrade
+	DebugLog = &softwareupgrade.DebugLog
+)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+type (
+	// GraphSummary is shown in the label of the DOT output
+	GraphSummary struct {
+		MinCut     int
+		IPs        int
+		Diameter   int
+		Radius     int
+		ShowRadius bool
+	}
+)
+
+func (summary GraphSummary) String() (result string) {
+	result = fmt.Sprintf("Eximchain Nodes, min cut=%d, IPs=%d, diameter=%d", summary.MinCut, summary.IPs, summary.Diameter)
+	if summary.ShowRadius {
+		result = fmt.Sprintf("%s, radius=%d", result, summary.Radius)
+	}
+	return
+}
+
+// WriteDOT writes the graph in the DOT language, with the summary in its own cluster, followed by
+// a cluster for each connected component, which contains the component's nodes, and their connections.
+func WriteDOT(w io.Writer, g *Graph, summary GraphSummary) (err error) {
+	components := g.Components()
+	componentOf := make([]int, len(g.vertices))
+	for c, component := range components {
+		for _, i := range component {
+			componentOf[i] = c
+		}
+	}
+	fmt.Fprintln(w, "graph EximchainNodes {")
+	fmt.Fprintln(w, "  subgraph cluster0 {")
+	fmt.Fprintln(w, "    node [color=white];")
+	fmt.Fprintf(w, "    label=%q\n", summary.String())
+	fmt.Fprintln(w, `    "     ";`)
+	fmt.Fprintln(w, "  };")
+	for c, component := range components {
+		fmt.Fprintf(w, "  subgraph cluster_%d {\n", c+1)
+		fmt.Fprintf(w, "    label=\"Subgraph %d\"\n", c+1)
+		for _, i := range component {
+			fmt.Fprintf(w, "    %q;\n", g.vertices[i])
+		}
+		for _, edge := range g.edges {
+			if componentOf[edge[0]] == c {
+				fmt.Fprintf(w, "    %q -- %q;\n", g.vertices[edge[0]], g.vertices[edge[1]])
+			}
+		}
+		fmt.Fprintln(w, "  };")
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+type (
+	// Graph is an undirected graph of nodes, named by their addresses, without duplicate edges, or self loops
+	Graph struct {
+		vertices  []string
+		index     map[string]int
+		adjacency []map[int]bool
+		edges     [][2]int // in the order added
+	}
+)
+
+// NewGraph returns an empty graph
+func NewGraph() *Graph {
+	return &Graph{index: make(map[string]int)}
+}
+
+// AddVertex adds the given vertex, if it doesn't exist, and returns its index
+func (g *Graph) AddVertex(name string) int {
+	if i, ok := g.index[name]; ok {
+		return i
+	}
+	g.index[name] = len(g.vertices)
+	g.vertices = append(g.vertices, name)
+	g.adjacency = append(g.adjacency, make(map[int]bool))
+	return len(g.vertices) - 1
+}
+
+// AddEdge connects the given vertices, adding them if they don't exist
+func (g *Graph) AddEdge(a, b string) {
+	i, j := g.AddVertex(a), g.AddVertex(b)
+	if i == j || g.adjacency[i][j] {
+		return
+	}
+	g.adjacency[i][j], g.adjacency[j][i] = true, true
+	g.edges = append(g.edges, [2]int{i, j})
+}
+
+// Vertices returns the vertices, in the order added
+func (g *Graph) Vertices() []string {
+	return g.vertices
+}
+
+// EdgeCount returns the number of edges
+func (g *Graph) EdgeCount() int {
+	return len(g.edges)
+}
+
+// distances returns the distance from the given vertex to every vertex, or -1 if it can't be reached
+func (g *Graph) distances(from int) (result []int) {
+	result = make([]int, len(g.vertices))
+	for i := range result {
+		result[i] = -1
+	}
+	result[from] = 0
+	queue := []int{from}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for j := range g.adjacency[i] {
+			if result[j] < 0 {
+				result[j] = result[i] + 1
+				queue = append(queue, j)
+			}
+		}
+	}
+	return
+}
+
+// Components returns the connected components, each as the indexes of its vertices, in the order added.
+// The components are in the order of their first vertex.
+func (g *Graph) Components() (result [][]int) {
+	component := make([]int, len(g.vertices))
+	for i := range component {
+		component[i] = -1
+	}
+	for i := range g.vertices {
+		if component[i] >= 0 {
+			continue
+		}
+		for j, distance := range g.distances(i) {
+			if distance >= 0 {
+				component[j] = len(result)
+			}
+		}
+		result = append(result, nil)
+	}
+	for i, c := range component {
+		result[c] = append(result[c], i)
+	}
+	return
+}
+
+// Eccentricities returns, for each vertex, the greatest distance to any vertex of its connected component
+func (g *Graph) Eccentricities() (result []int) {
+	result = make([]int, len(g.vertices))
+	for i := range g.vertices {
+		for _, distance := range g.distances(i) {
+			if distance > result[i] {
+				result[i] = distance
+			}
+		}
+	}
+	return
+}
+
+// Diameter returns the greatest eccentricity, ie, the longest of the shortest paths between any two connected vertices
+func (g *Graph) Diameter() (result int) {
+	for _, eccentricity := range g.Eccentricities() {
+		if eccentricity > result {
+			result = eccentricity
+		}
+	}
+	return
+}
+
+// Radius returns the least eccentricity of the vertices that are connected to another vertex
+func (g *Graph) Radius() (result int) {
+	result = -1
+	for _, eccentricity := range g.Eccentricities() {
+		if eccentricity > 0 && (result < 0 || eccentricity < result) {
+			result = eccentricity
+		}
+	}
+	if result < 0 {
+		result = 0
+	}
+	return
+}
+
+// minCutTrial contracts randomly chosen edges until 2 vertices remain, and returns the number of edges between them
+func (g *Graph) minCutTrial(random *rand.Rand) (result int) {
+	parent := make([]int, len(g.vertices))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	remaining := len(g.vertices)
+	for _, e := range random.Perm(len(g.edges)) {
+		if remaining <= 2 {
+			break
+		}
+		a, b := find(g.edges[e][0]), find(g.edges[e][1])
+		if a != b {
+			parent[a] = b
+			remaining--
+		}
+	}
+	for _, edge := range g.edges {
+		if find(edge[0]) != find(edge[1]) {
+			result++
+		}
+	}
+	return
+}
+
+// MinCut returns the least number of edges that disconnect the graph, found by Karger's algorithm, which
+// is run the given number of iterations, split among the given number of concurrent workers. As each
+// iteration finds the min cut with a probability of at least 2/(n*(n-1)), more iterations give a more
+// accurate result. A graph that's already disconnected has a min cut of 0.
+func (g *Graph) MinCut(iterations, concurrent int, seed int64) (result int) {
+	if len(g.vertices) < 2 || len(g.Components()) > 1 {
+		return 0
+	}
+	if iterations < 1 {
+		iterations = 1
+	}
+	if concurrent < 1 {
+		concurrent = 1
+	}
+	if concurrent > iterations {
+		concurrent = iterations
+	}
+	result = len(g.edges)
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for worker := 0; worker < concurrent; worker++ {
+		// each worker runs its share of the iterations, with its own source of random numbers
+		count := iterations / concurrent
+		if worker < iterations%concurrent {
+			count++
+		}
+		wg.Add(1)
+		go func(random *rand.Rand, count int) {
+			defer wg.Done()
+			best := len(g.edges)
+			for i := 0; i < count; i++ {
+				if cut := g.minCutTrial(random); cut < best {
+					best = cut
+				}
+			}
+			mutex.Lock()
+			if best < result {
+				result = best
+			}
+			mutex.Unlock()
+		}(rand.New(rand.NewSource(seed+int64(worker))), count)
+	}
+	wg.Wait()
+	return
+}
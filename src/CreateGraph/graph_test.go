@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// newCompleteGraph returns a graph where each of the vertices, named prefix0 to prefixN-1, are connected to each other
+func newCompleteGraph(g *Graph, prefix string, n int) *Graph {
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			g.AddEdge(fmt.Sprintf("%s%d", prefix, i), fmt.Sprintf("%s%d", prefix, j))
+		}
+	}
+	return g
+}
+
+func TestGraph(t *testing.T) {
+	g := NewGraph()
+	// a path of 4, a triangle, and a vertex without edges
+	g.AddEdge("a", "b")
+	g.AddEdge("b", "c")
+	g.AddEdge("c", "d")
+	g.AddEdge("b", "a")
+	g.AddEdge("d", "d")
+	g.AddEdge("x", "y")
+	g.AddEdge("y", "z")
+	g.AddEdge("z", "x")
+	g.AddVertex("alone")
+
+	if g.EdgeCount() != 6 {
+		t.Fatalf("Expected duplicate edges and self loops to be ignored, got: %d edges", g.EdgeCount())
+	}
+	if components := g.Components(); !reflect.DeepEqual(components, [][]int{{0, 1, 2, 3}, {4, 5, 6}, {7}}) {
+		t.Fatalf("Unexpected components: %v", components)
+	}
+	if eccentricities := g.Eccentricities(); !reflect.DeepEqual(eccentricities, []int{3, 2, 2, 3, 1, 1, 1, 0}) {
+		t.Fatalf("Unexpected eccentricities: %v", eccentricities)
+	}
+	if g.Diameter() != 3 || g.Radius() != 1 {
+		t.Fatalf("Expected a diameter of 3, and a radius of 1, got: %d, %d", g.Diameter(), g.Radius())
+	}
+	if NewGraph().Diameter() != 0 || NewGraph().Radius() != 0 {
+		t.Fatal("Expected an empty graph to have a diameter and radius of 0")
+	}
+}
+
+func TestGraph_MinCut(t *testing.T) {
+	// 2 complete graphs of 5, connected by 2 edges
+	g := newCompleteGraph(newCompleteGraph(NewGraph(), "a", 5), "b", 5)
+	g.AddEdge("a0", "b0")
+	g.AddEdge("a1", "b1")
+	for _, concurrent := range []int{1, 4} {
+		if cut := g.MinCut(200, concurrent, 1); cut != 2 {
+			t.Fatalf("Expected a min cut of 2 with %d workers, got: %d", concurrent, cut)
+		}
+	}
+	if cut := newCompleteGraph(NewGraph(), "k", 6).MinCut(100, 3, 1); cut != 5 {
+		t.Fatalf("Expected a min cut of 5 for a complete graph of 6, got: %d", cut)
+	}
+
+	g.AddEdge("x", "y")
+	if cut := g.MinCut(100, 1, 1); cut != 0 {
+		t.Fatalf("Expected a disconnected graph to have a min cut of 0, got: %d", cut)
+	}
+	if cut := NewGraph().MinCut(0, 0, 1); cut != 0 {
+		t.Fatalf("Expected an empty graph to have a min cut of 0, got: %d", cut)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"softwareupgrade"
+	"strings"
+	"time"
+)
+
+var (
+	inFilename, listFilename string
+	extension                string
+	outputFilename           string
+	iterations, concurrent   int
+	calcRadius, debug        bool
+	jsonFilename, collectDir string
+	collectGroups            string
+	gethBinary, gethIPC      string
+	collectParallel          int
+	collectTimeout           time.Duration
+)
+
+// getInputFiles returns the input files, either the file given by -in, or the files of the nodes in the
+// list given by -list, which are named after each node's hostname, with the extension given by -extension,
+// in the directory of the list.
+func getInputFiles(inFilename, listFilename, extension string) (result []string, nodes *NodeList, err error) {
+	if inFilename != "" {
+		result = []string{inFilename}
+		return
+	}
+	data, err := softwareupgrade.ReadDataFromFile(listFilename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read list: %v", err)
+	}
+	if nodes, err = ParseNodeList(data); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", listFilename, err)
+	}
+	dir := filepath.Dir(listFilename)
+	if expandedFilename, err := softwareupgrade.Expand(listFilename); err == nil {
+		dir = filepath.Dir(expandedFilename)
+	}
+	for _, entry := range nodes.Entries {
+		filename := entry.Hostname
+		if !strings.HasSuffix(filename, extension) {
+			filename += extension
+		}
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		result = append(result, filename)
+	}
+	return
+}
+
+// createGraph connects each node to its peers, read from the given input files, with the given extension
+func createGraph(filenames []string, extension string, nodes *NodeList) (g *Graph) {
+	g = NewGraph()
+	for _, filename := range filenames {
+		data, err := softwareupgrade.ReadDataFromFile(filename)
+		if os.IsNotExist(err) {
+			DebugLog.Println("Skipped %s, which doesn't exist", filename)
+			continue
+		} else if err != nil {
+			DebugLog.Println("Skipped %s: %v", filename, err)
+			continue
+		}
+		node := GetNodeName(filename, extension, nodes)
+		peers := g.AddPeers(node, data, nodes)
+		DebugLog.Debugln("Node: %s, peers: %d", node, peers)
+	}
+	return
+}
+
+// writeGraph calculates the min cut, diameter, and radius of the graph, and writes it in the DOT language
+func writeGraph(g *Graph) (err error) {
+	summary := GraphSummary{IPs: len(g.Vertices()), ShowRadius: calcRadius}
+	summary.Diameter = g.Diameter()
+	if calcRadius {
+		summary.Radius = g.Radius()
+	}
+	start := time.Now()
+	summary.MinCut = g.MinCut(iterations, concurrent, start.UnixNano())
+	DebugLog.Debugln("Min cut: %d, %d iterations took %v", summary.MinCut, iterations, time.Since(start))
+	DebugLog.Println("%s, connected components=%d", summary, len(g.Components()))
+
+	var b bytes.Buffer
+	WriteDOT(&b, g, summary)
+	if outputFilename == "" {
+		_, err = os.Stdout.Write(b.Bytes())
+		return
+	}
+	if _, err = softwareupgrade.SaveDataToFile(outputFilename, b.Bytes()); err != nil {
+		err = fmt.Errorf("unable to write output: %v", err)
+	}
+	return
+}
+
+func main() {
+	flag.StringVar(&inFilename, "in", "", "Specifies the input file, containing the output of admin.peers of a node")
+	flag.StringVar(&listFilename, "list", "", "Specifies the list of nodes, hostname,public IP,private IP, whose input files are named after the hostname (use one of -in, -list or -json)")
+	flag.StringVar(&extension, "extension", ".json.raw", "Specifies the file extension of the input files")
+	flag.StringVar(&outputFilename, "output", "", "Specifies the file to write the DOT output to (default: stdout)")
+	flag.StringVar(&outputFilename, "out", "", "Same as -output")
+	flag.IntVar(&iterations, "iterations", 100, "Specifies the number of iterations used to find the min cut")
+	flag.IntVar(&concurrent, "concurrent", 1, "Specifies the number of iterations run concurrently")
+	flag.BoolVar(&calcRadius, "radius", false, "Calculates the radius of the graph")
+	flag.StringVar(&jsonFilename, "json", "", "Specifies the Upgrade JSON configuration file, whose nodes' peers are collected over SSH, instead of reading them from -in or -list")
+	flag.StringVar(&collectDir, "collect-dir", "", "Specifies the directory where the collected peers, and the node list, are saved (default: Peers-<time> in the current directory)")
+	flag.StringVar(&collectGroups, "groups", "", "Specifies the comma separated groups whose nodes' peers are collected (default: all groups)")
+	flag.StringVar(&gethBinary, "geth", softwareupgrade.CGeth, "Specifies the geth run on the nodes to get their peers")
+	flag.StringVar(&gethIPC, "ipc", "", "Specifies the IPC socket geth attaches to on the nodes (default: the default IPC socket of the SSH user)")
+	flag.IntVar(&collectParallel, "parallel", 10, "Specifies the number of nodes whose peers are collected at the same time")
+	flag.DurationVar(&collectTimeout, "collect-timeout", 30*time.Second, "Specifies the time allowed for geth to return the peers of a node")
+	flag.BoolVar(&debug, "debug", false, "Specifies debug mode")
+	flag.Parse()
+
+	DebugLog.EnablePrintConsole()
+	DebugLog.SetConsole(os.Stderr)
+	if debug {
+		DebugLog.EnableDebug()
+	}
+
+	sources := 0
+	for _, filename := range []string{inFilename, listFilename, jsonFilename} {
+		if filename != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	var err error
+	if jsonFilename != "" {
+		// the collected peers are then read like any other list of nodes
+		listFilename, err = collectConfigPeers()
+	}
+	var filenames []string
+	var nodes *NodeList
+	if err == nil {
+		filenames, nodes, err = getInputFiles(inFilename, listFilename, extension)
+	}
+	if err == nil {
+		g := createGraph(filenames, extension, nodes)
+		if len(g.Vertices()) == 0 {
+			err = errors.New("no peers found in the input files")
+		} else {
+			err = writeGraph(g)
+		}
+	}
+	if err != nil {
+		DebugLog.Println("Error: %v", err)
+		os.Exit(1)
+	}
+}
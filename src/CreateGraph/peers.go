@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// NodeEntry is a line of the node list, either hostname,public IP,private IP, or just the hostname
+	NodeEntry struct {
+		Hostname  string
+		PublicIP  string
+		PrivateIP string
+	}
+
+	// NodeList maps the hostname, public IP and private IP of each node to its public IP,
+	// so that a node is the same vertex, however its peers connect to it
+	NodeList struct {
+		Entries   []NodeEntry
+		addresses map[string]string
+	}
+)
+
+var (
+	// remoteAddressRegexp matches the remote address of a peer in the output of admin.peers,
+	// either as a JavaScript object in the console, or as JSON
+	remoteAddressRegexp = regexp.MustCompile(`"?remoteAddress"?\s*:\s*"([^"]+)"`)
+	// ec2HostnameRegexp matches the public IP in an EC2 hostname, eg, ec2-13-232-223-9.ap-south-1.compute.amazonaws.com
+	ec2HostnameRegexp = regexp.MustCompile(`^ec2-(\d+)-(\d+)-(\d+)-(\d+)\.`)
+)
+
+// ParseNodeList parses the node list, where each line is hostname,public IP,private IP, or just the hostname
+func ParseNodeList(data []byte) (result *NodeList, err error) {
+	result = &NodeList{addresses: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 1 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: %s, expected hostname,public IP,private IP", line, text)
+		}
+		entry := NodeEntry{Hostname: strings.TrimSpace(fields[0])}
+		if len(fields) == 3 {
+			entry.PublicIP, entry.PrivateIP = strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2])
+		}
+		result.Entries = append(result.Entries, entry)
+		for _, address := range []string{entry.Hostname, entry.PublicIP, entry.PrivateIP} {
+			if address != "" {
+				result.addresses[address] = entry.PublicIP
+			}
+		}
+	}
+	return
+}
+
+// Resolve returns the public IP of the node with the given address, or the address, if it's not in the node list
+func (nodes *NodeList) Resolve(address string) string {
+	if nodes != nil {
+		if publicIP, ok := nodes.addresses[address]; ok && publicIP != "" {
+			return publicIP
+		}
+	}
+	return address
+}
+
+// GetNodeName returns the name of the node whose peers are in the given input file, which is named after
+// the node's hostname, with the given extension, eg, ec2-13-232-223-9.ap-south-1.compute.amazonaws.com.json.raw
+func GetNodeName(filename, extension string, nodes *NodeList) string {
+	hostname := strings.TrimSuffix(filepath.Base(filename), extension)
+	if name := nodes.Resolve(hostname); name != hostname {
+		return name
+	}
+	if match := ec2HostnameRegexp.FindStringSubmatch(hostname); match != nil {
+		return strings.Join(match[1:], ".")
+	}
+	return hostname
+}
+
+// ParsePeers returns the IP addresses of the peers in the output of admin.peers, in the order listed
+func ParsePeers(data []byte) (result []string) {
+	for _, match := range remoteAddressRegexp.FindAllSubmatch(data, -1) {
+		address := string(match[1])
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		result = append(result, address)
+	}
+	return
+}
+
+// AddPeers connects the given node to each of the peers in the output of admin.peers, and returns the number of peers
+func (g *Graph) AddPeers(node string, data []byte, nodes *NodeList) int {
+	g.AddVertex(node)
+	peers := ParsePeers(data)
+	for _, peer := range peers {
+		g.AddEdge(node, nodes.Resolve(peer))
+	}
+	return len(peers)
+}
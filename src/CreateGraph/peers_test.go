@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var (
+	update = flag.Bool("update", false, "updates the golden files")
+)
+
+func TestParsePeers(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "ec2-13-232-223-9.ap-south-1.compute.amazonaws.com.json.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"54.197.13.5", "54.197.84.79", "35.172.141.185", "18.209.9.107", "54.210.124.111", "52.15.135.96"}
+	if peers := ParsePeers(data); !reflect.DeepEqual(peers, expected) {
+		t.Fatalf("Expected: %v, got: %v", expected, peers)
+	}
+	if peers := ParsePeers([]byte(`[{"network": {"localAddress": "10.0.0.1:21000", "remoteAddress": "[::1]:21000"}}]`)); !reflect.DeepEqual(peers, []string{"::1"}) {
+		t.Fatalf("Expected the peers in JSON, got: %v", peers)
+	}
+}
+
+func TestParseNodeList(t *testing.T) {
+	nodes, err := ParseNodeList([]byte("ec2-13-232-223-9.ap-south-1.compute.amazonaws.com,13.232.223.9,10.0.56.87\n\nnode2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Entries) != 2 || nodes.Entries[1].Hostname != "node2" {
+		t.Fatalf("Unexpected entries: %v", nodes.Entries)
+	}
+	if nodes.Resolve("10.0.56.87") != "13.232.223.9" || nodes.Resolve("10.0.0.1") != "10.0.0.1" || nodes.Resolve("node2") != "node2" {
+		t.Fatal("Expected private IPs to resolve to public IPs")
+	}
+	if name := GetNodeName("/tmp/ec2-13-232-223-9.ap-south-1.compute.amazonaws.com.json.raw", ".json.raw", nodes); name != "13.232.223.9" {
+		t.Fatalf("Expected the public IP of the node, got: %s", name)
+	}
+	if name := GetNodeName("ec2-18-209-9-107.compute-1.amazonaws.com.json.raw", ".json.raw", nil); name != "18.209.9.107" {
+		t.Fatalf("Expected the IP of the EC2 hostname, got: %s", name)
+	}
+	if _, err := ParseNodeList([]byte("node1,13.232.223.9\n")); err == nil {
+		t.Fatal("Expected an error parsing a line with 2 fields")
+	}
+}
+
+func TestCreateGraph(t *testing.T) {
+	filenames, nodes, err := getInputFiles("", filepath.Join("testdata", "nodelist.txt"), ".json.raw")
+	if err != nil || len(filenames) != 6 {
+		t.Fatalf("Expected 6 input files, got: %v, error: %v", filenames, err)
+	}
+	// only 2 of the nodes have input files
+	g := createGraph(filenames, ".json.raw", nodes)
+	if len(g.Vertices()) != 8 || g.EdgeCount() != 7 {
+		t.Fatalf("Expected 8 nodes and 7 connections, got: %v, %d", g.Vertices(), g.EdgeCount())
+	}
+
+	summary := GraphSummary{MinCut: g.MinCut(10, 2, 1), IPs: len(g.Vertices()), Diameter: g.Diameter(), Radius: g.Radius(), ShowRadius: true}
+	var b bytes.Buffer
+	if err := WriteDOT(&b, g, summary); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "EximchainNodes.dot")
+	if *update {
+		ioutil.WriteFile(golden, b.Bytes(), 0644)
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Unable to read golden file: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, b.Bytes())
+	}
+}
@@ -11,6 +11,9 @@ const (
 	appActionDeleteRollback
 	appActionRollback
 	appActionResumeUpgrade
+	appActionPlan
+	appActionSessions
+	appActionPruneBackups
 
 	appActionMax // all appAction enumerations should be added before this
 )
@@ -21,6 +24,6 @@ func (action tAction) isValidAction() (result bool) {
 }
 
 func (action tAction) String() (result string) {
-	result = []string{"Unknown", "Upgrade", "Add", "Delete", "Rollback", "Resume", "Max"}[action]
+	result = []string{"Unknown", "Upgrade", "Add", "Delete", "Rollback", "Resume", "Plan", "Sessions", "PruneBackups", "Max"}[action]
 	return
 }
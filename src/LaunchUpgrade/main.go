@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
@@ -17,12 +18,16 @@ var (
 	userSSLcertContent                                       []byte
 	appStatus                                                string
 	debugLogFilename, failedNodesFilename                    string
-	rollbackInfoFilename                                     string
+	rollbackInfoFilename, journalFilename                    string
 	jsonFilename                                             string
 	debug                                                    bool
 	disableNodeVerification, disableFileVerification, dryRun bool
 	disableTargetDirVerification                             bool
 	mode, rollbackSuffix                                     string
+	parallel                                                 int
+	planFormat                                               string
+	planRemote                                               bool
+	forceUnlock                                              bool
 	action                                                   tAction
 )
 
@@ -44,7 +49,17 @@ func upgradeOrRollback(jsonContents []byte) {
 
 	DebugLog.Println("This session PID: %d rollback file: %s", os.Getpid(), rollbackInfoFilename)
 
-	if !disableFileVerification {
+	if err := upgradeconfig.VerifyOrder(); err != nil {
+		DebugLog.Printf("%v\n", err)
+		return
+	}
+	if err := upgradeconfig.VerifySettings(); err != nil {
+		DebugLog.Printf("%v\n", err)
+		return
+	}
+
+	// Pruning backups doesn't need the source files
+	if !disableFileVerification && action != appActionPruneBackups {
 		if err := upgradeconfig.VerifyFilesExist(); err != nil {
 			DebugLog.Printf("%v\n", err)
 			return
@@ -52,6 +67,29 @@ func upgradeOrRollback(jsonContents []byte) {
 		DebugLog.Println("All source files verified.")
 	}
 
+	if action == appActionPlan {
+		writePlan(&upgradeconfig)
+		return
+	}
+
+	// Only one session at a time runs with the same configuration on this host
+	localLock, err := softwareupgrade.AcquireLocalLock(jsonFilename, forceUnlock)
+	if err != nil {
+		DebugLog.Println("%v", err)
+		return
+	}
+	defer func() {
+		if err := localLock.Release(); err != nil {
+			DebugLog.Println("Unable to release lock: %s, %v", localLock.Filename(), err)
+		}
+	}()
+	lockFile, lockStaleAfter := upgradeconfig.GetLockSettings()
+
+	if action == appActionPruneBackups {
+		pruneBackups(&upgradeconfig)
+		return
+	}
+
 	// GroupNames is the name given to each combination of software
 	SoftwareGroupNames := upgradeconfig.GetGroupNames()
 	DebugLog.Println("%d groups defined: %v", len(SoftwareGroupNames), SoftwareGroupNames)
@@ -67,7 +105,18 @@ func upgradeOrRollback(jsonContents []byte) {
 			failCount, nodeCount int
 		)
 		for _, node := range nodes {
-			_, err := net.LookupIP(node)
+			// Nodes behind a jump host are resolved by the jump host, and might not be resolvable locally.
+			if len(upgradeconfig.GetNodeSSHInfo(node).ProxyJump) > 0 {
+				nodeCount++
+				continue
+			}
+			host, _, err := softwareupgrade.SplitNodeAddress(node, softwareupgrade.CDefaultSSHPort)
+			if err != nil {
+				msg = fmt.Sprintf("%sInvalid node %s: %v\n", msg, node, err)
+				failCount++
+				continue
+			}
+			_, err = net.LookupIP(host)
 			if err != nil {
 				msg = fmt.Sprintf("%sCan't resolve %s\n", msg, node)
 				failCount++
@@ -121,7 +170,7 @@ func upgradeOrRollback(jsonContents []byte) {
 					}
 					for _, software := range groupSoftware {
 						nodeInfo := upgradeconfig.GetNodeUpgradeInfo(node, software)
-						sshConfig := softwareupgrade.NewSSHConfig(nodeInfo.SSHUserName, nodeInfo.SSHCert, node)
+						sshConfig := nodeInfo.NewSSHConfig(node)
 						for _, dirInfo := range nodeInfo.Copy {
 							remoteDir := path.Dir(dirInfo.DestFilePath)
 							hostDir := fmt.Sprintf("%s-%s", node, remoteDir)
@@ -177,9 +226,31 @@ func upgradeOrRollback(jsonContents []byte) {
 		}
 	}
 
+	// The journal records each step of the upgrade as it's performed, so that an upgrade
+	// that's interrupted can be resumed from the last step performed. Nothing is performed by a dry run.
+	var journal *softwareupgrade.Journal
+	journalExists := softwareupgrade.FileExists(journalFilename)
+	if (action == appActionUpgrade || action == appActionResumeUpgrade) && !dryRun {
+		var err error
+		if journal, err = softwareupgrade.OpenJournal(journalFilename, rollbackSuffix); err != nil {
+			DebugLog.Println("%v", err)
+			return
+		}
+		defer journal.Close()
+		if journalExists {
+			// Continue backing up files with the suffix of the session being resumed, and use its files
+			resumeJournalSession(journal.Session())
+			DebugLog.Println("Resuming from journal: %s, session: %s", journal.Filename(), rollbackSuffix)
+		}
+	}
+
 	failedUpgradeInfo := softwareupgrade.NewFailedUpgradeInfo()
 	rollbackSession := softwareupgrade.NewRollbackSession(rollbackSuffix)
 
+	// The ID of a resumed session is the ID of the session being resumed
+	sessionRecord := startSessionRecord(softwareupgrade.GetBackupSuffix(), jsonContents)
+	defer finishSessionRecord(sessionRecord, rollbackSession)
+
 	var resumeUpgrade bool
 	defer func() {
 
@@ -232,8 +303,42 @@ func upgradeOrRollback(jsonContents []byte) {
 		}
 	case appActionResumeUpgrade:
 		{
-			if !softwareupgrade.FileExists(failedNodesFilename) {
-				DebugLog.Printf("Can't resume upgrade as %s doesn't exist.\n", failedNodesFilename)
+			switch {
+			case softwareupgrade.FileExists(failedNodesFilename):
+				{
+					data, err := softwareupgrade.ReadDataFromFile(failedNodesFilename)
+					if err == nil {
+						err = json.Unmarshal(data, &failedUpgradeInfo.FailedNodeSoftware)
+					}
+					if err != nil {
+						DebugLog.Printf("Unable to read data from the failed nodes session due to error: %v\n", err)
+						return
+					}
+				}
+			case journal != nil && journalExists:
+				{
+					// The failed nodes aren't saved if the upgrade was killed, so resume
+					// the software that the journal doesn't record as completed.
+					for _, softwareGroup := range SoftwareGroupNames {
+						groupSoftware := upgradeconfig.GetGroupSoftware(softwareGroup)
+						for _, node := range upgradeconfig.GetGroupNodes(softwareGroup) {
+							for _, software := range groupSoftware {
+								if !journal.Done(node, software, softwareupgrade.CStepCompleted, "") {
+									failedUpgradeInfo.AddNodeSoftware(node, software)
+								}
+							}
+						}
+					}
+				}
+			default:
+				{
+					DebugLog.Printf("Can't resume upgrade as neither %s nor %s exist.\n", failedNodesFilename, journalFilename)
+					return
+				}
+			}
+			if err := resumeRollbackSession(rollbackSession); err != nil {
+				DebugLog.Println("%v", err)
+				failedUpgradeInfo.Clear()
 				return
 			}
 			resumeUpgrade = true
@@ -244,7 +349,11 @@ func upgradeOrRollback(jsonContents []byte) {
 				data, err := softwareupgrade.ReadDataFromFile(rollbackInfoFilename)
 				if err == nil {
 					err = json.Unmarshal(data, &rollbackSession)
+					if err == nil {
+						err = checkRollbackConflicts(rollbackSession.SessionSuffix)
+					}
 					if err != nil {
+						DebugLog.Println("%v", err)
 						// Clear the data so that it's not persisted again
 						rollbackSession.RollbackInfo.Clear()
 						failedUpgradeInfo.Clear()
@@ -265,6 +374,13 @@ func upgradeOrRollback(jsonContents []byte) {
 				if err == nil {
 					err = json.Unmarshal(data, &failedUpgradeInfo.FailedNodeSoftware)
 					resumeUpgrade = err == nil && len(failedUpgradeInfo.FailedNodeSoftware) > 0
+					if resumeUpgrade {
+						if err = resumeRollbackSession(rollbackSession); err != nil {
+							DebugLog.Println("%v", err)
+							failedUpgradeInfo.Clear()
+							return
+						}
+					}
 				} else {
 					DebugLog.Printf("Unable to read data from the failed nodes session due to error: %v", err)
 				}
@@ -303,16 +419,28 @@ func upgradeOrRollback(jsonContents []byte) {
 		groupNodes := upgradeconfig.GetGroupNodes(softwareGroup)
 		if len(groupNodes) > 0 {
 			var doPause bool
-			DebugLog.Printf("Performing %s for software group: %s\n", mode, softwareGroup)
-			for _, node := range groupNodes {
-				if len(groupSoftware) == 0 {
-					continue
-				}
-				if Terminated() {
-					break
-				}
+			maxParallel := upgradeconfig.GetGroupMaxParallel(softwareGroup, parallel)
+			DebugLog.Printf("Performing %s for software group: %s, %d node(s) at a time\n", mode, softwareGroup, maxParallel)
+			if len(groupSoftware) > 0 && !Terminated() {
 				doPause = true
+			}
+			upgradeNode := func(node string) {
+				if len(groupSoftware) == 0 || Terminated() {
+					return
+				}
+				var hostKeyFailed bool
+
+				// The node is locked before its software is stopped, until all its software has been started
+				var remoteLock *softwareupgrade.RemoteLock
+				defer func() {
+					if remoteLock != nil {
+						if err := remoteLock.Release(); err != nil {
+							DebugLog.Println("Node: %s, %v", node, err)
+						}
+					}
+				}()
 				for _, software := range groupSoftware {
+					var upgradeFailed bool
 					if Terminated() {
 						break
 					}
@@ -366,18 +494,62 @@ func upgradeOrRollback(jsonContents []byte) {
 						}
 					}
 					DebugLog.Println(actionMsg)
-					sshConfig := softwareupgrade.NewSSHConfig(nodeInfo.SSHUserName, nodeInfo.SSHCert, node)
+					sshConfig := nodeInfo.NewSSHConfig(node)
+					nodeJournal := journal.ForNode(node, software)
 
-					// Only stop the software if it's not Delete Rollback and not Add
-					if action != appActionDeleteRollback && action != appActionAdd {
+					if nodeJournal.Done(softwareupgrade.CStepCompleted, "") {
+						DebugLog.Println("Node: %s has already been upgraded with software: %s, skipping", node, software)
+						failedUpgradeInfo.RemoveNodeSoftware(node, software)
+						continue
+					}
+
+					// Skip the stop, copy and start cycle if the node already has the files being upgraded to,
+					// unless the upgrade was interrupted, as the software might have been stopped
+					if (action == appActionUpgrade || action == appActionResumeUpgrade) && !nodeJournal.Started() {
+						upToDate, err := nodeInfo.IsUpToDate(sshConfig)
+						if err != nil {
+							DebugLog.Println("Unable to verify if node: %s is up to date with software: %s due to %v", node, software, err)
+							if softwareupgrade.IsHostKeyError(err) {
+								markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+								break
+							}
+						} else if upToDate {
+							DebugLog.Println("Node: %s is already up to date with software: %s, skipping", node, software)
+							failedUpgradeInfo.RemoveNodeSoftware(node, software)
+							recordStep(nodeJournal, remoteLock, softwareupgrade.CStepCompleted)
+							continue
+						}
+					}
+
+					if remoteLock == nil {
+						var err error
+						if remoteLock, err = softwareupgrade.AcquireRemoteLock(sshConfig, lockFile, lockStaleAfter, forceUnlock); err != nil {
+							DebugLog.Println("Unable to lock node: %s, %v", node, err)
+							markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+							break
+						}
+					}
+
+					// The steps of an interrupted upgrade that the journal records are skipped
+					upgraded := nodeJournal.Done(softwareupgrade.CStepUpgraded, "")
+					started := upgraded && nodeJournal.Done(softwareupgrade.CStepStarted, "")
+					if nodeJournal.Done(softwareupgrade.CStepStopped, "") || started {
+						DebugLog.Println("Node: %s, software: %s is already stopped or upgraded, continuing from the journal", node, software)
+					} else if action != appActionDeleteRollback && action != appActionAdd {
+						// Only stop the software if it's not Delete Rollback and not Add
 						// Stop the running software, upgrade it, then start the software
 						StopCmd := nodeInfo.StopCmd
 						StopResult, err := sshConfig.Run(StopCmd)
 						if err != nil { // If stop failed, skip the upgrade!
 							DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStop, err)
+							if softwareupgrade.IsHostKeyError(err) {
+								markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+								break
+							}
 							continue
 						}
 						DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStop, StopResult)
+						recordStep(nodeJournal, remoteLock, softwareupgrade.CStepStopped)
 					}
 
 					if !dryRun {
@@ -389,6 +561,11 @@ func upgradeOrRollback(jsonContents []byte) {
 									DebugLog.Println("Added software: %s to node: %s successfully", software, node)
 								} else {
 									DebugLog.Println("Failed to add software %s to node: %s", software, node)
+									if softwareupgrade.IsHostKeyError(err) {
+										DebugLog.Println("%v", err)
+										markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+										hostKeyFailed = true
+									}
 								}
 							}
 						case appActionDeleteRollback:
@@ -396,6 +573,10 @@ func upgradeOrRollback(jsonContents []byte) {
 								err := nodeInfo.RunDeleteRollback(sshConfig, rollbackSuffix)
 								if err != nil {
 									DebugLog.Println("Failed to delete rollback for node: %s, software: %s due to %v", node, software, err)
+									if softwareupgrade.IsHostKeyError(err) {
+										markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+										hostKeyFailed = true
+									}
 								} else {
 									DebugLog.Println("Deleted rollback for node: %s, software: %s", node, software)
 								}
@@ -411,32 +592,121 @@ func upgradeOrRollback(jsonContents []byte) {
 									rollbackSession.RollbackInfo.RemoveNodeSoftware(node, software)
 								}
 							}
-						case appActionUpgrade:
+						case appActionUpgrade, appActionResumeUpgrade:
 							{
-								err := nodeInfo.RunUpgrade(sshConfig) // the upgrade needs to either move or overwrite the older version
+								var err error
+								if upgraded {
+									DebugLog.Println("Node: %s has already been upgraded with software: %s, according to the journal", node, software)
+								} else {
+									err = nodeInfo.ResumeUpgrade(sshConfig, nodeJournal) // the upgrade needs to either move or overwrite the older version
+								}
 								if err != nil {
 									DebugLog.Println("Error during RunUpgrade: %v", err)
+									failedUpgradeInfo.AddNodeSoftware(node, software)
+									if softwareupgrade.IsHostKeyError(err) {
+										markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+										hostKeyFailed = true
+									} else {
+										upgradeFailed = true
+									}
 								} else {
 									DebugLog.Println("Upgraded node: %s with software %s successfully!", node, software)
 									failedUpgradeInfo.RemoveNodeSoftware(node, software)
 									rollbackSession.RollbackInfo.AddNodeSoftware(node, software)
+									sessionRecord.AddTouchedFiles(node, nodeInfo.GetDestFilePaths())
 								}
 							}
 						}
 					}
 
+					if hostKeyFailed {
+						break
+					}
+
+					if upgradeFailed && nodeInfo.OnFailure != softwareupgrade.CFailureContinue {
+						// with on_failure: halt, the software is left stopped, instead of being started with a partial upgrade
+						handleFailedSoftware(nodeInfo, sshConfig, node, software, groupSoftware, nil,
+							failedUpgradeInfo, rollbackSession, nodeJournal, remoteLock)
+						break
+					}
+
 					// Only start the software if it's not a delete rollback
 					if action != appActionDeleteRollback && action != appActionAdd {
-						StartCmd := nodeInfo.StartCmd
-						StartResult, err := sshConfig.Run(StartCmd)
-						if err != nil {
-							DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, err)
-							continue
+						if !started {
+							StartCmd := nodeInfo.StartCmd
+							StartResult, err := sshConfig.Run(StartCmd)
+							if err != nil {
+								DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, err)
+								handleFailedSoftware(nodeInfo, sshConfig, node, software, groupSoftware, err,
+									failedUpgradeInfo, rollbackSession, nodeJournal, remoteLock)
+								break
+							}
+							DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, StartResult)
+							recordStep(nodeJournal, remoteLock, softwareupgrade.CStepStarted)
+						}
+
+						// Verify the software is running correctly before moving on
+						if err := nodeInfo.RunHealthChecks(sshConfig); err != nil {
+							DebugLog.Println("Node: %s, software: %s, %v", node, software, err)
+							handleFailedSoftware(nodeInfo, sshConfig, node, software, groupSoftware, err,
+								failedUpgradeInfo, rollbackSession, nodeJournal, remoteLock)
+							break
+						}
+						recordStep(nodeJournal, remoteLock, softwareupgrade.CStepHealthChecked)
+						if !upgradeFailed {
+							recordStep(nodeJournal, remoteLock, softwareupgrade.CStepCompleted)
+						}
+					}
+				}
+			}
+
+			// Limit the number of nodes of the group that are stopped at the same time, so that, eg,
+			// enough validators keep running for blocks to be produced.
+			maxUnavailable := upgradeconfig.GetGroupMaxUnavailable(softwareGroup)
+			if maxUnavailable > 0 {
+				DebugLog.Println("At most %d node(s) of software group: %s will be unavailable at the same time", maxUnavailable, softwareGroup)
+			}
+			gate := softwareupgrade.NewUnavailableGate(maxUnavailable)
+			processNode := upgradeNode
+			upgradeNode = func(node string) {
+				if !gate.Acquire() {
+					DebugLog.Println("Skipping node: %s, as max_unavailable: %d nodes of software group: %s have failed", node, maxUnavailable, softwareGroup)
+					return
+				}
+				skipped := Terminated()
+				processNode(node)
+				failed := nodeFailed(failedUpgradeInfo, node, groupSoftware)
+				gate.Release(failed)
+				if action == appActionRollback && !dryRun {
+					failed = rollbackNodeFailed(rollbackSession, node, groupSoftware)
+				}
+				if !skipped {
+					sessionRecord.AddNodeResult(failed)
+				}
+			}
+
+			// Canary nodes are upgraded first, and the remaining nodes are only upgraded
+			// if the canaries remain healthy for the soak time.
+			remainingNodes := groupNodes
+			if action == appActionUpgrade || action == appActionResumeUpgrade {
+				var canaryNodes []string
+				canaryNodes, remainingNodes = upgradeconfig.GetGroupCanaries(softwareGroup)
+				if len(canaryNodes) > 0 && !Terminated() {
+					DebugLog.Println("Upgrading canary node(s): %v for software group: %s", canaryNodes, softwareGroup)
+					softwareupgrade.ForEachParallel(canaryNodes, maxParallel, upgradeNode)
+					if !Terminated() {
+						soak := upgradeconfig.Common.GroupSettings[softwareGroup].CanarySoak.Duration
+						if err := soakCanaries(&upgradeconfig, canaryNodes, groupSoftware, soak, failedUpgradeInfo); err != nil {
+							DebugLog.Println("Canary failed for software group: %s, %v", softwareGroup, err)
+							DebugLog.Println("Aborting %s, the remaining nodes are left untouched", mode)
+							Terminate()
+						} else {
+							DebugLog.Println("Canary node(s): %v are healthy", canaryNodes)
 						}
-						DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, StartResult)
 					}
 				}
 			}
+			softwareupgrade.ForEachParallel(remainingNodes, maxParallel, upgradeNode)
 			if Terminated() {
 				break
 			}
@@ -458,22 +728,259 @@ func upgradeOrRollback(jsonContents []byte) {
 	softwareupgrade.ClearSSHConfigCache()
 }
 
+// writePlan writes the steps the upgrade would run to stdout, without running them
+func writePlan(upgradeconfig *softwareupgrade.UpgradeConfig) {
+	plan := upgradeconfig.NewPlan(parallel, planRemote)
+	softwareupgrade.ClearSSHConfigCache()
+	switch strings.ToLower(planFormat) {
+	case "json":
+		{
+			data, err := json.MarshalIndent(plan, "", "  ")
+			if err != nil {
+				DebugLog.Println("Unable to marshal the plan: %v", err)
+				return
+			}
+			fmt.Println(string(data))
+		}
+	case "text":
+		{
+			plan.WriteText(os.Stdout)
+		}
+	default:
+		{
+			DebugLog.Println("Unknown plan format: %s", planFormat)
+		}
+	}
+}
+
+// pruneBackups removes all but the newest keep_backups backups of each remote file on each node,
+// and reports the space reclaimed on each node. Nothing is removed by a dry run.
+func pruneBackups(upgradeconfig *softwareupgrade.UpgradeConfig) {
+	defer softwareupgrade.ClearSSHConfigCache()
+	for _, softwareGroup := range upgradeconfig.GetGroupNames() {
+		if Terminated() {
+			break
+		}
+		groupSoftware := upgradeconfig.GetGroupSoftware(softwareGroup)
+		softwareupgrade.ForEachParallel(upgradeconfig.GetGroupNodes(softwareGroup), parallel, func(node string) {
+			var (
+				reclaimed   int64
+				removeCount int
+			)
+			for _, software := range groupSoftware {
+				if Terminated() {
+					break
+				}
+				nodeInfo := upgradeconfig.GetNodeUpgradeInfo(node, software)
+				if nodeInfo.KeepBackups <= 0 {
+					DebugLog.Println("Node: %s, keep_backups isn't specified for software: %s, skipping", node, software)
+					continue
+				}
+				sshConfig := nodeInfo.NewSSHConfig(node)
+				for _, destFilePath := range nodeInfo.GetDestFilePaths() {
+					removed, size, err := softwareupgrade.PruneBackups(sshConfig, destFilePath, nodeInfo.KeepBackups, dryRun)
+					if err != nil {
+						DebugLog.Println("Node: %s, %v", node, err)
+						continue
+					}
+					for _, backup := range removed {
+						if dryRun {
+							DebugLog.Println("Node: %s, would remove backup: %s (%d bytes)", node, backup.Path, backup.Size)
+						} else {
+							DebugLog.Println("Node: %s, removed backup: %s (%d bytes)", node, backup.Path, backup.Size)
+						}
+					}
+					reclaimed += size
+					removeCount += len(removed)
+				}
+			}
+			if dryRun {
+				DebugLog.Println("Node: %s, %d backup(s) would be removed, reclaiming %d bytes (dry run)", node, removeCount, reclaimed)
+			} else {
+				DebugLog.Println("Node: %s, removed %d backup(s), reclaimed %d bytes", node, removeCount, reclaimed)
+			}
+		})
+	}
+}
+
+// soakCanaries waits for the soak time, while running the health checks of the group software
+// on the canary nodes. An error is returned if a canary failed to upgrade, or becomes unhealthy.
+func soakCanaries(upgradeconfig *softwareupgrade.UpgradeConfig, canaryNodes, groupSoftware []string,
+	soak time.Duration, failedUpgradeInfo *softwareupgrade.FailedUpgradeInfo) (err error) {
+	checkCanaries := func() error {
+		for _, node := range canaryNodes {
+			for _, software := range groupSoftware {
+				if nodeFailed(failedUpgradeInfo, node, []string{software}) {
+					return fmt.Errorf("node: %s failed to upgrade software: %s", node, software)
+				}
+				nodeInfo := upgradeconfig.GetNodeUpgradeInfo(node, software)
+				if err := nodeInfo.RunHealthChecks(nodeInfo.NewSSHConfig(node)); err != nil {
+					return fmt.Errorf("node: %s, software: %s, %v", node, software, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if err = checkCanaries(); err != nil {
+		return
+	}
+	DebugLog.Println("Soaking canary node(s) for %s...", soak)
+	deadline := time.Now().Add(soak)
+	for time.Now().Before(deadline) {
+		if Terminated() {
+			return errors.New("terminated during the soak time")
+		}
+		wait := time.Until(deadline)
+		if wait > softwareupgrade.CDefaultCanaryCheckInterval {
+			wait = softwareupgrade.CDefaultCanaryCheckInterval
+		}
+		time.Sleep(wait)
+		if err = checkCanaries(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// handleFailedSoftware marks the node as failed, after the software failed to upgrade, start, or pass its health checks,
+// given by err, if it's known. When upgrading, the on_failure setting of the software is then applied,
+// by either rolling back the software, or halting the remaining nodes, leaving the software as it is.
+// The remaining nodes are also halted if err, or the health checks after a rollback, fail a check with halt_on_failure.
+func handleFailedSoftware(nodeInfo *softwareupgrade.NodeInfoContainer, runner softwareupgrade.Runner, node, software string,
+	groupSoftware []string, err error, failedUpgradeInfo *softwareupgrade.FailedUpgradeInfo,
+	rollbackSession *softwareupgrade.RollbackSession, nodeJournal *softwareupgrade.NodeJournal, remoteLock *softwareupgrade.RemoteLock) {
+	if action != appActionRollback {
+		markNodeFailed(failedUpgradeInfo, node, groupSoftware)
+	}
+	halt := softwareupgrade.IsHaltingHealthCheckError(err)
+	if action == appActionUpgrade || action == appActionResumeUpgrade {
+		switch nodeInfo.OnFailure {
+		case softwareupgrade.CFailureRollback:
+			{
+				err = rollbackFailedUpgrade(nodeInfo, runner, node, software, rollbackSession, nodeJournal, remoteLock)
+				halt = halt || softwareupgrade.IsHaltingHealthCheckError(err)
+			}
+		case softwareupgrade.CFailureHalt:
+			{
+				halt = true
+			}
+		}
+	}
+	if halt {
+		DebugLog.Println("Halting %s of the remaining nodes, as software: %s on node: %s failed", mode, software, node)
+		Terminate()
+	}
+}
+
+// rollbackFailedUpgrade restores the files backed up by the failed upgrade of the software on the node,
+// then restarts the software, and verifies it with the health checks of the software.
+// The software remains recorded as failed, so that it's upgraded when the upgrade is resumed.
+// If the files can't be restored, the software is left stopped, and it remains in the rollback info,
+// so that it can be rolled back later.
+func rollbackFailedUpgrade(nodeInfo *softwareupgrade.NodeInfoContainer, runner softwareupgrade.Runner,
+	node, software string, rollbackSession *softwareupgrade.RollbackSession, nodeJournal *softwareupgrade.NodeJournal,
+	remoteLock *softwareupgrade.RemoteLock) (err error) {
+	DebugLog.Println("Rolling back software: %s on node: %s", software, node)
+	if _, err := runner.Run(nodeInfo.StopCmd); err != nil { // the software might have been started
+		DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStop, err)
+	}
+	if err = nodeInfo.RunRollback(runner, rollbackSuffix); err != nil {
+		DebugLog.Println("Rollback failed for node: %s, software: %s due to %v", node, software, err)
+		return
+	}
+	rollbackSession.RollbackInfo.RemoveNodeSoftware(node, software)
+	recordStep(nodeJournal, remoteLock, softwareupgrade.CStepRolledBack) // the upgrade is resumed from the beginning
+
+	StartResult, err := runner.Run(nodeInfo.StartCmd)
+	if err != nil {
+		DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, err)
+		return
+	}
+	DebugLog.Printf(softwareupgrade.CNodeMsgSSS, node, softwareupgrade.CStart, StartResult)
+	if err = nodeInfo.RunHealthChecks(runner); err != nil {
+		DebugLog.Println("Node: %s, software: %s, after rollback, %v", node, software, err)
+		return
+	}
+	DebugLog.Println("Rolled back node: %s with software: %s successfully", node, software)
+	return
+}
+
+// recordStep records the step in the journal. The session is halted if the step can't be recorded,
+// as the upgrade couldn't be resumed from the right step if it was interrupted.
+// The lock on the node, if it's held, is refreshed, so that it doesn't become stale while the node is upgraded.
+// The session is also halted if the lock has been taken over by another session.
+func recordStep(nodeJournal *softwareupgrade.NodeJournal, remoteLock *softwareupgrade.RemoteLock, step string) {
+	if err := nodeJournal.Record(step, ""); err != nil {
+		DebugLog.Println("Halting %s, as the journal can't be written", mode)
+		Terminate()
+	}
+	if remoteLock == nil {
+		return
+	}
+	if err := remoteLock.Refresh(); err != nil {
+		DebugLog.Println("%v", err)
+		if _, ok := err.(*softwareupgrade.LockedError); ok {
+			DebugLog.Println("Halting %s, as the lock on the node has been taken over", mode)
+			Terminate()
+		}
+	}
+}
+
+// nodeFailed returns true if any of the software of the node failed to upgrade
+func nodeFailed(failedUpgradeInfo *softwareupgrade.FailedUpgradeInfo, node string, groupSoftware []string) bool {
+	// Failures are only recorded when upgrading, and a dry run doesn't remove the recorded software
+	if dryRun || (action != appActionUpgrade && action != appActionResumeUpgrade) {
+		return false
+	}
+	for _, software := range groupSoftware {
+		if failedUpgradeInfo.ExistsNodeSoftware(node, software) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackNodeFailed returns true if any of the software of the node remains to be rolled back
+func rollbackNodeFailed(rollbackSession *softwareupgrade.RollbackSession, node string, groupSoftware []string) bool {
+	for _, software := range groupSoftware {
+		if rollbackSession.RollbackInfo.ExistsNodeSoftware(node, software) {
+			return true
+		}
+	}
+	return false
+}
+
+// markNodeFailed records all the software of the given node as failed, so that
+// a node that can't be trusted, eg, due to a host key mismatch, is retried later.
+func markNodeFailed(failedUpgradeInfo *softwareupgrade.FailedUpgradeInfo, node string, groupSoftware []string) {
+	DebugLog.Println("Marking node: %s as failed", node)
+	for _, software := range groupSoftware {
+		failedUpgradeInfo.AddNodeSoftware(node, software)
+	}
+}
+
 func main() {
-	fmt.Println(softwareupgrade.CEximchainUpgradeTitle)
+	fmt.Fprintln(os.Stderr, softwareupgrade.CEximchainUpgradeTitle)
 
 	rollbackSuffix = softwareupgrade.GetBackupSuffix()
-	defaultRollbackName := fmt.Sprintf("~/Upgrade-Rollback-%s.session", rollbackSuffix)
-	defaultFailedNodesFilename := fmt.Sprintf("~/Upgrade-Failed-%s.session", rollbackSuffix)
 
-	flag.StringVar(&mode, "mode", "upgrade", "mode (add|resume-upgrade|upgrade|rollback|delete-rollback)")
+	flag.StringVar(&mode, "mode", "upgrade", "mode (add|resume-upgrade|upgrade|rollback|delete-rollback|plan|sessions|prune-backups)")
 	flag.BoolVar(&debug, "debug", false, "Specifies debug mode")
 	flag.StringVar(&debugLogFilename, "debug-log", `~/Upgrade-debug.log`, "Specifies the debug log filename where logs are written to")
 	flag.StringVar(&jsonFilename, "json", "", "Specifies the JSON configuration file to load nodes from")
-	flag.StringVar(&failedNodesFilename, "failed-nodes", defaultFailedNodesFilename, "Specifes the file to load/save nodes that failed to upgrade")
-	flag.StringVar(&rollbackInfoFilename, "rollback-filename", defaultRollbackName, "Specifies the rollback filename for this session")
+	flag.StringVar(&failedNodesFilename, "failed-nodes", "", "Specifes the file to load/save nodes that failed to upgrade (default: Upgrade-Failed-<session>.session in the session directory)")
+	flag.StringVar(&rollbackInfoFilename, "rollback-filename", "", "Specifies the rollback filename for this session (default: Upgrade-Rollback-<session>.session in the session directory)")
+	flag.StringVar(&journalFilename, "journal", "", "Specifies the journal that records each step of the upgrade, to resume the upgrade from (default: Upgrade-Journal-<session>.session in the session directory)")
+	flag.StringVar(&sessionDir, "session-dir", "~/Upgrade-Sessions", "Specifies the directory that records the sessions, and contains their files")
+	flag.StringVar(&sessionID, "session", "", "Specifies the ID of the session to rollback, delete-rollback or resume-upgrade, as listed by the sessions mode")
 	flag.BoolVar(&disableNodeVerification, "disable-node-verification", false, "Disables node IP resolution verification")
 	flag.BoolVar(&disableFileVerification, "disable-file-verification", false, "Disables source file existence verification")
 	flag.BoolVar(&disableTargetDirVerification, "disable-target-dir-verification", false, "Disables target directory existence verification")
+	flag.IntVar(&parallel, "parallel", 1, "Specifies the number of nodes in a software group to process at the same time, unless max_parallel is set for the group")
+	flag.StringVar(&planFormat, "plan-format", "text", "Specifies the format of the plan, text or json")
+	flag.BoolVar(&planRemote, "plan-remote", true, "Reads the remote files for the plan, to compare them with the local files, without modifying the nodes")
+	flag.BoolVar(&forceUnlock, "force-unlock", false, "Removes the locks held by another session, locally and on the nodes, even if they're not stale")
 	flag.BoolVar(&dryRun, "dry-run", true, "Enables testing mode, doesn't perform actual action, but starts and stops the software running on remote nodes")
 	flag.Parse()
 
@@ -498,6 +1005,28 @@ func main() {
 		{
 			action = appActionUpgrade
 		}
+	case "plan":
+		{
+			action = appActionPlan
+		}
+	case "sessions":
+		{
+			action = appActionSessions
+		}
+	case "prune-backups":
+		{
+			action = appActionPruneBackups
+		}
+	}
+
+	if action == appActionSessions {
+		var err error
+		if sessionStore, err = softwareupgrade.NewSessionStore(sessionDir); err == nil {
+			listSessions()
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
 	}
 
 	// Ensures that JSONFilename is provided by user
@@ -509,6 +1038,11 @@ func main() {
 		return
 	}
 
+	if err := openSessionStore(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
 	if debug && debugLogFilename != "" {
 		DebugLog.EnableDebug()
 		if err := DebugLog.EnableDebugLog(debugLogFilename); err == nil {
@@ -520,6 +1054,9 @@ func main() {
 
 	DebugLog.Debugln(softwareupgrade.CEximchainUpgradeTitle)
 	DebugLog.EnablePrintConsole()
+	if action == appActionPlan {
+		DebugLog.SetConsole(os.Stderr) // stdout only contains the plan
+	}
 
 	// Read JSON configuration file
 	if expandedJSONFilename, err := softwareupgrade.Expand(jsonFilename); err == nil {
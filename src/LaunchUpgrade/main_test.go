@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"softwareupgrade"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRunner records the commands run on a node, and fails the commands that start with any of failing
+type fakeRunner struct {
+	commands []string
+	failing  []string
+}
+
+func (runner *fakeRunner) Run(cmd string) (string, error) {
+	runner.commands = append(runner.commands, cmd)
+	for _, prefix := range runner.failing {
+		if strings.HasPrefix(cmd, prefix) {
+			return "", fmt.Errorf("%s failed", cmd)
+		}
+	}
+	return "", nil
+}
+
+// newFailureTest sets up the upgrade of geth on node1 with the given on_failure,
+// and returns a func that restores the globals changed.
+func newFailureTest(onFailure string) (nodeInfo *softwareupgrade.NodeInfoContainer, failedUpgradeInfo *softwareupgrade.FailedUpgradeInfo,
+	rollbackSession *softwareupgrade.RollbackSession, restore func()) {
+	savedAction, savedRollbackSuffix := action, rollbackSuffix
+	action, rollbackSuffix = appActionUpgrade, ".bak"
+	restore = func() {
+		action, rollbackSuffix = savedAction, savedRollbackSuffix
+		atomic.StoreInt32(&terminated, 0)
+	}
+
+	nodeInfo = &softwareupgrade.NodeInfoContainer{}
+	nodeInfo.StopCmd, nodeInfo.StartCmd, nodeInfo.OnFailure = "stop geth", "start geth", onFailure
+	nodeInfo.Copy = map[string]softwareupgrade.UpgradeStruct{
+		"1": {SourceFilePath: "geth", DestFilePath: "/usr/local/bin/geth", UserGroup: "root:root"},
+	}
+	nodeInfo.HealthChecks = []softwareupgrade.HealthCheck{{Type: softwareupgrade.CHealthCheckCommand, Command: "geth-healthy"}}
+
+	failedUpgradeInfo = softwareupgrade.NewFailedUpgradeInfo()
+	rollbackSession = softwareupgrade.NewRollbackSession(".bak")
+	rollbackSession.RollbackInfo.AddNodeSoftware("node1", "geth")
+	return
+}
+
+func TestHandleFailedSoftwareRollback(t *testing.T) {
+	nodeInfo, failedUpgradeInfo, rollbackSession, restore := newFailureTest(softwareupgrade.CFailureRollback)
+	defer restore()
+
+	runner := &fakeRunner{}
+	healthErr := &softwareupgrade.HealthCheckError{Check: "command", Reason: errors.New("unhealthy")}
+	handleFailedSoftware(nodeInfo, runner, "node1", "geth", []string{"geth"}, healthErr, failedUpgradeInfo, rollbackSession, nil, nil)
+
+	expected := []string{
+		"stop geth",
+		"sudo mv /usr/local/bin/geth.bak /usr/local/bin/geth",
+		"sudo chown root:root /usr/local/bin/geth",
+		"start geth",
+		"timeout 10 bash -c geth-healthy",
+	}
+	if fmt.Sprint(runner.commands) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the rollback to run %q, got %q", expected, runner.commands)
+	}
+	if !failedUpgradeInfo.ExistsNodeSoftware("node1", "geth") {
+		t.Fatal("Expected the node to be marked as failed")
+	}
+	if rollbackSession.RollbackInfo.ExistsNodeSoftware("node1", "geth") {
+		t.Fatal("Expected the software that was rolled back to be removed from the rollback info")
+	}
+	if Terminated() {
+		t.Fatal("Expected the remaining nodes not to be halted")
+	}
+}
+
+func TestHandleFailedSoftwareHalt(t *testing.T) {
+	nodeInfo, failedUpgradeInfo, rollbackSession, restore := newFailureTest(softwareupgrade.CFailureHalt)
+	defer restore()
+
+	runner := &fakeRunner{}
+	handleFailedSoftware(nodeInfo, runner, "node1", "geth", []string{"geth"}, errors.New("start failed"), failedUpgradeInfo, rollbackSession, nil, nil)
+
+	if len(runner.commands) != 0 {
+		t.Fatalf("Expected the software to be left stopped, got %q", runner.commands)
+	}
+	if !failedUpgradeInfo.ExistsNodeSoftware("node1", "geth") {
+		t.Fatal("Expected the node to be marked as failed")
+	}
+	if !Terminated() {
+		t.Fatal("Expected the remaining nodes to be halted")
+	}
+}
+
+func TestHandleFailedSoftwareFailedRollback(t *testing.T) {
+	nodeInfo, failedUpgradeInfo, rollbackSession, restore := newFailureTest(softwareupgrade.CFailureRollback)
+	defer restore()
+
+	runner := &fakeRunner{failing: []string{"sudo mv "}}
+	handleFailedSoftware(nodeInfo, runner, "node1", "geth", []string{"geth"}, errors.New("upgrade failed"), failedUpgradeInfo, rollbackSession, nil, nil)
+
+	for _, cmd := range runner.commands {
+		if cmd == nodeInfo.StartCmd {
+			t.Fatalf("Expected the software to be left stopped, got %q", runner.commands)
+		}
+	}
+	if !rollbackSession.RollbackInfo.ExistsNodeSoftware("node1", "geth") {
+		t.Fatal("Expected the software that wasn't rolled back to remain in the rollback info")
+	}
+	if !failedUpgradeInfo.ExistsNodeSoftware("node1", "geth") {
+		t.Fatal("Expected the node to be marked as failed")
+	}
+}
+
+func TestSoakCanariesDryRun(t *testing.T) {
+	savedAction, savedDryRun := action, dryRun
+	defer func() {
+		action, dryRun = savedAction, savedDryRun
+		softwareupgrade.ClearSSHConfigCache()
+	}()
+
+	// a new upgrade records every node and software as failed, until it's upgraded
+	var upgradeconfig softwareupgrade.UpgradeConfig
+	canaryNodes, groupSoftware := []string{"node1"}, []string{"quorum"}
+	failedUpgradeInfo := softwareupgrade.NewFailedUpgradeInfo()
+	failedUpgradeInfo.AddNodeSoftware("node1", "quorum")
+
+	// a dry run doesn't upgrade the canaries, so they aren't failed
+	action, dryRun = appActionUpgrade, true
+	if err := soakCanaries(&upgradeconfig, canaryNodes, groupSoftware, 0, failedUpgradeInfo); err != nil {
+		t.Fatalf("Expected the canaries of a dry run to pass, got: %v", err)
+	}
+
+	dryRun = false
+	if err := soakCanaries(&upgradeconfig, canaryNodes, groupSoftware, 0, failedUpgradeInfo); err == nil {
+		t.Fatal("Expected the canary that failed to upgrade to fail the canary stage")
+	}
+}
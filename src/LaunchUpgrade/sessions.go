@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"softwareupgrade"
+	"strings"
+	"time"
+)
+
+var (
+	sessionDir, sessionID string
+	sessionStore          *softwareupgrade.SessionStore
+)
+
+// listSessions writes the sessions in the session store to stdout
+func listSessions() {
+	records, err := sessionStore.List()
+	if err != nil {
+		DebugLog.Println("Unable to list sessions: %v", err)
+		return
+	}
+	softwareupgrade.WriteSessions(os.Stdout, records)
+}
+
+// openSessionStore opens the session store, which records every session, and contains the files of
+// the session, then sets the files of this session. As a plan has no side effects, it isn't recorded,
+// and the session store isn't created for it.
+func openSessionStore() (err error) {
+	if action == appActionPlan {
+		return
+	}
+	if sessionStore, err = softwareupgrade.NewSessionStore(sessionDir); err != nil {
+		return
+	}
+	if sessionID != "" {
+		if err = selectSession(sessionID); err != nil {
+			return
+		}
+	}
+	setSessionFilenames()
+	return
+}
+
+// selectSession uses the files of the session with the given ID, so that it can be rolled back,
+// have its rollback deleted, or be resumed.
+func selectSession(id string) (err error) {
+	record, err := sessionStore.Load(id)
+	if err != nil {
+		return
+	}
+	switch action {
+	case appActionRollback, appActionDeleteRollback:
+		{
+			rollbackInfoFilename = record.RollbackFilename
+		}
+	case appActionResumeUpgrade:
+		{
+			// the files replaced when the session is resumed are added to the session's rollback,
+			// so that rolling back the session restores the files replaced by all its runs
+			failedNodesFilename, journalFilename = record.FailedNodesFilename, record.JournalFilename
+			rollbackInfoFilename = record.RollbackFilename
+		}
+	default:
+		{
+			err = fmt.Errorf("a session can't be selected in %s mode", mode)
+		}
+	}
+	return
+}
+
+// setSessionFilenames sets the files of this session that weren't specified, or selected by -session,
+// to files in the session store named after the session's suffix
+func setSessionFilenames() {
+	if rollbackInfoFilename == "" {
+		rollbackInfoFilename = sessionFilename("Rollback", rollbackSuffix)
+	}
+	if failedNodesFilename == "" {
+		failedNodesFilename = sessionFilename("Failed", rollbackSuffix)
+	}
+	if journalFilename == "" {
+		journalFilename = sessionFilename("Journal", rollbackSuffix)
+	}
+}
+
+// sessionFilename returns the file of the given kind, eg, Rollback, of the session with the given suffix
+func sessionFilename(kind, suffix string) string {
+	return sessionStore.Filename(fmt.Sprintf("Upgrade-%s-%s.session", kind, suffix))
+}
+
+// resumeJournalSession continues the session recorded by the journal being resumed, so that files are backed up
+// with its suffix, and its rollback and failed nodes files are used, instead of the files named after this
+// session's suffix, unless they were specified.
+func resumeJournalSession(id string) {
+	if id != rollbackSuffix {
+		if rollbackInfoFilename == sessionFilename("Rollback", rollbackSuffix) {
+			rollbackInfoFilename = sessionFilename("Rollback", id)
+		}
+		if failedNodesFilename == sessionFilename("Failed", rollbackSuffix) {
+			failedNodesFilename = sessionFilename("Failed", id)
+		}
+	}
+	rollbackSuffix = id
+	softwareupgrade.SetBackupSuffix(rollbackSuffix)
+}
+
+// resumeRollbackSession loads the rollback information saved by the session being resumed, if any,
+// so that the files replaced when it's resumed are added to it, instead of replacing it.
+func resumeRollbackSession(rollbackSession *softwareupgrade.RollbackSession) (err error) {
+	if !softwareupgrade.FileExists(rollbackInfoFilename) {
+		return
+	}
+	data, err := softwareupgrade.ReadDataFromFile(rollbackInfoFilename)
+	if err == nil {
+		err = json.Unmarshal(data, rollbackSession)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read the rollback information of the resumed session from %s: %v", rollbackInfoFilename, err)
+	}
+	if rollbackSession.RollbackInfo == nil {
+		rollbackSession.RollbackInfo = softwareupgrade.NewFailedUpgradeInfo()
+	}
+	return
+}
+
+// checkRollbackConflicts returns an error if a session newer than the given session replaced
+// the same files on the same nodes, as rolling back the session would undo those changes.
+// A session without a record, eg, one from before sessions were recorded, isn't checked,
+// but the rollback is refused if the record can't be read.
+func checkRollbackConflicts(id string) error {
+	record, err := sessionStore.Load(id)
+	if errors.Is(err, os.ErrNotExist) {
+		DebugLog.Println("Unable to check for newer sessions, %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Can't roll back session %s, as its record can't be read: %v", id, err)
+	}
+	conflicts, err := sessionStore.FindConflicts(record)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		var ids []string
+		for _, conflict := range conflicts {
+			ids = append(ids, conflict.ID)
+		}
+		return fmt.Errorf("Can't roll back session %s, as newer session(s): %s replaced the same files, roll them back first",
+			id, strings.Join(ids, ", "))
+	}
+	return nil
+}
+
+// startSessionRecord records this session in the session store, continuing the record
+// of the session being resumed, if any.
+func startSessionRecord(id string, jsonContents []byte) (record *softwareupgrade.SessionRecord) {
+	recordMode := mode
+	if dryRun {
+		recordMode = fmt.Sprintf("%s (dry run)", mode)
+	}
+	if existing, err := sessionStore.Load(id); err == nil {
+		record = existing
+		record.Mode = recordMode
+		record.End = time.Time{}
+	} else {
+		configFilename := jsonFilename
+		if absFilename, err := filepath.Abs(configFilename); err == nil {
+			configFilename = absFilename
+		}
+		record = softwareupgrade.NewSessionRecord(id, recordMode, configFilename, jsonContents)
+	}
+	record.RollbackFilename, record.FailedNodesFilename = rollbackInfoFilename, failedNodesFilename
+	if action == appActionUpgrade || action == appActionResumeUpgrade {
+		record.JournalFilename = journalFilename
+	}
+	saveSessionRecord(record)
+	return
+}
+
+// finishSessionRecord records the end of this session, and for a rollback, or a delete rollback,
+// the state of the session rolled back
+func finishSessionRecord(record *softwareupgrade.SessionRecord, rollbackSession *softwareupgrade.RollbackSession) {
+	record.End = time.Now().UTC()
+	if (action == appActionRollback || action == appActionDeleteRollback) && rollbackSession.SessionSuffix != record.ID {
+		record.TargetSession = rollbackSession.SessionSuffix
+		if target, err := sessionStore.Load(record.TargetSession); err == nil && !dryRun && appStatus == "completed" {
+			if action == appActionRollback {
+				target.RolledBack = rollbackSession.RollbackInfo.Empty()
+			} else {
+				target.RollbackDeleted = true
+			}
+			saveSessionRecord(target)
+		}
+	}
+	saveSessionRecord(record)
+}
+
+func saveSessionRecord(record *softwareupgrade.SessionRecord) {
+	if err := sessionStore.Save(record); err != nil {
+		DebugLog.Println("Unable to save session %s: %v", record.ID, err)
+	}
+}
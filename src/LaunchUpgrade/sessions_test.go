@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"softwareupgrade"
+	"testing"
+)
+
+// runSession simulates a run of LaunchUpgrade in the given mode, selecting the given session, if any,
+// and sets the files of the run
+func runSession(t *testing.T, runMode string, runAction tAction, suffix, id string) {
+	mode, action, rollbackSuffix, sessionID = runMode, runAction, suffix, id
+	rollbackInfoFilename, failedNodesFilename, journalFilename = "", "", ""
+	if sessionID != "" {
+		if err := selectSession(sessionID); err != nil {
+			t.Fatalf("Unable to select session %s: %v", sessionID, err)
+		}
+	}
+	setSessionFilenames()
+}
+
+// upgradeSession simulates upgrading the given node in the session, and saving its rollback information
+func upgradeSession(t *testing.T, id, node string) {
+	rollbackSession := softwareupgrade.NewRollbackSession(id)
+	if action == appActionResumeUpgrade {
+		if err := resumeRollbackSession(rollbackSession); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := startSessionRecord(id, []byte("{}"))
+	rollbackSession.RollbackInfo.AddNodeSoftware(node, "quorum")
+	data, err := json.Marshal(rollbackSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := softwareupgrade.SaveDataToFile(rollbackInfoFilename, data); err != nil {
+		t.Fatal(err)
+	}
+	finishSessionRecord(record, rollbackSession)
+}
+
+func TestResumeSessionRollback(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	// the runs set the package's flags and files, which are restored for the other tests
+	savedMode, savedAction, savedSuffix, savedSessionID := mode, action, rollbackSuffix, sessionID
+	savedRollback, savedFailedNodes, savedJournal := rollbackInfoFilename, failedNodesFilename, journalFilename
+	savedStore, savedJSON, savedDryRun := sessionStore, jsonFilename, dryRun
+	defer func() {
+		mode, action, rollbackSuffix, sessionID = savedMode, savedAction, savedSuffix, savedSessionID
+		rollbackInfoFilename, failedNodesFilename, journalFilename = savedRollback, savedFailedNodes, savedJournal
+		sessionStore, jsonFilename, dryRun = savedStore, savedJSON, savedDryRun
+	}()
+	if sessionStore, err = softwareupgrade.NewSessionStore(tempdir); err != nil {
+		t.Fatal(err)
+	}
+	jsonFilename, dryRun = filepath.Join(tempdir, "upgrade.json"), false
+	const id = "2019-01-01T00-00-00Z"
+
+	// node1 is upgraded, and node2 fails
+	runSession(t, "upgrade", appActionUpgrade, id, "")
+	upgradeSession(t, id, "node1")
+	firstRollbackFilename := rollbackInfoFilename
+
+	// the session is resumed later, with a different suffix, and upgrades node2
+	runSession(t, "resume-upgrade", appActionResumeUpgrade, "2019-01-02T00-00-00Z", id)
+	if rollbackInfoFilename != firstRollbackFilename {
+		t.Fatalf("Expected the resumed session to use its rollback file: %s, got: %s", firstRollbackFilename, rollbackInfoFilename)
+	}
+	upgradeSession(t, id, "node2")
+
+	// rolling back the session restores the files replaced by both runs
+	runSession(t, "rollback", appActionRollback, "2019-01-03T00-00-00Z", id)
+	data, err := softwareupgrade.ReadDataFromFile(rollbackInfoFilename)
+	if err != nil {
+		t.Fatalf("Unable to read the rollback of the session: %v", err)
+	}
+	var rollbackSession softwareupgrade.RollbackSession
+	if err := json.Unmarshal(data, &rollbackSession); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"node1": {"quorum"}, "node2": {"quorum"}}
+	if rollbackSession.SessionSuffix != id || !reflect.DeepEqual(rollbackSession.RollbackInfo.FailedNodeSoftware, expected) {
+		t.Fatalf("Expected the rollback of session %s to contain: %v, got: %s", id, expected, data)
+	}
+}
+
+func TestResumeJournalSession(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	savedMode, savedAction, savedSuffix, savedSessionID := mode, action, rollbackSuffix, sessionID
+	savedRollback, savedFailedNodes, savedJournal := rollbackInfoFilename, failedNodesFilename, journalFilename
+	savedStore, savedJSON, savedDryRun := sessionStore, jsonFilename, dryRun
+	savedBackupSuffix := softwareupgrade.GetBackupSuffix()
+	defer func() {
+		mode, action, rollbackSuffix, sessionID = savedMode, savedAction, savedSuffix, savedSessionID
+		rollbackInfoFilename, failedNodesFilename, journalFilename = savedRollback, savedFailedNodes, savedJournal
+		sessionStore, jsonFilename, dryRun = savedStore, savedJSON, savedDryRun
+		softwareupgrade.SetBackupSuffix(savedBackupSuffix)
+	}()
+	if sessionStore, err = softwareupgrade.NewSessionStore(tempdir); err != nil {
+		t.Fatal(err)
+	}
+	jsonFilename, dryRun = filepath.Join(tempdir, "upgrade.json"), false
+	const id = "2019-01-01T00-00-00Z"
+
+	// node1 is upgraded, and the upgrade is killed, leaving its journal
+	runSession(t, "upgrade", appActionUpgrade, id, "")
+	journal, err := softwareupgrade.OpenJournal(journalFilename, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Record("node1", "quorum", softwareupgrade.CStepCompleted, "")
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgradeSession(t, id, "node1")
+	firstRollbackFilename, firstFailedNodesFilename, firstJournalFilename := rollbackInfoFilename, failedNodesFilename, journalFilename
+
+	// the upgrade is resumed with -journal, without -session
+	runSession(t, "resume-upgrade", appActionResumeUpgrade, "2019-01-02T00-00-00Z", "")
+	journalFilename = firstJournalFilename
+	setSessionFilenames()
+	if journal, err = softwareupgrade.OpenJournal(journalFilename, rollbackSuffix); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	resumeJournalSession(journal.Session())
+	if rollbackInfoFilename != firstRollbackFilename || failedNodesFilename != firstFailedNodesFilename {
+		t.Fatalf("Expected the resumed session to use its files: %s, %s, got: %s, %s",
+			firstRollbackFilename, firstFailedNodesFilename, rollbackInfoFilename, failedNodesFilename)
+	}
+	if softwareupgrade.GetBackupSuffix() != id {
+		t.Fatalf("Expected files to be backed up with the suffix: %s, got: %s", id, softwareupgrade.GetBackupSuffix())
+	}
+	upgradeSession(t, id, "node2")
+
+	// rolling back the session restores the files replaced by both runs
+	data, err := softwareupgrade.ReadDataFromFile(firstRollbackFilename)
+	if err != nil {
+		t.Fatalf("Unable to read the rollback of the session: %v", err)
+	}
+	var rollbackSession softwareupgrade.RollbackSession
+	if err := json.Unmarshal(data, &rollbackSession); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"node1": {"quorum"}, "node2": {"quorum"}}
+	if !reflect.DeepEqual(rollbackSession.RollbackInfo.FailedNodeSoftware, expected) {
+		t.Fatalf("Expected the rollback of session %s to contain: %v, got: %s", id, expected, data)
+	}
+
+	// files that are specified are kept
+	runSession(t, "resume-upgrade", appActionResumeUpgrade, "2019-01-03T00-00-00Z", "")
+	rollbackInfoFilename = filepath.Join(tempdir, "rollback.session")
+	setSessionFilenames()
+	resumeJournalSession(id)
+	if rollbackInfoFilename != filepath.Join(tempdir, "rollback.session") {
+		t.Fatalf("Expected the specified rollback file to be kept, got: %s", rollbackInfoFilename)
+	}
+}
+
+func TestOpenSessionStorePlan(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	savedAction, savedStore, savedSessionDir := action, sessionStore, sessionDir
+	savedRollback, savedFailedNodes, savedJournal := rollbackInfoFilename, failedNodesFilename, journalFilename
+	defer func() {
+		action, sessionStore, sessionDir = savedAction, savedStore, savedSessionDir
+		rollbackInfoFilename, failedNodesFilename, journalFilename = savedRollback, savedFailedNodes, savedJournal
+	}()
+	sessionDir = filepath.Join(tempdir, "Upgrade-Sessions")
+	rollbackInfoFilename, failedNodesFilename, journalFilename = "", "", ""
+
+	// a plan doesn't create the session store
+	action = appActionPlan
+	if err := openSessionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if softwareupgrade.FileExists(sessionDir) {
+		t.Fatalf("A plan shouldn't create the session store: %s", sessionDir)
+	}
+
+	action = appActionUpgrade
+	if err := openSessionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if !softwareupgrade.FileExists(sessionDir) || filepath.Dir(rollbackInfoFilename) != sessionDir {
+		t.Fatalf("Expected the session store: %s to be created, and contain the rollback file: %s", sessionDir, rollbackInfoFilename)
+	}
+}
+
+func TestCheckRollbackConflicts(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	savedStore := sessionStore
+	defer func() {
+		sessionStore = savedStore
+	}()
+	if sessionStore, err = softwareupgrade.NewSessionStore(tempdir); err != nil {
+		t.Fatal(err)
+	}
+
+	// a session without a record isn't checked
+	if err = checkRollbackConflicts("2019-01-01T00-00-00Z"); err != nil {
+		t.Fatalf("Expected a session without a record to be rolled back, got: %v", err)
+	}
+
+	// a record that can't be read refuses the rollback
+	const id = "2019-01-02T00-00-00Z"
+	if err = ioutil.WriteFile(sessionStore.Filename(id+".json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkRollbackConflicts(id); err == nil {
+		t.Fatal("Expected the rollback of a session whose record can't be read to be refused")
+	}
+}
@@ -3,18 +3,25 @@ package main
 import (
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 )
 
 var (
 	signalCh   chan os.Signal
-	terminated bool
+	terminated int32 // accessed atomically, as nodes are upgraded concurrently
 )
 
 // Terminated returns whether user has requested termination via Ctrl C,
 // or other means
 func Terminated() bool {
-	return terminated
+	return atomic.LoadInt32(&terminated) != 0
+}
+
+// Terminate requests termination, as if it was requested by the user,
+// eg, when a failed health check halts the rollout
+func Terminate() {
+	atomic.StoreInt32(&terminated, 1)
 }
 
 // EnableSignalHandler watches for a termination request from the user
@@ -30,7 +37,7 @@ func EnableSignalHandler() {
 		if s != syscall.SIGQUIT {
 			DebugLog.Println("Please wait while finishing up...")
 		}
-		terminated = true
+		atomic.StoreInt32(&terminated, 1)
 		return
 	}()
 }
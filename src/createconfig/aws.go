@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cEC2APIVersion      = "2016-11-15"
+	cDefaultEC2Endpoint = "https://ec2.%s.amazonaws.com/"
+)
+
+type (
+	// AWSOutputSpec specifies an output read from EC2, in the form
+	// Key=tag,Value=value,...;output_name;map|list;attribute, eg,
+	// Key=NetworkId,Value=84826,Key=Role,Value=Bootnode;bootnode_ips;map;PublicIpAddress
+	AWSOutputSpec struct {
+		Filters   []EC2Filter
+		Name      string
+		Type      string // map, keyed by region, or list, of the instances in the default region
+		Attribute string // PublicIpAddress, PublicDnsName, PrivateIpAddress, PrivateDnsName or InstanceId
+	}
+
+	// EC2Filter is a filter of DescribeInstances, eg, tag:Role, which matches any of its values
+	EC2Filter struct {
+		Name   string
+		Values []string
+	}
+
+	// EC2Instance is an instance returned by DescribeInstances
+	EC2Instance struct {
+		InstanceID       string `xml:"instanceId"`
+		PublicIPAddress  string `xml:"ipAddress"`
+		PublicDNSName    string `xml:"dnsName"`
+		PrivateIPAddress string `xml:"privateIpAddress"`
+		PrivateDNSName   string `xml:"privateDnsName"`
+	}
+
+	// EC2Client calls the EC2 Query API
+	EC2Client struct {
+		Endpoint    string // the endpoint of the EC2 API, where %s, if any, is replaced by the region
+		Credentials AWSCredentials
+		HTTPClient  *http.Client
+	}
+
+	ec2ErrorResponse struct {
+		Errors []struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Errors>Error"`
+	}
+)
+
+// ParseAWSOutputSpec parses the specification of an output, given by -outputN
+func ParseAWSOutputSpec(spec string) (result AWSOutputSpec, err error) {
+	parts := strings.Split(spec, ";")
+	if len(parts) != 4 {
+		return result, fmt.Errorf("invalid output: %s, expected filters;name;map|list;attribute", spec)
+	}
+	result.Name, result.Type, result.Attribute = strings.TrimSpace(parts[1]), strings.ToLower(strings.TrimSpace(parts[2])), strings.TrimSpace(parts[3])
+	if result.Name == "" {
+		return result, fmt.Errorf("invalid output: %s, the name is empty", spec)
+	}
+	if result.Type != "map" && result.Type != "list" {
+		return result, fmt.Errorf("invalid output: %s, the type must be map or list", spec)
+	}
+	if _, err = (EC2Instance{}).GetAttribute(result.Attribute); err != nil {
+		return result, fmt.Errorf("invalid output: %s, %v", spec, err)
+	}
+	var key string
+	for _, pair := range strings.Split(parts[0], ",") {
+		fields := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(fields) != 2 {
+			return result, fmt.Errorf("invalid output: %s, expected Key=tag,Value=value", spec)
+		}
+		switch fields[0] {
+		case "Key":
+			{
+				key = fields[1]
+			}
+		case "Value":
+			{
+				if key == "" {
+					return result, fmt.Errorf("invalid output: %s, Value=%s has no Key", spec, fields[1])
+				}
+				result.addFilter("tag:"+key, fields[1])
+			}
+		default:
+			{
+				return result, fmt.Errorf("invalid output: %s, unknown %s", spec, fields[0])
+			}
+		}
+	}
+	if len(result.Filters) == 0 {
+		return result, fmt.Errorf("invalid output: %s, no tags", spec)
+	}
+	return
+}
+
+// addFilter adds value to the filter of the given name, so that repeating a Key matches any of its values
+func (spec *AWSOutputSpec) addFilter(name, value string) {
+	for i := range spec.Filters {
+		if spec.Filters[i].Name == name {
+			spec.Filters[i].Values = append(spec.Filters[i].Values, value)
+			return
+		}
+	}
+	spec.Filters = append(spec.Filters, EC2Filter{Name: name, Values: []string{value}})
+}
+
+// GetAttribute returns the given attribute of the instance
+func (instance EC2Instance) GetAttribute(attribute string) (result string, err error) {
+	switch attribute {
+	case "PublicIpAddress":
+		{
+			result = instance.PublicIPAddress
+		}
+	case "PublicDnsName":
+		{
+			result = instance.PublicDNSName
+		}
+	case "PrivateIpAddress":
+		{
+			result = instance.PrivateIPAddress
+		}
+	case "PrivateDnsName":
+		{
+			result = instance.PrivateDNSName
+		}
+	case "InstanceId":
+		{
+			result = instance.InstanceID
+		}
+	default:
+		{
+			err = fmt.Errorf("unsupported attribute: %s", attribute)
+		}
+	}
+	return
+}
+
+// NewEC2Client returns a client of the EC2 API at the given endpoint, or of AWS, if the endpoint is empty
+func NewEC2Client(endpoint string, credentials AWSCredentials) *EC2Client {
+	if endpoint == "" {
+		endpoint = cDefaultEC2Endpoint
+	}
+	return &EC2Client{
+		Endpoint:    endpoint,
+		Credentials: credentials,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call calls the given action in the given region, and decodes the XML response into result
+func (c *EC2Client) call(region string, params url.Values, result interface{}) error {
+	endpoint := c.Endpoint
+	if strings.Contains(endpoint, "%s") {
+		endpoint = fmt.Sprintf(endpoint, region)
+	}
+	params.Set("Version", cEC2APIVersion)
+	body := []byte(params.Encode())
+	request, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	SignV4(request, body, c.Credentials, "ec2", region, time.Now())
+	DebugLog.Debugln("POST %s %s", endpoint, body)
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to connect to EC2 in %s: %v", region, err)
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read the response of %s in %s: %v", params.Get("Action"), region, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		var ec2Error ec2ErrorResponse
+		if xml.Unmarshal(responseBody, &ec2Error) == nil && len(ec2Error.Errors) > 0 {
+			return fmt.Errorf("%s in %s failed: %s: %s", params.Get("Action"), region, ec2Error.Errors[0].Code, ec2Error.Errors[0].Message)
+		}
+		return fmt.Errorf("%s in %s failed: %d %s", params.Get("Action"), region, response.StatusCode, http.StatusText(response.StatusCode))
+	}
+	if err := xml.Unmarshal(responseBody, result); err != nil {
+		return fmt.Errorf("unable to parse the response of %s in %s: %v", params.Get("Action"), region, err)
+	}
+	return nil
+}
+
+// DescribeRegions returns the names of the regions enabled for the account, sorted
+func (c *EC2Client) DescribeRegions(region string) (result []string, err error) {
+	var response struct {
+		Regions []string `xml:"regionInfo>item>regionName"`
+	}
+	if err = c.call(region, url.Values{"Action": {"DescribeRegions"}}, &response); err != nil {
+		return
+	}
+	result = response.Regions
+	sort.Strings(result)
+	return
+}
+
+// DescribeInstances returns the running instances in the given region that match all the filters
+func (c *EC2Client) DescribeInstances(region string, filters []EC2Filter) (result []EC2Instance, err error) {
+	params := url.Values{"Action": {"DescribeInstances"}}
+	filters = append(filters[:len(filters):len(filters)], EC2Filter{Name: "instance-state-name", Values: []string{"running"}})
+	for i, filter := range filters {
+		params.Set(fmt.Sprintf("Filter.%d.Name", i+1), filter.Name)
+		for j, value := range filter.Values {
+			params.Set(fmt.Sprintf("Filter.%d.Value.%d", i+1, j+1), value)
+		}
+	}
+	for {
+		var response struct {
+			Instances []EC2Instance `xml:"reservationSet>item>instancesSet>item"`
+			NextToken string        `xml:"nextToken"`
+		}
+		if err = c.call(region, params, &response); err != nil {
+			return nil, err
+		}
+		result = append(result, response.Instances...)
+		if response.NextToken == "" {
+			break
+		}
+		params.Set("NextToken", response.NextToken)
+	}
+	return
+}
+
+// getNodes returns the given attribute of the instances in the region that match the spec, in the order EC2 returns them
+func (c *EC2Client) getNodes(region string, spec AWSOutputSpec) (result []string, err error) {
+	instances, err := c.DescribeInstances(region, spec.Filters)
+	if err != nil {
+		return
+	}
+	result = []string{}
+	for _, instance := range instances {
+		value, _ := instance.GetAttribute(spec.Attribute)
+		if value == "" {
+			DebugLog.Debugln("Instance %s in %s has no %s, skipped", instance.InstanceID, region, spec.Attribute)
+			continue
+		}
+		result = append(result, value)
+	}
+	return
+}
+
+// GetAWSOutputs returns the outputs of the given specs, read from EC2, in the same form as the outputs of
+// "terraform output -json". A map output contains the nodes in each of the given regions, or if no regions
+// are given, in each region enabled for the account. A list output contains the nodes in the default region.
+func GetAWSOutputs(client *EC2Client, defaultRegion string, regions []string, specs []AWSOutputSpec) (result TerraformOutputs, err error) {
+	for _, spec := range specs {
+		if spec.Type == "map" && len(regions) == 0 {
+			if regions, err = client.DescribeRegions(defaultRegion); err != nil {
+				return
+			}
+			break
+		}
+	}
+	result = make(TerraformOutputs)
+	for _, spec := range specs {
+		var value interface{}
+		if spec.Type == "map" {
+			regionNodes := make(map[string]interface{})
+			for _, region := range regions {
+				nodes, err := client.getNodes(region, spec)
+				if err != nil {
+					return nil, fmt.Errorf("output %s: %v", spec.Name, err)
+				}
+				regionNodes[region] = toInterfaces(nodes)
+			}
+			value = regionNodes
+		} else {
+			nodes, err := client.getNodes(defaultRegion, spec)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %v", spec.Name, err)
+			}
+			value = toInterfaces(nodes)
+		}
+		result[spec.Name] = TerraformOutput{Type: spec.Type, Value: value}
+	}
+	return
+}
+
+func toInterfaces(values []string) (result []interface{}) {
+	result = make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return
+}
+
+// GetGroupNodes returns the nodes of each output, keyed by the output name, as the groupnodes of an Upgrade configuration
+func GetGroupNodes(outputs TerraformOutputs) (result []byte, err error) {
+	var config struct {
+		SoftwareGroupNodes map[string][]string `json:"groupnodes"`
+	}
+	config.SoftwareGroupNodes = make(map[string][]string)
+	for name, output := range outputs {
+		if config.SoftwareGroupNodes[name], err = output.Items(); err != nil {
+			return
+		}
+		if config.SoftwareGroupNodes[name] == nil {
+			config.SoftwareGroupNodes[name] = []string{}
+		}
+	}
+	return json.MarshalIndent(config, "", "    ")
+}
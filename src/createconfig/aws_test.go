@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEC2Instance struct {
+	region      string
+	state       string
+	tags        map[string]string
+	ip, dns, id string
+}
+
+var (
+	testAWSCredentials = AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+	testEC2Instances = []testEC2Instance{
+		{"us-east-1", "running", map[string]string{"NetworkId": "84826", "Role": "Bootnode"}, "18.207.120.214", "ec2-18-207-120-214.compute-1.amazonaws.com", "i-1"},
+		{"us-east-2", "running", map[string]string{"NetworkId": "84826", "Role": "Bootnode"}, "18.222.37.52", "ec2-18-222-37-52.us-east-2.compute.amazonaws.com", "i-2"},
+		{"us-east-2", "running", map[string]string{"NetworkId": "84826", "Role": "Bootnode"}, "18.188.115.226", "ec2-18-188-115-226.us-east-2.compute.amazonaws.com", "i-3"},
+		{"us-east-2", "stopped", map[string]string{"NetworkId": "84826", "Role": "Bootnode"}, "", "", "i-4"},
+		{"us-east-1", "running", map[string]string{"NetworkId": "12345", "Role": "Bootnode"}, "3.3.3.3", "", "i-5"},
+		{"us-east-1", "running", map[string]string{"NetworkId": "84826", "Role": "Vault"}, "54.175.210.140", "", "i-6"},
+		{"us-east-2", "running", map[string]string{"NetworkId": "84826", "Role": "Vault"}, "3.16.0.1", "", "i-7"},
+		{"us-east-1", "running", map[string]string{"NetworkId": "84826", "Role": "Maker"}, "", "", "i-8"},
+	}
+)
+
+// matches returns whether the instance matches the filters of a DescribeInstances request
+func (instance testEC2Instance) matches(form map[string][]string) bool {
+	for i := 1; ; i++ {
+		name := strings.Join(form[fmt.Sprintf("Filter.%d.Name", i)], "")
+		if name == "" {
+			return true
+		}
+		var actual string
+		if name == "instance-state-name" {
+			actual = instance.state
+		} else {
+			actual = instance.tags[strings.TrimPrefix(name, "tag:")]
+		}
+		matched := false
+		for j := 1; ; j++ {
+			value, ok := form[fmt.Sprintf("Filter.%d.Value.%d", i, j)]
+			if !ok {
+				break
+			}
+			matched = matched || value[0] == actual
+		}
+		if !matched {
+			return false
+		}
+	}
+}
+
+// newTestEC2Server returns a stand-in for EC2, at the endpoint <url>/<region>/, that verifies the signature
+// of each request, and returns at most 1 instance for each DescribeInstances request
+func newTestEC2Server(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := strings.Trim(r.URL.Path, "/")
+		body, _ := ioutil.ReadAll(r.Body)
+		amzDate, _ := time.Parse(cAmzDateFormat, r.Header.Get("X-Amz-Date"))
+		expected, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+		expected.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		SignV4(expected, body, testAWSCredentials, "ec2", region, amzDate)
+		if r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `<Response><Errors><Error><Code>AuthFailure</Code><Message>AWS was not able to validate the provided access credentials</Message></Error></Errors></Response>`)
+			return
+		}
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		r.ParseForm()
+		switch r.PostForm.Get("Action") {
+		case "DescribeRegions":
+			{
+				fmt.Fprint(w, `<DescribeRegionsResponse><regionInfo><item><regionName>us-west-1</regionName></item>`+
+					`<item><regionName>us-east-2</regionName></item><item><regionName>us-east-1</regionName></item></regionInfo></DescribeRegionsResponse>`)
+			}
+		case "DescribeInstances":
+			{
+				start, _ := strconv.Atoi(r.PostForm.Get("NextToken"))
+				var matched []testEC2Instance
+				for _, instance := range testEC2Instances {
+					if instance.region == region && instance.matches(r.PostForm) {
+						matched = append(matched, instance)
+					}
+				}
+				fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet>`)
+				if start < len(matched) {
+					instance := matched[start]
+					fmt.Fprintf(w, `<item><instancesSet><item><instanceId>%s</instanceId><ipAddress>%s</ipAddress><dnsName>%s</dnsName></item></instancesSet></item>`,
+						instance.id, instance.ip, instance.dns)
+				}
+				fmt.Fprint(w, `</reservationSet>`)
+				if start+1 < len(matched) {
+					fmt.Fprintf(w, `<nextToken>%d</nextToken>`, start+1)
+				}
+				fmt.Fprint(w, `</DescribeInstancesResponse>`)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidAction</Code><Message>unknown action</Message></Error></Errors></Response>`)
+			}
+		}
+	}))
+}
+
+func TestParseAWSOutputSpec(t *testing.T) {
+	spec, err := ParseAWSOutputSpec("Key=NetworkId,Value=84826,Key=Role,Value=Bootnode,Value=Maker;bootnode_ips;map;PublicIpAddress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AWSOutputSpec{
+		Filters:   []EC2Filter{{"tag:NetworkId", []string{"84826"}}, {"tag:Role", []string{"Bootnode", "Maker"}}},
+		Name:      "bootnode_ips",
+		Type:      "map",
+		Attribute: "PublicIpAddress",
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Expected: %+v, got: %+v", expected, spec)
+	}
+	for _, invalid := range []string{
+		"Key=Role,Value=Bootnode;bootnode_ips;map",
+		"Key=Role,Value=Bootnode;bootnode_ips;set;PublicIpAddress",
+		"Key=Role,Value=Bootnode;bootnode_ips;map;PublicIp",
+		"Value=Bootnode;bootnode_ips;map;PublicIpAddress",
+		";bootnode_ips;map;PublicIpAddress",
+	} {
+		if _, err := ParseAWSOutputSpec(invalid); err == nil {
+			t.Fatalf("Expected an error parsing %s", invalid)
+		}
+	}
+}
+
+func TestGetAWSOutputs(t *testing.T) {
+	server := newTestEC2Server(t)
+	defer server.Close()
+
+	var specs []AWSOutputSpec
+	for _, output := range []string{
+		"Key=NetworkId,Value=84826,Key=Role,Value=Bootnode;bootnode_ips;map;PublicIpAddress",
+		"Key=NetworkId,Value=84826,Key=Role,Value=Vault;vault_server_ips;list;PublicIpAddress",
+		"Key=NetworkId,Value=84826,Key=Role,Value=Bootnode;bootnode_dns;list;PublicDnsName",
+	} {
+		spec, err := ParseAWSOutputSpec(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, spec)
+	}
+	client := NewEC2Client(server.URL+"/%s/", testAWSCredentials)
+	outputs, err := GetAWSOutputs(client, "us-east-1", nil, specs)
+	if err != nil {
+		t.Fatalf("Unable to get outputs: %v", err)
+	}
+
+	// the outputs render the same as the output of terraform output -json
+	template, _ := ioutil.ReadFile(filepath.Join("testdata", "nodes.template"))
+	expected, _ := ioutil.ReadFile(filepath.Join("testdata", "nodes.golden"))
+	if result, err := RenderTemplate(template, outputs, RenderOptions{RemoveQuote: true, RemoveDelimiter: true}); err != nil ||
+		string(result) != string(expected) {
+		t.Fatalf("Expected: %s, got: %s, error: %v", expected, result, err)
+	}
+
+	data, err := GetGroupNodes(outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		SoftwareGroupNodes map[string][]string `json:"groupnodes"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil || VerifyUpgradeConfig(data) != nil {
+		t.Fatalf("Invalid groupnodes: %s", data)
+	}
+	if nodes := config.SoftwareGroupNodes["bootnode_dns"]; !reflect.DeepEqual(nodes, []string{"ec2-18-207-120-214.compute-1.amazonaws.com"}) {
+		t.Fatalf("Expected the bootnodes in the default region, got: %v", nodes)
+	}
+
+	// instances without the attribute are skipped
+	makers, _ := ParseAWSOutputSpec("Key=Role,Value=Maker;makers;map;PublicIpAddress")
+	if outputs, err = GetAWSOutputs(client, "us-east-1", []string{"us-east-1"}, []AWSOutputSpec{makers}); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := outputs["makers"].Items(); len(items) != 0 {
+		t.Fatalf("Expected no makers, got: %v", items)
+	}
+
+	client.Credentials.SecretAccessKey = "wrong"
+	if _, err := GetAWSOutputs(client, "us-east-1", nil, specs); err == nil || !strings.Contains(err.Error(), "AuthFailure") {
+		t.Fatalf("Expected an AuthFailure error, got: %v", err)
+	}
+}
+
+func TestGetAWSCredentials(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	credentialsFilename, configFilename := filepath.Join(tempdir, "credentials"), filepath.Join(tempdir, "config")
+	ioutil.WriteFile(credentialsFilename, []byte("[default]\naws_access_key_id = AKID1\naws_secret_access_key = secret1\n\n"+
+		"[test]\naws_access_key_id=AKID2\naws_secret_access_key=secret2\n"), 0600)
+	ioutil.WriteFile(configFilename, []byte("[default]\nregion = us-east-1\n[profile test]\nregion = us-west-2\n"), 0600)
+
+	for name, value := range map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": credentialsFilename, "AWS_CONFIG_FILE": configFilename, "AWS_PROFILE": "test",
+		"AWS_ACCESS_KEY_ID": "", "AWS_REGION": "", "AWS_DEFAULT_REGION": "",
+	} {
+		if previous, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	if credentials, err := GetAWSCredentials("", ""); err != nil || credentials.AccessKeyID != "AKID2" || credentials.SecretAccessKey != "secret2" {
+		t.Fatalf("Expected the credentials of the profile, got: %+v, error: %v", credentials, err)
+	}
+	if credentials, _ := GetAWSCredentials("AKID3", "secret3"); credentials.AccessKeyID != "AKID3" {
+		t.Fatalf("Expected the given credentials, got: %+v", credentials)
+	}
+	if region, err := GetAWSRegion(""); err != nil || region != "us-west-2" {
+		t.Fatalf("Expected the region of the profile, got: %s, error: %v", region, err)
+	}
+	os.Setenv("AWS_PROFILE", "")
+	if region, _ := GetAWSRegion(""); region != "us-east-1" {
+		t.Fatalf("Expected the default region, got: %s", region)
+	}
+	os.Setenv("AWS_PROFILE", "missing")
+	if _, err := GetAWSCredentials("", ""); err == nil {
+		t.Fatal("Expected an error for missing credentials")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"softwareupgrade"
+	"strings"
+)
+
+// readINISection returns the keys of the given section of an AWS credentials or config file
+func readINISection(filename, section string) (result map[string]string) {
+	data, err := softwareupgrade.ReadDataFromFile(filename)
+	if err != nil {
+		return
+	}
+	var current string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			if result == nil {
+				result = make(map[string]string)
+			}
+			result[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return
+}
+
+// getAWSProfile returns the profile read from ~/.aws/credentials and ~/.aws/config, from AWS_PROFILE, or default
+func getAWSProfile() (result string) {
+	if result = os.Getenv("AWS_PROFILE"); result == "" {
+		result = "default"
+	}
+	return
+}
+
+// GetAWSCredentials returns the given credentials, or if they're not given, the credentials in
+// the environment, or in ~/.aws/credentials
+func GetAWSCredentials(accessKeyID, secretAccessKey string) (result AWSCredentials, err error) {
+	if accessKeyID != "" || secretAccessKey != "" {
+		result = AWSCredentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey}
+	} else if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		result = AWSCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	} else {
+		filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if filename == "" {
+			filename = "~/.aws/credentials"
+		}
+		keys := readINISection(filename, getAWSProfile())
+		result = AWSCredentials{
+			AccessKeyID:     keys["aws_access_key_id"],
+			SecretAccessKey: keys["aws_secret_access_key"],
+			SessionToken:    keys["aws_session_token"],
+		}
+	}
+	if result.AccessKeyID == "" || result.SecretAccessKey == "" {
+		err = errors.New("AWS credentials not found, specify -akid and -sak, or configure them in ~/.aws/credentials")
+	}
+	return
+}
+
+// GetAWSRegion returns the given region, or if it's not given, the region in the environment, or in ~/.aws/config
+func GetAWSRegion(region string) (result string, err error) {
+	if result = region; result == "" {
+		result = os.Getenv("AWS_REGION")
+	}
+	if result == "" {
+		result = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if result == "" {
+		filename := os.Getenv("AWS_CONFIG_FILE")
+		if filename == "" {
+			filename = "~/.aws/config"
+		}
+		section := getAWSProfile()
+		if section != "default" {
+			section = "profile " + section
+		}
+		result = readINISection(filename, section)["region"]
+	}
+	if result == "" {
+		err = errors.New("AWS region not found, specify -region, or configure it in ~/.aws/config")
+	}
+	return
+}
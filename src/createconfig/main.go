@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"softwareupgrade"
+	"strings"
+)
+
+var (
+	mode                         string
+	templateFilename             string
+	terraformFilename            string
+	outputFilename               string
+	removeQuote, removeDelimiter bool
+	debug                        bool
+	tfeAddress, tfeToken         string
+	organization, workspace      string
+	awsOutputs                   [cAWSMaxOutputs]string
+	awsAccessKeyID, awsSecretKey string
+	awsRegion, awsRegions        string
+	ec2Endpoint                  string
+)
+
+const (
+	cAWSMaxOutputs = 10
+)
+
+// createConfig renders the template with the outputs of Terraform, and saves it to the output file
+func createConfig(outputs TerraformOutputs) (err error) {
+	DebugLog.Debugln("Loaded %d Terraform outputs", len(outputs))
+	template, err := softwareupgrade.ReadDataFromFile(templateFilename)
+	if err != nil {
+		return fmt.Errorf("unable to read template: %v", err)
+	}
+	result, err := RenderTemplate(template, outputs, RenderOptions{RemoveQuote: removeQuote, RemoveDelimiter: removeDelimiter})
+	if err != nil {
+		return
+	}
+	if err = VerifyUpgradeConfig(result); err != nil {
+		return
+	}
+	if _, err = softwareupgrade.SaveDataToFile(outputFilename, result); err != nil {
+		return fmt.Errorf("unable to write output: %v", err)
+	}
+	DebugLog.Println("Created %s from %s", outputFilename, templateFilename)
+	return
+}
+
+// createAWSConfig reads the outputs from EC2, and either renders the template with them, or if
+// there's no template, saves them as the groupnodes of an Upgrade configuration
+func createAWSConfig() (err error) {
+	var specs []AWSOutputSpec
+	for _, output := range awsOutputs {
+		if output == "" {
+			continue
+		}
+		spec, err := ParseAWSOutputSpec(output)
+		if err != nil {
+			return err
+		}
+		DebugLog.Debugln("Output %s: filters: %v", spec.Name, spec.Filters)
+		specs = append(specs, spec)
+	}
+	credentials, err := GetAWSCredentials(awsAccessKeyID, awsSecretKey)
+	if err != nil {
+		return
+	}
+	region, err := GetAWSRegion(awsRegion)
+	if err != nil {
+		return
+	}
+	var regions []string
+	if awsRegions != "" {
+		regions = strings.Split(awsRegions, ",")
+	}
+	outputs, err := GetAWSOutputs(NewEC2Client(ec2Endpoint, credentials), region, regions, specs)
+	if err != nil {
+		return
+	}
+	if templateFilename != "" {
+		return createConfig(outputs)
+	}
+	result, err := GetGroupNodes(outputs)
+	if err != nil {
+		return
+	}
+	if _, err = softwareupgrade.SaveDataToFile(outputFilename, result); err != nil {
+		return fmt.Errorf("unable to write output: %v", err)
+	}
+	DebugLog.Println("Created %s from EC2", outputFilename)
+	return
+}
+
+func main() {
+	flag.StringVar(&mode, "mode", "cli", "mode (aws|cli|tfe), where aws reads the nodes from EC2, cli reads the output of terraform output -json, and tfe reads the outputs from Terraform Enterprise")
+	flag.StringVar(&templateFilename, "template", "", "Specifies the template, where {%output_name} is replaced by the values of the Terraform output")
+	flag.StringVar(&terraformFilename, "terraform-json", "", "Specifies the file containing the output of terraform output -json, for the cli mode")
+	flag.StringVar(&outputFilename, "output", "", "Specifies the file to write the rendered template to")
+	flag.BoolVar(&removeQuote, "remove-quote", false, "Doesn't quote the values of the Terraform outputs")
+	flag.BoolVar(&removeDelimiter, "remove-delimiter", false, "Separates the values of the Terraform outputs with spaces, instead of commas")
+	flag.StringVar(&tfeAddress, "address", "https://app.terraform.io", "Specifies the address of Terraform Enterprise, for the tfe mode")
+	flag.StringVar(&tfeToken, "auth", "", "Specifies the Terraform Enterprise API token, for the tfe mode (default: the TFE_TOKEN environment variable)")
+	flag.StringVar(&organization, "organization", "", "Specifies the Terraform Enterprise organization, for the tfe mode")
+	flag.StringVar(&workspace, "workspace", "", "Specifies the Terraform Enterprise workspace to read the outputs of, for the tfe mode")
+	for i := range awsOutputs {
+		flag.StringVar(&awsOutputs[i], fmt.Sprintf("output%d", i+1), "", "Specifies an output read from EC2, for the aws mode, eg, Key=Role,Value=Bootnode;bootnode_ips;map;PublicIpAddress")
+	}
+	flag.StringVar(&awsAccessKeyID, "akid", "", "Specifies the AWS Access Key ID, for the aws mode (default: from the environment, or ~/.aws/credentials)")
+	flag.StringVar(&awsSecretKey, "sak", "", "Specifies the AWS Secret Access Key, for the aws mode (default: from the environment, or ~/.aws/credentials)")
+	flag.StringVar(&awsRegion, "region", "", "Specifies the default AWS region, for the aws mode (default: from the environment, or ~/.aws/config)")
+	flag.StringVar(&awsRegions, "regions", "", "Specifies the comma separated AWS regions of map outputs, for the aws mode (default: all enabled regions)")
+	flag.StringVar(&ec2Endpoint, "endpoint", "", "Specifies the EC2 endpoint, where %s is replaced by the region, for the aws mode (default: https://ec2.%s.amazonaws.com/)")
+	flag.BoolVar(&debug, "debug", false, "Specifies debug mode")
+	flag.Parse()
+
+	// CreateConfig template terraform-output output
+	if args := flag.Args(); len(args) == 3 && templateFilename == "" && terraformFilename == "" && outputFilename == "" {
+		templateFilename, terraformFilename, outputFilename = args[0], args[1], args[2]
+	}
+
+	DebugLog.EnablePrintConsole()
+	DebugLog.SetConsole(os.Stderr)
+	if debug {
+		DebugLog.EnableDebug()
+	}
+
+	var err error
+	switch strings.ToLower(mode) {
+	case "aws":
+		{
+			if outputFilename == "" || strings.Join(awsOutputs[:], "") == "" {
+				flag.PrintDefaults()
+				os.Exit(2)
+			}
+			err = createAWSConfig()
+		}
+	case "cli":
+		{
+			if templateFilename == "" || terraformFilename == "" || outputFilename == "" {
+				flag.PrintDefaults()
+				os.Exit(2)
+			}
+			var terraformOutput []byte
+			var outputs TerraformOutputs
+			if terraformOutput, err = softwareupgrade.ReadDataFromFile(terraformFilename); err == nil {
+				if outputs, err = ParseTerraformOutputs(terraformOutput); err == nil {
+					err = createConfig(outputs)
+				}
+			}
+		}
+	case "tfe":
+		{
+			if tfeToken == "" {
+				tfeToken = os.Getenv("TFE_TOKEN")
+			}
+			if templateFilename == "" || outputFilename == "" || tfeToken == "" || organization == "" || workspace == "" {
+				flag.PrintDefaults()
+				os.Exit(2)
+			}
+			var outputs TerraformOutputs
+			if outputs, err = NewTFEClient(tfeAddress, tfeToken).GetOutputs(organization, workspace); err == nil {
+				err = createConfig(outputs)
+			}
+		}
+	default:
+		{
+			err = fmt.Errorf("unknown mode: %s", mode)
+		}
+	}
+	if err != nil {
+		DebugLog.Println("Error: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The requests, and their signatures, are from the get-vanilla and get-vanilla-query-order-key
+// tests of the AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	credentials := AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		method, url, expected string
+	}{
+		{"GET", "https://example.amazonaws.com/",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+				"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, test.url, nil)
+		SignV4(request, nil, credentials, "service", "us-east-1", now)
+		if authorization := request.Header.Get("Authorization"); authorization != "AWS4-HMAC-SHA256 "+test.expected {
+			t.Fatalf("%s %s: unexpected signature: %s", test.method, test.url, authorization)
+		}
+	}
+
+	request, _ := http.NewRequest("POST", "https://ec2.us-east-1.amazonaws.com/", nil)
+	credentials.SessionToken = "token"
+	SignV4(request, nil, credentials, "ec2", "us-east-1", now)
+	if request.Header.Get("X-Amz-Security-Token") != "token" ||
+		!strings.Contains(request.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Fatalf("Expected the session token to be signed, got: %s", request.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"softwareupgrade"
+	"strings"
+)
+
+type (
+	// RenderOptions specifies how the values of an output replace its placeholder
+	RenderOptions struct {
+		RemoveQuote     bool // the values aren't quoted
+		RemoveDelimiter bool // the values are separated by spaces, instead of commas
+	}
+)
+
+var (
+	// placeholderRegexp matches a placeholder, eg, {%bootnode_ips}
+	placeholderRegexp = regexp.MustCompile(`\{%([^{}%\s]+)\}`)
+)
+
+// RenderTemplate replaces each placeholder in the template with the values of the output it names.
+// By default, the values are quoted, and separated by commas, so that a placeholder in a JSON array,
+// eg, ["{%bootnode_ips}"] without the quotes, becomes a JSON array of strings.
+func RenderTemplate(template []byte, outputs TerraformOutputs, options RenderOptions) (result []byte, err error) {
+	var msg string
+	missing := make(map[string]bool)
+	result = placeholderRegexp.ReplaceAllFunc(template, func(placeholder []byte) []byte {
+		name := string(placeholderRegexp.FindSubmatch(placeholder)[1])
+		output, ok := outputs[name]
+		if !ok {
+			if !missing[name] {
+				missing[name] = true
+				msg = fmt.Sprintf("%sOutput: %s doesn't exist in the Terraform output\n", msg, name)
+			}
+			return placeholder
+		}
+		items, err := output.Items()
+		if err != nil {
+			msg = fmt.Sprintf("%sOutput: %s, %v\n", msg, name, err)
+			return placeholder
+		}
+		return []byte(formatItems(items, options))
+	})
+	if msg != "" {
+		return nil, errors.New(strings.TrimSuffix(msg, "\n"))
+	}
+	return
+}
+
+func formatItems(items []string, options RenderOptions) string {
+	formatted := make([]string, len(items))
+	for i, item := range items {
+		if options.RemoveQuote {
+			formatted[i] = item
+		} else {
+			quoted, _ := json.Marshal(item)
+			formatted[i] = string(quoted)
+		}
+	}
+	if options.RemoveDelimiter {
+		return strings.Join(formatted, " ")
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// VerifyUpgradeConfig verifies that a rendered template that's a JSON object is a valid
+// configuration for Upgrade. Templates that aren't JSON objects, eg, a list of nodes, aren't verified.
+func VerifyUpgradeConfig(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil
+	}
+	var config softwareupgrade.UpgradeConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("the output isn't a valid Upgrade configuration: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	update = flag.Bool("update", false, "updates the golden files")
+)
+
+func loadTestOutputs(t *testing.T) TerraformOutputs {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "terraform-output.json"))
+	if err != nil {
+		t.Fatalf("Unable to read Terraform output: %v", err)
+	}
+	outputs, err := ParseTerraformOutputs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outputs
+}
+
+func TestTerraformOutput_Items(t *testing.T) {
+	outputs := loadTestOutputs(t)
+	if items, err := outputs["bootnode_ips"].Items(); err != nil ||
+		!reflect.DeepEqual(items, []string{"18.207.120.214", "18.222.37.52", "18.188.115.226"}) {
+		t.Fatalf("Expected the bootnodes in the order of their regions, got: %v, error: %v", items, err)
+	}
+	if items, err := outputs["vault_server_ips"].Items(); err != nil || !reflect.DeepEqual(items, []string{"54.175.210.140"}) {
+		t.Fatalf("Unexpected vault servers: %v, error: %v", items, err)
+	}
+
+	outputs, err := ParseTerraformOutputs([]byte(`{"port": {"type": "string", "value": 8545}, "nested": {"value": [["a"], {"x": "b"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := outputs["port"].Items(); !reflect.DeepEqual(items, []string{"8545"}) {
+		t.Fatalf("Expected the number as given, got: %v", items)
+	}
+	if items, _ := outputs["nested"].Items(); !reflect.DeepEqual(items, []string{"a", "b"}) {
+		t.Fatalf("Expected the nested values to be flattened, got: %v", items)
+	}
+	if _, err := ParseTerraformOutputs([]byte(`[]`)); err == nil {
+		t.Fatal("Expected an error parsing an invalid Terraform output")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	outputs := loadTestOutputs(t)
+	tests := []struct {
+		template string
+		golden   string
+		options  RenderOptions
+	}{
+		{"nodes.template", "nodes.golden", RenderOptions{RemoveQuote: true, RemoveDelimiter: true}},
+		{"upgrade.template", "upgrade.golden", RenderOptions{}},
+	}
+	for _, test := range tests {
+		template, err := ioutil.ReadFile(filepath.Join("testdata", test.template))
+		if err != nil {
+			t.Fatalf("Unable to read template: %v", err)
+		}
+		result, err := RenderTemplate(template, outputs, test.options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+		if err := VerifyUpgradeConfig(result); err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+		golden := filepath.Join("testdata", test.golden)
+		if *update {
+			ioutil.WriteFile(golden, result, 0644)
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("Unable to read golden file: %v", err)
+		}
+		if !bytes.Equal(result, expected) {
+			t.Fatalf("%s: expected:\n%s\ngot:\n%s", test.template, expected, result)
+		}
+	}
+
+	if _, err := RenderTemplate([]byte(`{%bootnode_ips} {%validator_ips} {%maker_ips} {%validator_ips}`), outputs, RenderOptions{}); err == nil ||
+		strings.Count(err.Error(), "\n") != 1 || !strings.Contains(err.Error(), "validator_ips") || !strings.Contains(err.Error(), "maker_ips") {
+		t.Fatalf("Expected an error listing each missing output once, got: %v", err)
+	}
+}
+
+func TestVerifyUpgradeConfig(t *testing.T) {
+	if err := VerifyUpgradeConfig([]byte(`{"groupnodes": {"Bootnodes": [18.207.120.214]}}`)); err == nil {
+		t.Fatal("Expected an error for an unquoted IP address")
+	}
+	if err := VerifyUpgradeConfig([]byte(`{"groupnodes": {"Bootnodes": "18.207.120.214"}}`)); err == nil {
+		t.Fatal("Expected an error for nodes that aren't a list")
+	}
+	if err := VerifyUpgradeConfig([]byte("18.207.120.214 54.175.210.140\n")); err != nil {
+		t.Fatalf("Output that isn't a JSON object shouldn't be verified, got: %v", err)
+	}
+}
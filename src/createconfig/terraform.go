@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type (
+	// TerraformOutput is a single output of "terraform output -json". Its value is either a string,
+	// a list, or a map, eg, of the IP addresses of the nodes in each region.
+	TerraformOutput struct {
+		Sensitive bool        `json:"sensitive"`
+		Type      interface{} `json:"type"` // "string", "list" or "map", or a type expression in newer versions of Terraform
+		Value     interface{} `json:"value"`
+	}
+
+	// TerraformOutputs contains the outputs of "terraform output -json", keyed by the output name
+	TerraformOutputs map[string]TerraformOutput
+)
+
+// ParseTerraformOutputs parses the output of "terraform output -json"
+func ParseTerraformOutputs(data []byte) (result TerraformOutputs, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // so that numbers are written as they're given
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to parse Terraform output: %v", err)
+	}
+	return
+}
+
+// Items returns the values of the output. The values of a map are returned in the order of
+// their keys, eg, the nodes of us-east-1 before the nodes of us-east-2, and nested lists are flattened.
+func (output TerraformOutput) Items() (result []string, err error) {
+	err = appendItems(&result, output.Value)
+	return
+}
+
+func appendItems(result *[]string, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		{
+		}
+	case string:
+		{
+			*result = append(*result, v)
+		}
+	case json.Number:
+		{
+			*result = append(*result, v.String())
+		}
+	case bool:
+		{
+			*result = append(*result, fmt.Sprintf("%t", v))
+		}
+	case []interface{}:
+		{
+			for _, item := range v {
+				if err := appendItems(result, item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		{
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if err := appendItems(result, v[key]); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		{
+			return fmt.Errorf("unsupported value: %v", value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type (
+	// TFEClient reads the outputs of a workspace from the Terraform Enterprise API
+	TFEClient struct {
+		Address    string // eg, https://app.terraform.io
+		Token      string
+		HTTPClient *http.Client
+	}
+
+	// tfeError is an error in a Terraform Enterprise API response. Older versions of the API
+	// return the errors as strings.
+	tfeError struct {
+		Status string `json:"status"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	}
+
+	tfeOutput struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Name      string      `json:"name"`
+			Sensitive bool        `json:"sensitive"`
+			Type      interface{} `json:"type"`
+			Value     interface{} `json:"value"`
+		} `json:"attributes"`
+	}
+)
+
+// NewTFEClient returns a client of the Terraform Enterprise API at the given address, authorized by the given token
+func NewTFEClient(address, token string) *TFEClient {
+	return &TFEClient{
+		Address:    strings.TrimSuffix(address, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// get reads the given API path, and decodes the response into result
+func (c *TFEClient) get(path string, result interface{}) error {
+	request, err := http.NewRequest("GET", c.Address+"/api/v2"+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	request.Header.Set("Content-Type", "application/vnd.api+json")
+	DebugLog.Debugln("GET %s", request.URL)
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to connect to Terraform Enterprise: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read the response of %s: %v", path, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return getTFEError(response.StatusCode, body)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(result); err != nil {
+		return fmt.Errorf("unable to parse the response of %s: %v", path, err)
+	}
+	return nil
+}
+
+// getTFEError returns the error of a failed API request, with the errors in the response, if any
+func getTFEError(statusCode int, body []byte) error {
+	var msg string
+	switch statusCode {
+	case http.StatusUnauthorized:
+		{
+			msg = "the Terraform Enterprise token is invalid, or has expired"
+		}
+	case http.StatusNotFound:
+		{
+			msg = "not found, or the Terraform Enterprise token isn't authorized to read it"
+		}
+	default:
+		{
+			msg = fmt.Sprintf("Terraform Enterprise returned %d %s", statusCode, http.StatusText(statusCode))
+		}
+	}
+	var response struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+	if json.Unmarshal(body, &response) == nil {
+		var details []string
+		for _, rawError := range response.Errors {
+			var e tfeError
+			var s string
+			if json.Unmarshal(rawError, &s) == nil {
+				details = append(details, s)
+			} else if json.Unmarshal(rawError, &e) == nil {
+				details = append(details, strings.TrimSpace(e.Title+" "+e.Detail))
+			}
+		}
+		if len(details) > 0 {
+			msg = fmt.Sprintf("%s: %s", msg, strings.Join(details, ", "))
+		}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// GetWorkspaceID returns the ID of the given workspace of the given organization
+func (c *TFEClient) GetWorkspaceID(organization, workspace string) (result string, err error) {
+	var response struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	path := fmt.Sprintf("/organizations/%s/workspaces/%s", url.PathEscape(organization), url.PathEscape(workspace))
+	if err = c.get(path, &response); err != nil {
+		return "", fmt.Errorf("workspace %s of organization %s: %v", workspace, organization, err)
+	}
+	if response.Data.ID == "" {
+		return "", fmt.Errorf("workspace %s of organization %s has no ID", workspace, organization)
+	}
+	return response.Data.ID, nil
+}
+
+// GetOutputs returns the outputs of the current state version of the given workspace, the same
+// outputs that "terraform output -json" returns. The values of sensitive outputs are read separately,
+// as they're not returned with the rest of the outputs.
+func (c *TFEClient) GetOutputs(organization, workspace string) (result TerraformOutputs, err error) {
+	workspaceID, err := c.GetWorkspaceID(organization, workspace)
+	if err != nil {
+		return
+	}
+	var response struct {
+		Data []tfeOutput `json:"data"`
+	}
+	if err = c.get(fmt.Sprintf("/workspaces/%s/current-state-version-outputs", url.PathEscape(workspaceID)), &response); err != nil {
+		return nil, fmt.Errorf("outputs of workspace %s: %v", workspace, err)
+	}
+	result = make(TerraformOutputs)
+	for _, output := range response.Data {
+		if output.Attributes.Sensitive && output.Attributes.Value == nil {
+			var sensitive struct {
+				Data tfeOutput `json:"data"`
+			}
+			if err = c.get(fmt.Sprintf("/state-version-outputs/%s", url.PathEscape(output.ID)), &sensitive); err != nil {
+				return nil, fmt.Errorf("output %s of workspace %s: %v", output.Attributes.Name, workspace, err)
+			}
+			output = sensitive.Data
+		}
+		result[output.Attributes.Name] = TerraformOutput{
+			Sensitive: output.Attributes.Sensitive,
+			Type:      output.Attributes.Type,
+			Value:     output.Attributes.Value,
+		}
+	}
+	DebugLog.Debugln("Read %d outputs of workspace %s (%s)", len(result), workspace, workspaceID)
+	return
+}
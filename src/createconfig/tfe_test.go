@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testTFEToken = "test-token"
+)
+
+// newTestTFEServer returns a stand-in for Terraform Enterprise, with the workspace eximchain/testnet,
+// which has the outputs of testdata/terraform-output.json, and a sensitive output.
+func newTestTFEServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/organizations/eximchain/workspaces/testnet", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"id": "ws-123", "type": "workspaces", "attributes": {"name": "testnet"}}}`)
+	})
+	mux.HandleFunc("/api/v2/workspaces/ws-123/current-state-version-outputs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [
+			{"id": "wsout-1", "type": "state-version-outputs", "attributes": {"name": "bootnode_ips", "sensitive": false, "type": "map",
+				"value": {"us-east-2": ["18.222.37.52", "18.188.115.226"], "us-east-1": ["18.207.120.214"], "us-west-1": []}}},
+			{"id": "wsout-2", "type": "state-version-outputs", "attributes": {"name": "vault_server_ips", "sensitive": false, "type": "list",
+				"value": ["54.175.210.140"]}},
+			{"id": "wsout-3", "type": "state-version-outputs", "attributes": {"name": "vault_token", "sensitive": true, "type": "string", "value": null}}
+		]}`)
+	})
+	mux.HandleFunc("/api/v2/state-version-outputs/wsout-3", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"id": "wsout-3", "type": "state-version-outputs", "attributes": {"name": "vault_token", "sensitive": true, "type": "string", "value": "s.secret"}}}`)
+	})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testTFEToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors": [{"status": "401", "title": "unauthorized"}]}`)
+			return
+		}
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": [{"status": "404", "title": "not found"}]}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+func TestTFEClient_GetOutputs(t *testing.T) {
+	server := newTestTFEServer(t)
+	defer server.Close()
+
+	outputs, err := NewTFEClient(server.URL+"/", testTFEToken).GetOutputs("eximchain", "testnet")
+	if err != nil {
+		t.Fatalf("Unable to get outputs: %v", err)
+	}
+	if items, _ := outputs["vault_token"].Items(); len(items) != 1 || items[0] != "s.secret" {
+		t.Fatalf("Expected the value of the sensitive output, got: %v", items)
+	}
+
+	// the outputs render the same as the output of terraform output -json
+	template, err := ioutil.ReadFile(filepath.Join("testdata", "nodes.template"))
+	if err != nil {
+		t.Fatalf("Unable to read template: %v", err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "nodes.golden"))
+	if err != nil {
+		t.Fatalf("Unable to read golden file: %v", err)
+	}
+	result, err := RenderTemplate(template, outputs, RenderOptions{RemoveQuote: true, RemoveDelimiter: true})
+	if err != nil || string(result) != string(expected) {
+		t.Fatalf("Expected: %s, got: %s, error: %v", expected, result, err)
+	}
+}
+
+func TestTFEClient_Errors(t *testing.T) {
+	server := newTestTFEServer(t)
+	defer server.Close()
+
+	if _, err := NewTFEClient(server.URL, "bad-token").GetOutputs("eximchain", "testnet"); err == nil ||
+		!strings.Contains(err.Error(), "token is invalid") || !strings.Contains(err.Error(), "unauthorized") {
+		t.Fatalf("Expected an invalid token error, got: %v", err)
+	}
+	if _, err := NewTFEClient(server.URL, testTFEToken).GetOutputs("eximchain", "mainnet"); err == nil ||
+		!strings.Contains(err.Error(), "workspace mainnet of organization eximchain") || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expected a missing workspace error, got: %v", err)
+	}
+	if _, err := NewTFEClient("http://127.0.0.1:1", testTFEToken).GetOutputs("eximchain", "testnet"); err == nil ||
+		!strings.Contains(err.Error(), "unable to connect") {
+		t.Fatalf("Expected a connection error, got: %v", err)
+	}
+
+	if err := getTFEError(http.StatusInternalServerError, []byte(`{"errors": ["internal error"]}`)); !strings.Contains(err.Error(), "500") ||
+		!strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("Expected the errors in the response, got: %v", err)
+	}
+}
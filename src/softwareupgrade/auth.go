@@ -0,0 +1,160 @@
+package softwareupgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	signerCache      map[string]ssh.Signer // parsed private keys, keyed by filename
+	signerCacheMutex sync.Mutex            // also serializes passphrase prompts
+
+	agentClient      agent.Agent
+	agentClientMutex sync.Mutex
+)
+
+// SetAuth specifies the private keys to authenticate with, in the order they're tried,
+// the file to read the passphrase of passphrase protected keys from, and whether
+// the ssh-agent listening on SSH_AUTH_SOCK is used.
+// If passphraseFile is empty, the passphrase is prompted for on the terminal.
+func (sshConfig *SSHConfig) SetAuth(keyFilenames []string, passphraseFile string, useAgent bool) {
+	sshConfig.keyFilenames = nil
+	for _, keyFilename := range keyFilenames {
+		if keyFilename == "" {
+			continue
+		}
+		if expandedKeyFilename, err := Expand(keyFilename); err == nil {
+			keyFilename = expandedKeyFilename
+		}
+		sshConfig.keyFilenames = append(sshConfig.keyFilenames, keyFilename)
+	}
+	sshConfig.passphraseFile = passphraseFile
+	sshConfig.useAgent = useAgent
+	sshConfig.signers = nil
+}
+
+// LoadKeys parses the private keys specified in the SSHConfig, prompting for passphrases if required.
+// The keys that can't be loaded are reported in the returned error, but do not prevent the
+// remaining keys, or the ssh-agent from being used.
+func (sshConfig *SSHConfig) LoadKeys() (err error) {
+	var msg string
+	sshConfig.signers = nil
+	for _, keyFilename := range sshConfig.keyFilenames {
+		signer, err := loadSigner(keyFilename, sshConfig.passphraseFile)
+		if err != nil {
+			msg = fmt.Sprintf("%sUnable to load SSH key %s: %v\n", msg, keyFilename, err)
+			continue
+		}
+		sshConfig.signers = append(sshConfig.signers, signer)
+	}
+	if msg != "" {
+		err = errors.New(strings.TrimSuffix(msg, "\n"))
+	}
+	return
+}
+
+// getSigners returns the keys loaded from files, followed by the keys held by the ssh-agent
+func (sshConfig *SSHConfig) getSigners() (result []ssh.Signer, err error) {
+	result = append(result, sshConfig.signers...)
+	if sshConfig.useAgent {
+		if agentSigners, agentErr := getAgentSigners(); agentErr == nil {
+			result = append(result, agentSigners...)
+		} else {
+			DebugLog.Debugln("Unable to use ssh-agent: %v", agentErr)
+		}
+	}
+	if len(result) == 0 {
+		err = fmt.Errorf("no usable SSH keys for %s@%s", sshConfig.user, sshConfig.HostIPOrAddr)
+	}
+	return
+}
+
+func (sshConfig *SSHConfig) getAuthMethods() ([]ssh.AuthMethod, error) {
+	if sshConfig.signers == nil {
+		if err := sshConfig.LoadKeys(); err != nil {
+			DebugLog.Println("%v", err)
+		}
+	}
+	// Verify there's at least one key before connecting, so the failure is reported clearly
+	if _, err := sshConfig.getSigners(); err != nil {
+		return nil, err
+	}
+	// All keys are offered through a single method, as the ssh package doesn't retry
+	// a method of the same name.
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(sshConfig.getSigners)}, nil
+}
+
+func getAgentSigners() ([]ssh.Signer, error) {
+	agentClientMutex.Lock()
+	defer agentClientMutex.Unlock()
+	if agentClient == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errors.New("SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		agentClient = agent.NewClient(conn)
+	}
+	return agentClient.Signers()
+}
+
+// loadSigner parses the given private key file, once per file, reading the passphrase of a passphrase
+// protected key, in either the PEM or the OpenSSH format. Only keys that are loaded are cached, so a key
+// that fails to load, eg, due to a mistyped passphrase, is loaded again the next time it's used.
+func loadSigner(keyFilename, passphraseFile string) (signer ssh.Signer, err error) {
+	signerCacheMutex.Lock()
+	defer signerCacheMutex.Unlock()
+	if signerCache == nil {
+		signerCache = make(map[string]ssh.Signer)
+	}
+	if signer = signerCache[keyFilename]; signer != nil {
+		return
+	}
+
+	privateKey, err := ReadDataFromFile(keyFilename)
+	if err != nil {
+		return nil, err
+	}
+	signer, err = ssh.ParsePrivateKey(privateKey)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		var passphrase []byte
+		if passphrase, err = readPassphrase(keyFilename, passphraseFile); err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signerCache[keyFilename] = signer
+	return
+}
+
+func readPassphrase(keyFilename, passphraseFile string) (passphrase []byte, err error) {
+	if passphraseFile != "" {
+		passphrase, err = ReadDataFromFile(passphraseFile)
+		if err == nil {
+			passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+		}
+		return
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("key is passphrase protected, and no terminal is available to prompt for it; specify ssh_passphrase_file")
+	}
+	fmt.Printf("Enter passphrase for %s: ", keyFilename)
+	passphrase, err = terminal.ReadPassword(fd)
+	fmt.Println()
+	return
+}
@@ -0,0 +1,105 @@
+package softwareupgrade
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHConfig_LoadKeys(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	plainBlock := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	encryptedBlock, err := x509.EncryptPEMBlock(rand.Reader, plainBlock.Type, plainBlock.Bytes, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("Unable to encrypt key: %v", err)
+	}
+
+	plainKey := filepath.Join(tempdir, "plain")
+	encryptedKey := filepath.Join(tempdir, "encrypted")
+	passphraseFile := filepath.Join(tempdir, "passphrase")
+	SaveDataToFile(plainKey, pem.EncodeToMemory(plainBlock))
+	SaveDataToFile(encryptedKey, pem.EncodeToMemory(encryptedBlock))
+	SaveDataToFile(passphraseFile, []byte("secret\n"))
+
+	sshConfig := &SSHConfig{}
+	sshConfig.SetAuth([]string{plainKey, encryptedKey}, passphraseFile, false)
+	if err := sshConfig.LoadKeys(); err != nil {
+		t.Fatalf("LoadKeys failed: %v", err)
+	}
+	if len(sshConfig.signers) != 2 {
+		t.Fatalf("Expected 2 keys to be loaded, but got: %d", len(sshConfig.signers))
+	}
+
+	sshConfig.SetAuth([]string{filepath.Join(tempdir, "missing"), plainKey}, "", false)
+	if err := sshConfig.LoadKeys(); err == nil {
+		t.Fatal("LoadKeys should report the missing key")
+	}
+	if len(sshConfig.signers) != 1 {
+		t.Fatalf("The remaining key should still be loaded, but got: %d keys", len(sshConfig.signers))
+	}
+	if signers, err := sshConfig.getSigners(); err != nil || len(signers) != 1 {
+		t.Fatalf("getSigners should return the loaded key, got: %d, %v", len(signers), err)
+	}
+
+	sshConfig.SetAuth(nil, "", false)
+	sshConfig.LoadKeys()
+	if _, err := sshConfig.getSigners(); err == nil {
+		t.Fatal("getSigners should fail when there are no keys")
+	}
+}
+
+func TestSSHConfig_LoadKeysOpenSSH(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+
+	// ssh-keygen writes keys in the OpenSSH format by default
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unable to encrypt key: %v", err)
+	}
+	encryptedKey := filepath.Join(tempdir, "id_ed25519")
+	wrongPassphraseFile := filepath.Join(tempdir, "wrong")
+	passphraseFile := filepath.Join(tempdir, "passphrase")
+	SaveDataToFile(encryptedKey, pem.EncodeToMemory(block))
+	SaveDataToFile(wrongPassphraseFile, []byte("mistyped\n"))
+	SaveDataToFile(passphraseFile, []byte("secret\n"))
+
+	sshConfig := &SSHConfig{}
+	sshConfig.SetAuth([]string{encryptedKey}, wrongPassphraseFile, false)
+	if err := sshConfig.LoadKeys(); err == nil {
+		t.Fatal("LoadKeys should fail with the wrong passphrase")
+	}
+
+	// the failure isn't remembered, so the key is loaded with the right passphrase
+	sshConfig.SetAuth([]string{encryptedKey}, passphraseFile, false)
+	if err := sshConfig.LoadKeys(); err != nil {
+		t.Fatalf("LoadKeys failed: %v", err)
+	}
+	if len(sshConfig.signers) != 1 || sshConfig.signers[0].PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("Expected the ed25519 key to be loaded, but got: %d keys", len(sshConfig.signers))
+	}
+}
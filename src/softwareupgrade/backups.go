@@ -0,0 +1,89 @@
+package softwareupgrade
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// BackupFile is a backup of a remote file, made by an upgrade, named after the
+	// remote file with the backup suffix of the session appended
+	BackupFile struct {
+		Path string
+		Time time.Time // the time of the session, parsed from the backup suffix
+		Size int64
+	}
+)
+
+// parseBackupSuffix parses a backup suffix, which is the RFC3339 time of the session
+// with ':' replaced by '-', eg, 2019-01-02T10-00-00+08-00
+func parseBackupSuffix(suffix string) (result time.Time, err error) {
+	const dateTimeLen = len("2006-01-02T15-04-05")
+	if len(suffix) <= dateTimeLen || suffix[10] != 'T' {
+		return result, fmt.Errorf("invalid backup suffix: %s", suffix)
+	}
+	clock := strings.Replace(suffix[11:dateTimeLen], "-", ":", -1)
+	zone := strings.Replace(suffix[dateTimeLen:], "-", ":", -1)
+	if zone[0] == ':' { // a negative offset, eg, -05-00
+		zone = "-" + zone[1:]
+	}
+	return time.Parse(time.RFC3339, suffix[:11]+clock+zone)
+}
+
+// ListBackups returns the backups of the given remote file, the newest first.
+// Files that start with the name of the remote file, but don't end with a backup suffix, are ignored.
+func ListBackups(runner Runner, destFilePath string) (result []BackupFile, err error) {
+	cmd := fmt.Sprintf("sudo find %s -maxdepth 1 -type f -name %s -printf '%%s %%p\\n'",
+		ShellQuote(path.Dir(destFilePath)), ShellQuote(path.Base(destFilePath)+"*"))
+	output, err := runner.Run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list backups of %s: %v %s", destFilePath, err, output)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], destFilePath) {
+			continue
+		}
+		backupTime, err := parseBackupSuffix(strings.TrimPrefix(fields[1], destFilePath))
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[0], 10, 64)
+		result = append(result, BackupFile{Path: fields[1], Time: backupTime, Size: size})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	return
+}
+
+// PruneBackups removes all but the newest keep backups of the given remote file, and returns the backups
+// removed, and the space reclaimed, in bytes. With dryRun, the backups that would be removed are returned,
+// but not removed.
+func PruneBackups(runner Runner, destFilePath string, keep int, dryRun bool) (removed []BackupFile, reclaimed int64, err error) {
+	if keep < 1 {
+		return nil, 0, fmt.Errorf("at least 1 backup of %s must be kept", destFilePath)
+	}
+	backups, err := ListBackups(runner, destFilePath)
+	if err != nil || len(backups) <= keep {
+		return
+	}
+	var paths []string
+	for _, backup := range backups[keep:] {
+		paths = append(paths, ShellQuote(backup.Path))
+	}
+	if !dryRun {
+		if output, err := runner.Run(fmt.Sprintf("sudo rm -f %s", strings.Join(paths, " "))); err != nil {
+			return nil, 0, fmt.Errorf("unable to remove backups of %s: %v %s", destFilePath, err, output)
+		}
+	}
+	removed = backups[keep:]
+	for _, backup := range removed {
+		reclaimed += backup.Size
+	}
+	return
+}
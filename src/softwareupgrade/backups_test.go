@@ -0,0 +1,101 @@
+package softwareupgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBackupSuffix(t *testing.T) {
+	tests := []struct {
+		suffix    string
+		expected  string
+		expectErr bool
+	}{
+		{"2019-01-02T10-00-00+08-00", "2019-01-02T10:00:00+08:00", false},
+		{"2019-01-02T10-00-00-05-30", "2019-01-02T10:00:00-05:30", false},
+		{"2019-01-02T10-00-00Z", "2019-01-02T10:00:00Z", false},
+		{"", "", true},
+		{".bak", "", true},
+		{"2019-01-02T10-00-00", "", true},
+		{"2019-01-02 10-00-00Z", "", true},
+	}
+	for _, test := range tests {
+		result, err := parseBackupSuffix(test.suffix)
+		if (err != nil) != test.expectErr {
+			t.Fatalf("%s: unexpected error: %v", test.suffix, err)
+		}
+		if err == nil {
+			expected, _ := time.Parse(time.RFC3339, test.expected)
+			if !result.Equal(expected) {
+				t.Fatalf("%s: expected %v, got: %v", test.suffix, expected, result)
+			}
+		}
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	destFilePath := filepath.Join(tempdir, "geth")
+	files := map[string]string{
+		"geth":                          "current",
+		"geth2019-01-01T10-00-00+08-00": "1",
+		"geth2019-03-01T10-00-00+08-00": "333",
+		"geth2019-02-01T02-00-00Z":      "22",
+		"geth2019-04-01T10-00-00+08-00": "4444",
+		"geth.bak":                      "not a backup",
+		"gethx":                         "not a backup",
+		".geth.staging":                 "staged",
+		"bootnode2019-01-01T10-00-00Z":  "another file",
+	}
+	for name, contents := range files {
+		SaveDataToFile(filepath.Join(tempdir, name), []byte(contents))
+	}
+	runner := &sudoRunner{}
+
+	backups, err := ListBackups(runner, destFilePath)
+	if err != nil {
+		t.Fatalf("Unable to list backups: %v", err)
+	}
+	var names []string
+	for _, backup := range backups {
+		names = append(names, filepath.Base(backup.Path))
+	}
+	expected := "geth2019-04-01T10-00-00+08-00 geth2019-03-01T10-00-00+08-00 geth2019-02-01T02-00-00Z geth2019-01-01T10-00-00+08-00"
+	if strings.Join(names, " ") != expected {
+		t.Fatalf("Expected backups, newest first: %s, got: %v", expected, names)
+	}
+
+	removed, reclaimed, err := PruneBackups(runner, destFilePath, 2, true)
+	if err != nil || len(removed) != 2 || reclaimed != 3 {
+		t.Fatalf("Expected 2 backups of 3 bytes to be removed, got: %d, %d bytes, error: %v", len(removed), reclaimed, err)
+	}
+	if backups, _ = ListBackups(runner, destFilePath); len(backups) != 4 {
+		t.Fatal("A dry run shouldn't remove backups")
+	}
+
+	if _, reclaimed, err = PruneBackups(runner, destFilePath, 2, false); err != nil || reclaimed != 3 {
+		t.Fatalf("Expected 3 bytes to be reclaimed, got: %d, error: %v", reclaimed, err)
+	}
+	for name := range files {
+		exists := FileExists(filepath.Join(tempdir, name))
+		pruned := name == "geth2019-01-01T10-00-00+08-00" || name == "geth2019-02-01T02-00-00Z"
+		if exists == pruned {
+			t.Fatalf("%s: expected to exist: %v", name, !pruned)
+		}
+	}
+
+	if removed, _, err = PruneBackups(runner, destFilePath, 2, false); err != nil || len(removed) != 0 {
+		t.Fatalf("Expected no more backups to be removed, got: %d, error: %v", len(removed), err)
+	}
+	if _, _, err = PruneBackups(runner, destFilePath, 0, false); err == nil {
+		t.Fatal("At least 1 backup should be kept")
+	}
+}
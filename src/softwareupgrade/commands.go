@@ -0,0 +1,115 @@
+package softwareupgrade
+
+import (
+	"fmt"
+	"path"
+)
+
+// The functions below render the remote commands used to upgrade a file, so that
+// the same commands are executed by RunUpgrade and shown by a plan.
+
+// getStagingPath returns the path a file is staged at before it replaces destFilePath.
+// It's in the same directory as destFilePath, so that replacing destFilePath is a rename.
+func getStagingPath(destFilePath string) string {
+	return path.Join(path.Dir(destFilePath), fmt.Sprintf(".%s.staging", path.Base(destFilePath)))
+}
+
+// getBackupCommand returns the command that keeps the current destination file as the backup.
+// For the move strategy, the backup is a hard link, so that the destination is replaced
+// atomically by the rename, instead of being missing until the staged file is moved into place.
+func getBackupCommand(upgradeStruct UpgradeStruct, suffix string) (cmd string, err error) {
+	backupName := upgradeStruct.DestFilePath + suffix
+	switch upgradeStruct.BackupStrategy {
+	case CBackupCopy:
+		{
+			cmd = fmt.Sprintf("sudo cp -p %s %s", ShellQuote(upgradeStruct.DestFilePath), ShellQuote(backupName))
+		}
+	case CBackupMove:
+		{
+			cmd = fmt.Sprintf("sudo ln -f %s %s", ShellQuote(upgradeStruct.DestFilePath), ShellQuote(backupName))
+		}
+	default:
+		{
+			err = fmt.Errorf("unknown backup strategy: %s", upgradeStruct.BackupStrategy)
+		}
+	}
+	return
+}
+
+// getPromoteCommand returns the command that atomically replaces destFilePath with the staged file
+func getPromoteCommand(stagingPath, destFilePath string) string {
+	return fmt.Sprintf("sudo mv -f %s %s", ShellQuote(stagingPath), ShellQuote(destFilePath))
+}
+
+// getChownCommand returns the command that changes the ownership of filePath to owner, eg, user:group
+func getChownCommand(filePath, owner string) string {
+	return fmt.Sprintf("sudo chown %s %s", owner, filePath)
+}
+
+func getRemoveCommand(filePath string) string {
+	return fmt.Sprintf("sudo rm -f %s", ShellQuote(filePath))
+}
+
+// hashLocalFile hashes the given local file with the algorithm specified in VerifyCopy
+func hashLocalFile(verifyCopy, filePath string) (result string, err error) {
+	if expandedFilePath, err := Expand(filePath); err == nil {
+		filePath = expandedFilePath
+	}
+	localHasher := NewLocalHostHasher()
+	switch verifyCopy {
+	case CVerifyMD5:
+		{
+			result, err = localHasher.Md5sum(filePath)
+		}
+	case CVerifySHA256:
+		{
+			result, err = localHasher.Sha256sum(filePath)
+		}
+	default:
+		{
+			err = fmt.Errorf("unknown verification: %s", verifyCopy)
+		}
+	}
+	return
+}
+
+// hashRemoteFile hashes the given remote file with the algorithm specified in VerifyCopy.
+// sudo is used, as the file might not be readable by the SSH user.
+func hashRemoteFile(runner Runner, verifyCopy, filePath string) (result string, err error) {
+	switch verifyCopy {
+	case CVerifyMD5:
+		{
+			result, err = internalSum(runner, "sudo md5sum", ShellQuote(filePath))
+		}
+	case CVerifySHA256:
+		{
+			result, err = internalSum(runner, "sudo sha256sum", ShellQuote(filePath))
+		}
+	default:
+		{
+			err = fmt.Errorf("unknown verification: %s", verifyCopy)
+		}
+	}
+	return
+}
+
+// getCopyEntries returns the files to copy, in the numeric order of their keys, skipping empty entries.
+// Keys start from either 0 or 1.
+func (upgradeInfo *UpgradeInfo) getCopyEntries() (result []UpgradeStruct) {
+	for i := 0; i < len(upgradeInfo.Copy)+1; i++ {
+		upgradeStruct := upgradeInfo.Copy[IntToStr(i)]
+		if (UpgradeStruct{}) == upgradeStruct || upgradeStruct.SourceFilePath == "" { // skip empty struct, or empty source
+			continue
+		}
+		result = append(result, upgradeStruct)
+	}
+	return
+}
+
+// GetDestFilePaths returns the remote files copied by the upgrade, in the order they're copied
+func (upgradeInfo *UpgradeInfo) GetDestFilePaths() (result []string) {
+	for _, upgradeStruct := range upgradeInfo.getCopyEntries() {
+		result = append(result, upgradeStruct.DestFilePath)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package softwareupgrade
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// fakeUploadRunner upgrades a single remote file kept in memory, and records the steps of the upgrade
+type fakeUploadRunner struct {
+	staged   []byte
+	copyErr  error // returned by the transfer of the file
+	corrupt  bool  // the staged file differs from the local file
+	commands []string
+}
+
+func (runner *fakeUploadRunner) Run(cmd string) (string, error) {
+	runner.commands = append(runner.commands, cmd)
+	switch {
+	case strings.HasPrefix(cmd, "[  -e "):
+		return "Yes", nil
+	case strings.HasPrefix(cmd, "sudo sha256sum "):
+		return fmt.Sprintf("%x  remote\n", sha256.Sum256(runner.staged)), nil
+	}
+	return "", nil
+}
+
+func (runner *fakeUploadRunner) CopyLocalFileToRemoteFile(localFilename, remoteFilename, permissions string) error {
+	runner.commands = append(runner.commands, fmt.Sprintf("copy %s %s", localFilename, remoteFilename))
+	if runner.copyErr != nil {
+		return runner.copyErr
+	}
+	data, err := ioutil.ReadFile(localFilename)
+	if runner.corrupt {
+		data = append(data, '!')
+	}
+	runner.staged = data
+	return err
+}
+
+func (runner *fakeUploadRunner) resumesTransfers() bool {
+	return false
+}
+
+// steps returns the steps of the upgrade that were run, in order
+func (runner *fakeUploadRunner) steps() (result []string) {
+	prefixes := []struct{ prefix, step string }{
+		{"copy ", "stage"},
+		{"sudo sha256sum ", "verify"},
+		{"sudo chown ", "chown"},
+		{"sudo ln -f ", "backup"},
+		{"sudo mv -f ", "promote"},
+		{"sudo rm -f ", "remove"},
+	}
+	for _, cmd := range runner.commands {
+		for _, p := range prefixes {
+			if strings.HasPrefix(cmd, p.prefix) {
+				result = append(result, p.step)
+			}
+		}
+	}
+	return
+}
+
+func Test_getStagingPath(t *testing.T) {
+	if stagingPath := getStagingPath("/usr/local/bin/geth"); stagingPath != "/usr/local/bin/.geth.staging" {
+		t.Fatalf("Staging path should be next to the destination, but is: %s", stagingPath)
+	}
+}
+
+func Test_getBackupCommand(t *testing.T) {
+	upgradeStruct := UpgradeStruct{DestFilePath: "/usr/local/bin/geth", BackupStrategy: CBackupCopy}
+	cmd, err := getBackupCommand(upgradeStruct, "2018-09-05T07-20-06Z")
+	if err != nil || cmd != "sudo cp -p /usr/local/bin/geth /usr/local/bin/geth2018-09-05T07-20-06Z" {
+		t.Fatalf("Unexpected copy backup command: %s, %v", cmd, err)
+	}
+
+	upgradeStruct.BackupStrategy = CBackupMove
+	cmd, err = getBackupCommand(upgradeStruct, "2018-09-05T07-20-06Z")
+	if err != nil || cmd != "sudo ln -f /usr/local/bin/geth /usr/local/bin/geth2018-09-05T07-20-06Z" {
+		t.Fatalf("Unexpected move backup command: %s, %v", cmd, err)
+	}
+
+	upgradeStruct.BackupStrategy = "rename"
+	if _, err = getBackupCommand(upgradeStruct, ""); err == nil {
+		t.Fatal("Unknown backup strategies should be rejected")
+	}
+}
+
+func Test_upgradeFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		copyErr error
+		corrupt bool
+		steps   []string
+	}{
+		{"verified", nil, false, []string{"stage", "verify", "chown", "backup", "promote"}},
+		{"verification mismatch", nil, true, []string{"stage", "verify", "remove"}},
+		{"transfer error", errors.New("connection lost"), false, []string{"stage", "remove"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, cleanup := newTransferFile(t, "geth 1.8")
+			defer cleanup()
+			upgradeStruct := UpgradeStruct{SourceFilePath: file.Name(), DestFilePath: "/usr/local/bin/geth",
+				UserGroup: "root:root", Permissions: "0755", VerifyCopy: CVerifySHA256, BackupStrategy: CBackupMove}
+			runner := &fakeUploadRunner{copyErr: test.copyErr, corrupt: test.corrupt}
+			nodeInfo := &NodeInfoContainer{}
+
+			err := nodeInfo.upgradeFile(runner, upgradeStruct, nil)
+			if (err == nil) != (test.copyErr == nil && !test.corrupt) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if fmt.Sprint(runner.steps()) != fmt.Sprint(test.steps) {
+				t.Fatalf("Expected steps: %v, got: %v, commands: %q", test.steps, runner.steps(), runner.commands)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,30 @@ type (
 		SSHCert     string `json:"ssh_cert"`
 		SSHUserName string `json:"ssh_username"`
 		SSHTimeout  string `json:"ssh_timeout"`
+
+		SSHKnownHosts          string   `json:"ssh_known_hosts"`           // known_hosts file, defaults to ~/.ssh/known_hosts
+		SSHHostKeyCheck        string   `json:"ssh_host_key_check"`        // strict (default), tofu or off
+		SSHHostKeyFingerprints []string `json:"ssh_host_key_fingerprints"` // pinned host key fingerprints, eg, SHA256:...
+
+		SSHKeys           []string `json:"ssh_keys"`            // fallback private keys, tried in order after ssh_cert
+		SSHPassphraseFile string   `json:"ssh_passphrase_file"` // file containing the passphrase of passphrase protected keys
+		SSHDisableAgent   bool     `json:"ssh_disable_agent"`   // disables authentication through the ssh-agent at SSH_AUTH_SOCK
+
+		ProxyJump []JumpHost `json:"proxy_jump"` // bastion hosts to tunnel through, in order
+		SSHPort   int        `json:"ssh_port"`   // used when the node doesn't specify a port, defaults to 22
+
+		TransferProtocol  string `json:"transfer_protocol"`   // scp (default) or sftp
+		ResumableTransfer bool   `json:"resumable_transfer"`  // transfers continue from where an interrupted transfer stopped
+		TransferChunkSize int64  `json:"transfer_chunk_size"` // size in bytes of each chunk of a resumable transfer
+	}
+
+	// JumpHost specifies a bastion host used to reach nodes that can't be connected to directly.
+	// If the username or the cert is not specified, the ones used for the node are used.
+	JumpHost struct {
+		Host                   string   `json:"host"`
+		SSHUserName            string   `json:"ssh_username"`
+		SSHCert                string   `json:"ssh_cert"`
+		SSHHostKeyFingerprints []string `json:"ssh_host_key_fingerprints"`
 	}
 
 	// RollbackStruct contains the necessary information in order to rollback a particular
@@ -57,11 +83,18 @@ type (
 		// copy will be numeric order.
 		Copy map[string]UpgradeStruct `json:"Copy"`
 		Exec []string                 `json:"Exec"`
+
+		DependsOn []string `json:"depends_on"` // software in the same group that are upgraded before this software
+
+		HealthChecks []HealthCheck `json:"health_checks"` // checks run after the software is started
+		OnFailure    string        `json:"on_failure"`    // rollback, halt or continue, when the upgrade or a health check fails
+		KeepBackups  int           `json:"keep_backups"`  // the number of backups of each file kept by prune-backups
 	}
 
 	// FailedUpgradeInfo records the name of nodes together with the software it failed to upgrade.
 	FailedUpgradeInfo struct {
 		FailedNodeSoftware map[string][]string `json:"NodeSoftware"`
+		mutex              sync.Mutex          // nodes are upgraded concurrently
 	}
 
 	// NodeInfoContainer contains the information necessary to connect to a particular node and its upgrade information
@@ -76,6 +109,17 @@ type (
 		NodeUpgradeInfo map[string]UpgradeInfo
 	}
 
+	// GroupSettings contains the settings for upgrading the nodes of a software group
+	GroupSettings struct {
+		MaxParallel int      `json:"max_parallel"` // the number of nodes in the group that are upgraded at the same time
+		DependsOn   []string `json:"depends_on"`   // the groups that are upgraded before this group
+		CanaryNodes []string `json:"canary_nodes"` // the nodes upgraded before the rest of the group
+		CanaryCount int      `json:"canary_count"` // the number of nodes, from the start of the group, used as canaries, if canary_nodes isn't specified
+		CanarySoak  Duration `json:"canary_soak"`  // the time the canaries must remain healthy, before the rest of the group is upgraded
+
+		MaxUnavailable CountOrPercent `json:"max_unavailable"` // the number, or percentage, of nodes in the group that can be stopped at the same time
+	}
+
 	// Duration contains the delay to sleep between upgrades
 	Duration struct {
 		time.Duration
@@ -84,9 +128,15 @@ type (
 	// UpgradeConfig contains the configuration for upgrading nodes
 	UpgradeConfig struct {
 		Common struct {
-			SSHInfo                           // This specifies the general and common SSL configuration for common nodes
-			SoftwareGroup map[string][]string `json:"software_group"` // This specifies the software type that's possible to run on a node, the start and stop command, the command used to upgrade the software
-			GroupPause    Duration            `json:"group_pause_after_upgrade"`
+			SSHInfo                                 // This specifies the general and common SSL configuration for common nodes
+			SoftwareGroup  map[string][]string      `json:"software_group"` // This specifies the software type that's possible to run on a node, the start and stop command, the command used to upgrade the software
+			GroupPause     Duration                 `json:"group_pause_after_upgrade"`
+			GroupSettings  map[string]GroupSettings `json:"group_settings"`   // settings for each software group, keyed by group name
+			GroupOrder     []string                 `json:"group_order"`      // the order the software groups are upgraded in
+			OnFailure      string                   `json:"on_failure"`       // rollback, halt or continue, unless specified by the software
+			LockFile       string                   `json:"lock_file"`        // the lock file created on each node while it's upgraded
+			LockStaleAfter Duration                 `json:"lock_stale_after"` // the age after which a lock on a node is considered abandoned
+			KeepBackups    int                      `json:"keep_backups"`     // the number of backups of each file kept by prune-backups, unless specified by the software
 		} `json:"common"`
 		Nodes    map[string]NodeInfoContainer `json:"nodes"`    // This is a map with the key as the DNS hostnames of each node that participates in the network
 		Software map[string]UpgradeInfo       `json:"software"` // this defines each individual piece of software
@@ -101,7 +151,8 @@ type (
 )
 
 var (
-	sourceFilesVerificationInfo map[string]string
+	sourceFilesVerificationInfo      map[string]string // SHA256 hashes of source files, keyed by path
+	sourceFilesVerificationInfoMutex sync.Mutex
 )
 
 // MarshalJSON marshals the duration into JSON format
@@ -131,36 +182,86 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	}
 }
 
-// RunAdd adds the given files specified in the nodeInfo to the target node specified in the sshConfig
+// NewSSHConfig returns the SSHConfig used to connect to the given node, configured
+// with the SSH settings resolved for the node.
+func (nodeInfo *NodeInfoContainer) NewSSHConfig(node string) (result *SSHConfig) {
+	// Each hop is tunneled through the previous hop. As SSHConfigs are cached, the
+	// connection to a bastion is shared by all the nodes behind it, so it's only
+	// configured by the first node that uses it.
+	var jumpHost *SSHConfig
+	for _, hop := range nodeInfo.ProxyJump {
+		user, cert := hop.SSHUserName, hop.SSHCert
+		if user == "" {
+			user = nodeInfo.SSHUserName
+		}
+		if cert == "" {
+			cert = nodeInfo.SSHCert
+		}
+		hopConfig := NewSSHConfig(user, cert, hop.Host)
+		hopConfig.configureJumpHost(jumpHostSettings{
+			hostKeyCheck:   nodeInfo.SSHHostKeyCheck,
+			knownHostsFile: nodeInfo.SSHKnownHosts,
+			fingerprints:   hop.SSHHostKeyFingerprints,
+			keyFilename:    cert,
+			passphraseFile: nodeInfo.SSHPassphraseFile,
+			useAgent:       !nodeInfo.SSHDisableAgent,
+			jumpHost:       jumpHost,
+		})
+		jumpHost = hopConfig
+	}
+
+	result = NewSSHConfig(nodeInfo.SSHUserName, nodeInfo.SSHCert, node)
+	result.SetPort(nodeInfo.GetSSHPort(node))
+	result.SetTransferProtocol(nodeInfo.TransferProtocol)
+	result.SetResumableTransfer(nodeInfo.ResumableTransfer, nodeInfo.TransferChunkSize)
+	result.SetProxyJump(jumpHost)
+	result.SetHostKeyCheck(nodeInfo.SSHHostKeyCheck, nodeInfo.SSHKnownHosts, nodeInfo.SSHHostKeyFingerprints)
+	result.SetAuth(append([]string{nodeInfo.SSHCert}, nodeInfo.SSHKeys...), nodeInfo.SSHPassphraseFile, !nodeInfo.SSHDisableAgent)
+	if err := result.LoadKeys(); err != nil {
+		// report unusable keys up front, instead of as an authentication failure later
+		DebugLog.Println("Node %s: %v", node, err)
+	}
+	return
+}
+
+// GetSSHPort returns the port to SSH to the given node on. A port specified as part of
+// the node, eg, host:2222, takes precedence over ssh_port.
+func (sshInfo *SSHInfo) GetSSHPort(node string) int {
+	defaultPort := sshInfo.SSHPort
+	if defaultPort == 0 {
+		defaultPort = CDefaultSSHPort
+	}
+	_, port, err := SplitNodeAddress(node, defaultPort)
+	if err != nil {
+		return defaultPort
+	}
+	return port
+}
+
+// RunAdd adds the given files specified in the nodeInfo to the target node specified in the sshConfig.
+// Like an upgrade, each file is staged next to its destination and verified before it's moved into place,
+// so that a failed transfer never leaves a partial file at the destination. An existing destination isn't
+// backed up, as the rollback of an add deletes the added files.
 func (nodeInfo *NodeInfoContainer) RunAdd(sshConfig *SSHConfig) (err error) {
 	var msg string
-	if len(nodeInfo.Copy) > 0 {
-		for i := 0; i < len(nodeInfo.Copy)+1; i++ {
-			index := IntToStr(i)
-			upgradeStruct := nodeInfo.Copy[index]
-			if (UpgradeStruct{}) == upgradeStruct { // skip empty struct, or empty source
-				continue
-			}
-			err = sshConfig.CopyLocalFileToRemoteFile(
-				upgradeStruct.SourceFilePath,
-				upgradeStruct.DestFilePath, upgradeStruct.Permissions)
-			if err != nil {
-				if msg == "" {
-					msg = fmt.Sprintf("%v", err)
-				} else {
-					msg = fmt.Sprintf("%s\n%v", msg, err)
-				}
+	for _, upgradeStruct := range nodeInfo.getCopyEntries() {
+		upgradeStruct.BackupStrategy = ""
+		if upgradeStruct.VerifyCopy == "" {
+			upgradeStruct.VerifyCopy = CVerifySHA256
+		}
+		err = nodeInfo.upgradeFile(sshConfig, upgradeStruct, nil)
+		if IsHostKeyError(err) {
+			return
+		}
+		if err != nil {
+			if msg == "" {
+				msg = fmt.Sprintf("%v", err)
 			} else {
-				if upgradeStruct.UserGroup != "" {
-					// if fileOwner has been retrieved, change the file ownership to the previous
-					err = sshConfig.changeFileOwnership(upgradeStruct.DestFilePath, upgradeStruct.UserGroup)
-					if err != nil {
-						msg = fmt.Sprintf("%s\n%v", msg, err)
-					}
-				}
+				msg = fmt.Sprintf("%s\n%v", msg, err)
 			}
 		}
 	}
+	err = nil
 	if msg != "" {
 		err = errors.New(msg)
 	}
@@ -184,6 +285,9 @@ func (nodeInfo *NodeInfoContainer) RunDeleteRollback(sshConfig *SSHConfig, rollb
 			}
 			if cmd := nodeInfo.StopCmd; cmd != "" {
 				_, err := sshConfig.Run(cmd)
+				if IsHostKeyError(err) {
+					return err
+				}
 				if err != nil {
 					if msg == "" {
 						msg = fmt.Sprintf("%v", err)
@@ -204,7 +308,7 @@ func (nodeInfo *NodeInfoContainer) RunDeleteRollback(sshConfig *SSHConfig, rollb
 }
 
 // RunRollback runs the rollback for a particular node
-func (nodeInfo *NodeInfoContainer) RunRollback(sshConfig *SSHConfig, rollbackSuffix string) (err error) {
+func (nodeInfo *NodeInfoContainer) RunRollback(runner Runner, rollbackSuffix string) (err error) {
 	if len(nodeInfo.Copy) > 0 {
 		for i := 0; i < len(nodeInfo.Copy)+1; i++ {
 			index := IntToStr(i)
@@ -213,7 +317,7 @@ func (nodeInfo *NodeInfoContainer) RunRollback(sshConfig *SSHConfig, rollbackSuf
 				continue
 			}
 			if upgradeStruct.UserGroup == "" {
-				if upgradeStruct.UserGroup, err = sshConfig.getFileOwnership(upgradeStruct.DestFilePath); err != nil {
+				if upgradeStruct.UserGroup, err = getFileOwnership(runner, upgradeStruct.DestFilePath); err != nil {
 					DebugLog.Printf("Unable to get owner for %s, error: %v\n", upgradeStruct.DestFilePath, err)
 				}
 			}
@@ -224,18 +328,18 @@ func (nodeInfo *NodeInfoContainer) RunRollback(sshConfig *SSHConfig, rollbackSuf
 					cmd := PreUpgradeCmds[i]
 					msg := fmt.Sprintf(`Pre-Rollback command %d: "%s"`, i, cmd)
 					DebugLog.Println(msg)
-					cmdOutput, err := sshConfig.Run(cmd)
+					cmdOutput, err := runner.Run(cmd)
 					msg = fmt.Sprintf(`%d output: "%s", error: "%v"`, i, cmdOutput, err)
 					DebugLog.Println(msg)
 				}
 			}
 			rollbackName := upgradeStruct.DestFilePath + rollbackSuffix
 			cmd := fmt.Sprintf("sudo mv %s %s", rollbackName, upgradeStruct.DestFilePath)
-			_, err = sshConfig.Run(cmd)
+			_, err = runner.Run(cmd)
 			if err == nil {
 				if upgradeStruct.UserGroup != "" {
 					// if fileOwner has been retrieved, change the file ownership to the previous
-					err = sshConfig.changeFileOwnership(upgradeStruct.DestFilePath, upgradeStruct.UserGroup)
+					err = changeFileOwnership(runner, upgradeStruct.DestFilePath, upgradeStruct.UserGroup)
 					if err != nil {
 						DebugLog.Printf("Unable to set owner for %s, error: %v\n", upgradeStruct.DestFilePath, err)
 					}
@@ -248,7 +352,7 @@ func (nodeInfo *NodeInfoContainer) RunRollback(sshConfig *SSHConfig, rollbackSuf
 					cmd := PostUpgradeCmds[i]
 					msg := fmt.Sprintf(`Post-Rollback command %d: "%s"`, i, cmd)
 					DebugLog.Println(msg)
-					cmdOutput, err := sshConfig.Run(cmd)
+					cmdOutput, err := runner.Run(cmd)
 					msg = fmt.Sprintf(`%d output: "%s", error: "%v"`, i, cmdOutput, err)
 					DebugLog.Println(msg)
 				}
@@ -258,59 +362,23 @@ func (nodeInfo *NodeInfoContainer) RunRollback(sshConfig *SSHConfig, rollbackSuf
 	return
 }
 
-// RunUpgrade runs the upgrade for a particular node
+// RunUpgrade runs the upgrade for a particular node.
+// Each file is staged next to its destination and verified, before it replaces the destination,
+// so that a failed transfer leaves the destination untouched.
 func (nodeInfo *NodeInfoContainer) RunUpgrade(sshConfig *SSHConfig) (err error) {
-	// Support i := 0 or i := 1 by checking for empty struct
+	return nodeInfo.ResumeUpgrade(sshConfig, nil)
+}
+
+// ResumeUpgrade runs the upgrade for a particular node like RunUpgrade, recording each step in the journal,
+// and skipping the steps the journal already records, eg, a file isn't backed up again once it's been replaced.
+func (nodeInfo *NodeInfoContainer) ResumeUpgrade(sshConfig *SSHConfig, journal *NodeJournal) (err error) {
 	var msg string
 	if len(nodeInfo.Copy) > 0 {
-		for i := 0; i < len(nodeInfo.Copy)+1; i++ {
-			index := IntToStr(i)
-			upgradeStruct := nodeInfo.Copy[index]
-			if (UpgradeStruct{}) == upgradeStruct || upgradeStruct.SourceFilePath == "" { // skip empty struct, or empty source
+		for _, upgradeStruct := range nodeInfo.getCopyEntries() {
+			if journal.Done(CStepReplaced, upgradeStruct.DestFilePath) {
+				DebugLog.Println("Skipping %s, as it's already been replaced", upgradeStruct.DestFilePath)
 				continue
 			}
-			var (
-				sourceHash, destHash string
-			)
-			if upgradeStruct.VerifyCopy != "" {
-				localHasher := NewLocalHostHasher()
-				switch upgradeStruct.VerifyCopy {
-				case "md5":
-					{
-						sourceHash, err = localHasher.Md5sum(upgradeStruct.SourceFilePath)
-					}
-				case "sha256":
-					{
-						sourceHash, err = localHasher.Sha256sum(upgradeStruct.SourceFilePath)
-					}
-				}
-			}
-			if upgradeStruct.Permissions == "" {
-				upgradeStruct.Permissions, err = sshConfig.getFilePermissions(upgradeStruct.DestFilePath)
-			}
-			if upgradeStruct.UserGroup == "" {
-				if upgradeStruct.UserGroup, err = sshConfig.getFileOwnership(upgradeStruct.DestFilePath); err != nil {
-					DebugLog.Printf("Unable to get owner for %s, error: %v\n", upgradeStruct.DestFilePath, err)
-				}
-			}
-			if upgradeStruct.BackupStrategy != "" {
-				var cmd, backupName string
-				backupName = upgradeStruct.DestFilePath + backupSuffix
-				switch upgradeStruct.BackupStrategy {
-				case "copy":
-					{
-						cmd = fmt.Sprintf("sudo cp %s %s", upgradeStruct.DestFilePath, backupName)
-					}
-				case "move":
-					{
-						cmd = fmt.Sprintf("sudo mv %s %s", upgradeStruct.DestFilePath, backupName)
-					}
-				}
-				backupResult, err := sshConfig.Run(cmd)
-				if err != nil {
-					msg = fmt.Sprintf("%sFailed to implement backup strategy for node: %v software: %s\n", msg, err, backupResult)
-				}
-			}
 			PreUpgradeCmds := nodeInfo.PreUpgrade
 			if len(PreUpgradeCmds) > 0 {
 				DebugLog.Println("Running Pre-Upgrade commands...")
@@ -323,34 +391,13 @@ func (nodeInfo *NodeInfoContainer) RunUpgrade(sshConfig *SSHConfig) (err error)
 					DebugLog.Println(msg)
 				}
 			}
-			err = sshConfig.CopyLocalFileToRemoteFile(
-				upgradeStruct.SourceFilePath,
-				upgradeStruct.DestFilePath, upgradeStruct.Permissions)
-			if err != nil {
-				msg = fmt.Sprintf("%sError encountered during file transfer in RunUpgrade: %v\n", msg, err)
-			} else if upgradeStruct.VerifyCopy != "" {
-				switch upgradeStruct.VerifyCopy {
-				case "md5":
-					{
-						destHash, err = sshConfig.Md5sum(upgradeStruct.DestFilePath)
-					}
-				case "sha256":
-					{
-						destHash, err = sshConfig.Sha256sum(upgradeStruct.DestFilePath)
-					}
-				}
-				// file transfer successful since the hash is the same
-				if destHash != "" && sourceHash != "" && sourceHash == destHash {
-					if upgradeStruct.UserGroup != "" {
-						// if fileOwner has been retrieved, change the file ownership to the previous
-						err = sshConfig.changeFileOwnership(upgradeStruct.DestFilePath, upgradeStruct.UserGroup)
-					}
-					if err == nil {
-						DebugLog.Println("Upgrade successful!")
-					}
-				} else {
-					msg = fmt.Sprintf("%sUpgrade failed for %s\n", msg, upgradeStruct.DestFilePath)
+			if err := nodeInfo.upgradeFile(sshConfig, upgradeStruct, journal); err != nil {
+				if IsHostKeyError(err) {
+					return err
 				}
+				msg = fmt.Sprintf("%sUpgrade failed for %s: %v\n", msg, upgradeStruct.DestFilePath, err)
+			} else {
+				DebugLog.Println("Upgrade successful!")
 			}
 			PostUpgradeCmds := nodeInfo.PostUpgrade
 			if len(PostUpgradeCmds) > 0 {
@@ -380,14 +427,165 @@ func (nodeInfo *NodeInfoContainer) RunUpgrade(sshConfig *SSHConfig) (err error)
 			}
 		}
 	}
+	if err == nil {
+		err = journal.Record(CStepUpgraded, "")
+	}
 	return
 }
 
-// GetGroupNames gets the groups specified in the config
-func (config *UpgradeConfig) GetGroupNames() (result []string) {
-	for groupKey := range config.SoftwareGroupNodes {
-		result = append(result, groupKey)
+// IsUpToDate returns true if every file to be copied for the software already exists on the node,
+// with the same SHA256 hash as its source file, so that the upgrade can be skipped.
+// A destination file that can't be hashed, eg, because it doesn't exist, isn't up to date.
+func (nodeInfo *NodeInfoContainer) IsUpToDate(sshConfig *SSHConfig) (result bool, err error) {
+	var checked int
+	for _, upgradeStruct := range nodeInfo.Copy {
+		if upgradeStruct.SourceFilePath == "" {
+			continue
+		}
+		sourceHash, err := getSourceFileHash(upgradeStruct.SourceFilePath)
+		if err != nil {
+			return false, err
+		}
+		destHash, err := hashRemoteFile(sshConfig, CVerifySHA256, upgradeStruct.DestFilePath)
+		if err != nil {
+			if IsHostKeyError(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		if destHash != sourceHash {
+			return false, nil
+		}
+		checked++
+	}
+	result = checked > 0
+	return
+}
+
+// getSourceFileHash returns the SHA256 hash of the given source file, hashing each file only once
+func getSourceFileHash(sourceFilePath string) (result string, err error) {
+	if expandedFilePath, err := Expand(sourceFilePath); err == nil {
+		sourceFilePath = expandedFilePath
+	}
+	sourceFilesVerificationInfoMutex.Lock()
+	defer sourceFilesVerificationInfoMutex.Unlock()
+	if sourceFilesVerificationInfo == nil {
+		sourceFilesVerificationInfo = make(map[string]string)
+	}
+	if result = sourceFilesVerificationInfo[sourceFilePath]; result != "" {
+		return
+	}
+	if result, err = NewLocalHostHasher().Sha256sum(sourceFilePath); err == nil {
+		sourceFilesVerificationInfo[sourceFilePath] = result
+	}
+	return
+}
+
+// upgradeFile stages, verifies, backs up and then replaces a single file.
+// The destination is only modified once the staged file is verified.
+// The steps recorded in the journal are skipped, and each step performed is recorded.
+func (nodeInfo *NodeInfoContainer) upgradeFile(runner uploadRunner, upgradeStruct UpgradeStruct, journal *NodeJournal) (err error) {
+	var sourceHash, stagedHash string
+	if sourceHash, err = hashLocalFile(upgradeStruct.VerifyCopy, upgradeStruct.SourceFilePath); err != nil {
+		return fmt.Errorf("unable to hash %s: %v", upgradeStruct.SourceFilePath, err)
+	}
+
+	// The staged file might have replaced the destination, before the replacement was recorded
+	if journal.Done(CStepVerified, upgradeStruct.DestFilePath) {
+		if destHash, err := hashRemoteFile(runner, upgradeStruct.VerifyCopy, upgradeStruct.DestFilePath); err == nil && destHash == sourceHash {
+			DebugLog.Println("%s has already been replaced", upgradeStruct.DestFilePath)
+			return journal.Record(CStepReplaced, upgradeStruct.DestFilePath)
+		}
+	}
+
+	destExists, err := internalExists(runner, "", "e", upgradeStruct.DestFilePath)
+	if err != nil {
+		return err
+	}
+	if destExists {
+		if upgradeStruct.Permissions == "" {
+			if upgradeStruct.Permissions, err = getFilePermissions(runner, upgradeStruct.DestFilePath); err != nil {
+				DebugLog.Printf("Unable to get permissions for %s, error: %v\n", upgradeStruct.DestFilePath, err)
+			}
+		}
+		if upgradeStruct.UserGroup == "" {
+			if upgradeStruct.UserGroup, err = getFileOwnership(runner, upgradeStruct.DestFilePath); err != nil {
+				DebugLog.Printf("Unable to get owner for %s, error: %v\n", upgradeStruct.DestFilePath, err)
+			}
+		}
+	}
+
+	stagingPath := getStagingPath(upgradeStruct.DestFilePath)
+	removeStaged := func() {
+		if _, err := runner.Run(getRemoveCommand(stagingPath)); err != nil {
+			DebugLog.Printf("Unable to remove %s, error: %v\n", stagingPath, err)
+		}
+	}
+
+	if !journal.Done(CStepCopied, upgradeStruct.DestFilePath) {
+		DebugLog.Println("Staging %s to %s", upgradeStruct.SourceFilePath, stagingPath)
+		err = runner.CopyLocalFileToRemoteFile(upgradeStruct.SourceFilePath, stagingPath, upgradeStruct.Permissions)
+		if err != nil {
+			if !runner.resumesTransfers() { // keep the partial file, so that the next attempt continues from it
+				removeStaged()
+			}
+			return fmt.Errorf("Error encountered during file transfer: %v", err)
+		}
+		if err = journal.Record(CStepCopied, upgradeStruct.DestFilePath); err != nil {
+			return
+		}
+	}
+
+	if !journal.Done(CStepVerified, upgradeStruct.DestFilePath) {
+		if stagedHash, err = hashRemoteFile(runner, upgradeStruct.VerifyCopy, stagingPath); err != nil || stagedHash != sourceHash {
+			removeStaged()
+			journal.Record(CStepRolledBack, upgradeStruct.DestFilePath) // the file has to be copied again
+			return fmt.Errorf("verification of %s failed, expected %s hash: %s, got: %s, error: %v",
+				stagingPath, upgradeStruct.VerifyCopy, sourceHash, stagedHash, err)
+		}
+		if err = journal.Record(CStepVerified, upgradeStruct.DestFilePath); err != nil {
+			return
+		}
+	}
+
+	if upgradeStruct.UserGroup != "" {
+		// change the file ownership to the previous owner before it replaces the destination
+		if err = changeFileOwnership(runner, stagingPath, upgradeStruct.UserGroup); err != nil {
+			removeStaged()
+			return err
+		}
+	}
+
+	// The backup isn't made again, as the destination might already be the staged file
+	if destExists && upgradeStruct.BackupStrategy != "" && !journal.Done(CStepBackedUp, upgradeStruct.DestFilePath) {
+		cmd, err := getBackupCommand(upgradeStruct, backupSuffix)
+		if err == nil {
+			var backupResult string
+			backupResult, err = runner.Run(cmd)
+			if err != nil {
+				err = fmt.Errorf("%v %s", err, backupResult)
+			}
+		}
+		if err != nil {
+			removeStaged()
+			return fmt.Errorf("Failed to implement backup strategy: %v", err)
+		}
+		if err = journal.Record(CStepBackedUp, upgradeStruct.DestFilePath); err != nil {
+			return err
+		}
 	}
+
+	if _, err = runner.Run(getPromoteCommand(stagingPath, upgradeStruct.DestFilePath)); err != nil {
+		removeStaged()
+		return fmt.Errorf("unable to move %s into place: %v", stagingPath, err)
+	}
+	return journal.Record(CStepReplaced, upgradeStruct.DestFilePath)
+}
+
+// GetGroupNames gets the groups specified in the config, in the order they're upgraded in,
+// as specified by group_order and depends_on. Use VerifyOrder to check the order can be satisfied.
+func (config *UpgradeConfig) GetGroupNames() (result []string) {
+	result, _ = config.orderGroupNames()
 	return
 }
 
@@ -397,9 +595,124 @@ func (config *UpgradeConfig) GetGroupNodes(groupName string) (result []string) {
 	return
 }
 
-// GetGroupSoftware gets the software belonging to the specified group
+// GetGroupSoftware gets the software belonging to the specified group, in the order they're upgraded in
 func (config *UpgradeConfig) GetGroupSoftware(groupName string) (result []string) {
-	result = config.Common.SoftwareGroup[groupName]
+	result, _ = config.orderGroupSoftware(groupName)
+	return
+}
+
+// GetGroupMaxParallel returns the number of nodes in the group that can be processed at the same time.
+// If max_parallel isn't specified for the group, defaultMaxParallel is returned.
+func (config *UpgradeConfig) GetGroupMaxParallel(groupName string, defaultMaxParallel int) (result int) {
+	result = config.Common.GroupSettings[groupName].MaxParallel
+	if result <= 0 {
+		result = defaultMaxParallel
+	}
+	if result <= 0 {
+		result = 1
+	}
+	return
+}
+
+// GetGroupMaxUnavailable returns the number of nodes in the group that can be unavailable at the same time,
+// either being upgraded, or failed. 0 is returned if max_unavailable isn't specified for the group.
+func (config *UpgradeConfig) GetGroupMaxUnavailable(groupName string) int {
+	return config.Common.GroupSettings[groupName].MaxUnavailable.Resolve(len(config.GetGroupNodes(groupName)))
+}
+
+// GetGroupCanaries splits the nodes of the group into the canary nodes, which are upgraded first,
+// and the remaining nodes. The canaries are the nodes listed in canary_nodes, or if it isn't
+// specified, the first canary_count nodes of the group. Both lists keep the order of the group.
+func (config *UpgradeConfig) GetGroupCanaries(groupName string) (canaries, remaining []string) {
+	groupSettings := config.Common.GroupSettings[groupName]
+	isCanary := make(map[string]bool)
+	for _, node := range groupSettings.CanaryNodes {
+		isCanary[node] = true
+	}
+	for i, node := range config.GetGroupNodes(groupName) {
+		if isCanary[node] || len(groupSettings.CanaryNodes) == 0 && i < groupSettings.CanaryCount {
+			canaries = append(canaries, node)
+		} else {
+			remaining = append(remaining, node)
+		}
+	}
+	return
+}
+
+// GetOnFailure returns what's done when the upgrade of the software, or its health checks, fail.
+// The on_failure of the software takes precedence over the common on_failure, which defaults to continue.
+func (config *UpgradeConfig) GetOnFailure(software string) (result string) {
+	result = config.Software[software].OnFailure
+	if result == "" {
+		result = config.Common.OnFailure
+	}
+	if result == "" {
+		result = CFailureContinue
+	}
+	result = strings.ToLower(result)
+	return
+}
+
+// GetKeepBackups returns the number of backups of each file of the software kept by prune-backups,
+// or 0, if it's not specified
+func (config *UpgradeConfig) GetKeepBackups(software string) (result int) {
+	result = config.Software[software].KeepBackups
+	if result <= 0 {
+		result = config.Common.KeepBackups
+	}
+	if result < 0 {
+		result = 0
+	}
+	return
+}
+
+// GetLockSettings returns the lock file created on each node while it's upgraded, and
+// the age after which the lock is considered abandoned by the session holding it
+func (config *UpgradeConfig) GetLockSettings() (lockFile string, staleAfter time.Duration) {
+	lockFile, staleAfter = config.Common.LockFile, config.Common.LockStaleAfter.Duration
+	if lockFile == "" {
+		lockFile = CDefaultRemoteLockFile
+	}
+	if staleAfter <= 0 {
+		staleAfter = CDefaultLockStaleAfter
+	}
+	return
+}
+
+// VerifySettings verifies that the settings that take one of a set of values are valid.
+// If this is true, error is nil.
+func (config *UpgradeConfig) VerifySettings() (err error) {
+	var msg string
+	verifyOnFailure := func(where, onFailure string) {
+		switch strings.ToLower(onFailure) {
+		case "", CFailureRollback, CFailureHalt, CFailureContinue:
+		default:
+			{
+				msg = fmt.Sprintf("%sInvalid on_failure in %s: %s\n", msg, where, onFailure)
+			}
+		}
+	}
+	verifyOnFailure("common", config.Common.OnFailure)
+	for softwareName, softwareInfo := range config.Software {
+		verifyOnFailure(softwareName, softwareInfo.OnFailure)
+	}
+	for node, nodeInfo := range config.Nodes {
+		verifyOnFailure(node, nodeInfo.OnFailure)
+	}
+	for groupName, groupSettings := range config.Common.GroupSettings {
+		groupNodes := make(map[string]bool)
+		for _, node := range config.GetGroupNodes(groupName) {
+			groupNodes[node] = true
+		}
+		for _, node := range groupSettings.CanaryNodes {
+			if !groupNodes[node] {
+				msg = fmt.Sprintf("%sCanary node %s is not in group: %s\n", msg, node, groupName)
+			}
+		}
+	}
+	if msg != "" {
+		err = errors.New(strings.TrimSuffix(msg, "\n"))
+	}
 	return
 }
 
@@ -416,19 +729,12 @@ func (config *UpgradeConfig) GetNodeCount() (result int) {
 func (config *UpgradeConfig) VerifyFilesExist() (err error) {
 	var msg string
 
-	// build a cache for SourceFile sum
-	if sourceFilesVerificationInfo == nil {
-		sourceFilesVerificationInfo = make(map[string]string)
-	}
-
 	for softwareKey, softwareInfo := range config.Software {
 		for _, fileInfo := range softwareInfo.Copy {
 			if !FileExists(fileInfo.SourceFilePath) {
 				msg = fmt.Sprintf("%sFile does not exist in %s: %v\n", msg, softwareKey, fileInfo.SourceFilePath)
-			} else {
-				fileInfo := sourceFilesVerificationInfo[fileInfo.SourceFilePath]
-				if fileInfo == "" {
-				}
+			} else if _, err := getSourceFileHash(fileInfo.SourceFilePath); err != nil { // build a cache for SourceFile sum
+				msg = fmt.Sprintf("%sUnable to hash %s in %s: %v\n", msg, fileInfo.SourceFilePath, softwareKey, err)
 			}
 		}
 	}
@@ -448,6 +754,70 @@ func (config *UpgradeConfig) GetNodes() (result []string) {
 	return
 }
 
+// GetNodeSSHInfo gets the SSH settings for a particular node. Settings specified for
+// the node take precedence over the common settings.
+func (config *UpgradeConfig) GetNodeSSHInfo(node string) (result SSHInfo) {
+	nodeInfo := config.Nodes[node]
+	if nodeInfo.SSHUserName != "" {
+		result.SSHUserName = nodeInfo.SSHUserName
+	} else {
+		result.SSHUserName = config.Common.SSHUserName
+	}
+	if nodeInfo.SSHCert != "" {
+		result.SSHCert = nodeInfo.SSHCert
+	} else {
+		result.SSHCert = config.Common.SSHCert
+	}
+	if nodeInfo.SSHKnownHosts != "" {
+		result.SSHKnownHosts = nodeInfo.SSHKnownHosts
+	} else {
+		result.SSHKnownHosts = config.Common.SSHKnownHosts
+	}
+	if nodeInfo.SSHHostKeyCheck != "" {
+		result.SSHHostKeyCheck = nodeInfo.SSHHostKeyCheck
+	} else {
+		result.SSHHostKeyCheck = config.Common.SSHHostKeyCheck
+	}
+	if len(nodeInfo.SSHHostKeyFingerprints) > 0 {
+		result.SSHHostKeyFingerprints = nodeInfo.SSHHostKeyFingerprints
+	} else {
+		result.SSHHostKeyFingerprints = config.Common.SSHHostKeyFingerprints
+	}
+	if len(nodeInfo.SSHKeys) > 0 {
+		result.SSHKeys = nodeInfo.SSHKeys
+	} else {
+		result.SSHKeys = config.Common.SSHKeys
+	}
+	if nodeInfo.SSHPassphraseFile != "" {
+		result.SSHPassphraseFile = nodeInfo.SSHPassphraseFile
+	} else {
+		result.SSHPassphraseFile = config.Common.SSHPassphraseFile
+	}
+	result.SSHDisableAgent = nodeInfo.SSHDisableAgent || config.Common.SSHDisableAgent
+	if len(nodeInfo.ProxyJump) > 0 {
+		result.ProxyJump = nodeInfo.ProxyJump
+	} else {
+		result.ProxyJump = config.Common.ProxyJump
+	}
+	if nodeInfo.SSHPort != 0 {
+		result.SSHPort = nodeInfo.SSHPort
+	} else {
+		result.SSHPort = config.Common.SSHPort
+	}
+	if nodeInfo.TransferProtocol != "" {
+		result.TransferProtocol = nodeInfo.TransferProtocol
+	} else {
+		result.TransferProtocol = config.Common.TransferProtocol
+	}
+	result.ResumableTransfer = nodeInfo.ResumableTransfer || config.Common.ResumableTransfer
+	if nodeInfo.TransferChunkSize != 0 {
+		result.TransferChunkSize = nodeInfo.TransferChunkSize
+	} else {
+		result.TransferChunkSize = config.Common.TransferChunkSize
+	}
+	return
+}
+
 // GetNodeUpgradeInfo gets the specific upgrade information for a particular node's software.
 func (config *UpgradeConfig) GetNodeUpgradeInfo(node, software string) (result *NodeInfoContainer) {
 	result = &NodeInfoContainer{}
@@ -472,16 +842,22 @@ func (config *UpgradeConfig) GetNodeUpgradeInfo(node, software string) (result *
 	} else {
 		result.StopCmd = config.Software[software].StopCmd
 	}
-	if nodeInfo.SSHUserName != "" {
-		result.SSHUserName = nodeInfo.SSHUserName
+	if len(nodeInfo.HealthChecks) > 0 {
+		result.HealthChecks = nodeInfo.HealthChecks
 	} else {
-		result.SSHUserName = config.Common.SSHUserName
+		result.HealthChecks = config.Software[software].HealthChecks
 	}
-	if nodeInfo.SSHCert != "" {
-		result.SSHCert = nodeInfo.SSHCert
+	if nodeInfo.OnFailure != "" {
+		result.OnFailure = strings.ToLower(nodeInfo.OnFailure)
 	} else {
-		result.SSHCert = config.Common.SSHCert
+		result.OnFailure = config.GetOnFailure(software)
 	}
+	if nodeInfo.KeepBackups > 0 {
+		result.KeepBackups = nodeInfo.KeepBackups
+	} else {
+		result.KeepBackups = config.GetKeepBackups(software)
+	}
+	result.SSHInfo = config.GetNodeSSHInfo(node)
 	if len(nodeInfo.Copy) > 0 {
 		result.Copy = nodeInfo.Copy
 		result.Exec = nodeInfo.Exec
@@ -491,14 +867,20 @@ func (config *UpgradeConfig) GetNodeUpgradeInfo(node, software string) (result *
 	}
 
 	// assign backup strategy as copy if it is not speficied.
-	// also assign transfer verification
-	for k := range result.Copy {
-		if result.Copy[k].BackupStrategy == "" {
-			temp := result.Copy[k]
-			temp.BackupStrategy = "copy"
-			temp.VerifyCopy = "sha256"
-			result.Copy[k] = temp
+	// also assign transfer verification, as staged files are always verified.
+	// Copy is shared with the configuration, so the defaults are assigned to a copy of it.
+	copyInfo := make(map[string]UpgradeStruct, len(result.Copy))
+	for k, temp := range result.Copy {
+		if temp.BackupStrategy == "" {
+			temp.BackupStrategy = CBackupCopy
+		}
+		if temp.VerifyCopy == "" {
+			temp.VerifyCopy = CVerifySHA256
 		}
+		copyInfo[k] = temp
+	}
+	if result.Copy != nil {
+		result.Copy = copyInfo
 	}
 
 	if (len(result.Copy) == 0) || (len(result.PreUpgrade) == 0) || (len(result.PostUpgrade) == 0) ||
@@ -517,16 +899,22 @@ func NewFailedUpgradeInfo() *FailedUpgradeInfo {
 
 // Clear clears the mapping
 func (failedUpgradeInfo *FailedUpgradeInfo) Clear() {
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	failedUpgradeInfo.FailedNodeSoftware = nil
 }
 
 // GetNodeSoftwareCount gets the number of failed upgrades for a particular node
 func (failedUpgradeInfo *FailedUpgradeInfo) GetNodeSoftwareCount(node string) int {
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	return len(failedUpgradeInfo.FailedNodeSoftware[node])
 }
 
 // GetCount returns the total number of values currently available
 func (failedUpgradeInfo *FailedUpgradeInfo) GetCount() (totalCount int) {
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	for k := range failedUpgradeInfo.FailedNodeSoftware {
 		totalCount += len(failedUpgradeInfo.FailedNodeSoftware[k])
 	}
@@ -538,10 +926,15 @@ func (failedUpgradeInfo *FailedUpgradeInfo) AddNodeSoftware(node, software strin
 	if failedUpgradeInfo == nil {
 		panic("Iniatialize failedUpgradeInfo first!")
 	}
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	// Do not allow duplicates
-	if failedUpgradeInfo.ExistsNodeSoftware(node, software) {
+	if failedUpgradeInfo.existsNodeSoftware(node, software) {
 		return
 	}
+	if failedUpgradeInfo.FailedNodeSoftware == nil {
+		failedUpgradeInfo.FailedNodeSoftware = make(map[string][]string)
+	}
 	softwares := failedUpgradeInfo.FailedNodeSoftware[node]
 	softwares = append(softwares, software)
 	failedUpgradeInfo.FailedNodeSoftware[node] = softwares
@@ -549,13 +942,24 @@ func (failedUpgradeInfo *FailedUpgradeInfo) AddNodeSoftware(node, software strin
 
 // Empty returns true if failedUpgradeInfo's FailedNodeSoftware does not have any keys
 func (failedUpgradeInfo *FailedUpgradeInfo) Empty() (empty bool) {
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	empty = len(failedUpgradeInfo.FailedNodeSoftware) == 0
 	return
 }
 
 // ExistsNodeSoftware returns true if a particular software for a nade exists in the failed upgrade info
 func (failedUpgradeInfo *FailedUpgradeInfo) ExistsNodeSoftware(node, software string) (result bool) {
-	if failedUpgradeInfo == nil || failedUpgradeInfo.FailedNodeSoftware == nil {
+	if failedUpgradeInfo == nil {
+		return false
+	}
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
+	return failedUpgradeInfo.existsNodeSoftware(node, software)
+}
+
+func (failedUpgradeInfo *FailedUpgradeInfo) existsNodeSoftware(node, software string) (result bool) {
+	if failedUpgradeInfo.FailedNodeSoftware == nil {
 		return false
 	}
 	softwares := failedUpgradeInfo.FailedNodeSoftware[node]
@@ -569,6 +973,8 @@ func (failedUpgradeInfo *FailedUpgradeInfo) ExistsNodeSoftware(node, software st
 
 // RemoveNodeSoftware removes a software from a node
 func (failedUpgradeInfo *FailedUpgradeInfo) RemoveNodeSoftware(node, software string) {
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
 	softwares := failedUpgradeInfo.FailedNodeSoftware[node]
 	for i, v := range softwares {
 		if v == software {
@@ -587,7 +993,9 @@ func (failedUpgradeInfo *FailedUpgradeInfo) RemoveNodeSoftware(node, software st
 
 // FindNode returns the software for a node
 func (failedUpgradeInfo *FailedUpgradeInfo) FindNode(node string) []string {
-	return failedUpgradeInfo.FailedNodeSoftware[node]
+	failedUpgradeInfo.mutex.Lock()
+	defer failedUpgradeInfo.mutex.Unlock()
+	return append([]string(nil), failedUpgradeInfo.FailedNodeSoftware[node]...)
 }
 
 // NewRollbackSession creates a new RollbackSession
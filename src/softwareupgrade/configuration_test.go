@@ -1,6 +1,10 @@
 package softwareupgrade
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -87,3 +91,185 @@ func TestFailedUpgradeInfo_GetCount(t *testing.T) {
 		t.Fatalf("%s %d", CGetCountShouldReturn, 2)
 	}
 }
+
+func TestUpgradeConfig_GetNodeSSHInfo(t *testing.T) {
+	var config UpgradeConfig
+	err := json.Unmarshal([]byte(`{
+		"common": {
+			"ssh_cert": "~/.ssh/quorum",
+			"ssh_username": "ubuntu",
+			"proxy_jump": [{"host": "bastion1"}]
+		},
+		"nodes": {
+			"node2": {
+				"ssh_username": "admin",
+				"proxy_jump": [{"host": "bastion2", "ssh_username": "jump"}, {"host": "bastion3"}]
+			}
+		}
+	}`), &config)
+	if err != nil {
+		t.Fatalf("Unable to parse configuration: %v", err)
+	}
+
+	sshInfo := config.GetNodeSSHInfo("node1")
+	if sshInfo.SSHUserName != "ubuntu" || len(sshInfo.ProxyJump) != 1 || sshInfo.ProxyJump[0].Host != "bastion1" {
+		t.Fatalf("node1 should use the common SSH settings, but got: %+v", sshInfo)
+	}
+
+	sshInfo = config.GetNodeSSHInfo("node2")
+	if sshInfo.SSHUserName != "admin" || sshInfo.SSHCert != "~/.ssh/quorum" {
+		t.Fatalf("node2 should override only the username, but got: %+v", sshInfo)
+	}
+	if len(sshInfo.ProxyJump) != 2 || sshInfo.ProxyJump[0].SSHUserName != "jump" || sshInfo.ProxyJump[1].Host != "bastion3" {
+		t.Fatalf("node2 should use its own proxy_jump chain, but got: %+v", sshInfo.ProxyJump)
+	}
+}
+
+func TestNodeInfoContainer_NewSSHConfig_JumpHost(t *testing.T) {
+	EnsureSSHConfigCache()
+	defer ClearSSHConfigCache()
+	nodeInfo := NodeInfoContainer{}
+	nodeInfo.SSHUserName = "ubuntu"
+	nodeInfo.SSHHostKeyCheck = CHostKeyCheckTOFU
+	nodeInfo.ProxyJump = []JumpHost{{Host: "bastion1"}}
+
+	// the nodes behind the bastion are configured in parallel, sharing the bastion's SSHConfig
+	nodes := []string{"node1", "node2", "node3", "node4", "node5", "node6", "node7", "node8"}
+	jumpHosts := make(chan *SSHConfig, len(nodes))
+	ForEachParallel(nodes, len(nodes), func(node string) {
+		jumpHosts <- nodeInfo.NewSSHConfig(node).jumpHost
+	})
+	close(jumpHosts)
+	jumpHost := <-jumpHosts
+	for other := range jumpHosts {
+		if other != jumpHost {
+			t.Fatal("Expected the nodes to share the SSHConfig of the bastion")
+		}
+	}
+	if jumpHost.hostKeyCheck != CHostKeyCheckTOFU {
+		t.Fatalf("Expected the bastion to be configured, got host key check: %s", jumpHost.hostKeyCheck)
+	}
+
+	// a node with different settings doesn't reconfigure the bastion others connect through
+	otherInfo := nodeInfo
+	otherInfo.SSHHostKeyCheck = CHostKeyCheckOff
+	if otherInfo.NewSSHConfig("node9").jumpHost != jumpHost || jumpHost.hostKeyCheck != CHostKeyCheckTOFU {
+		t.Fatalf("Expected the bastion to keep its settings, got host key check: %s", jumpHost.hostKeyCheck)
+	}
+}
+
+func TestGetSourceFileHash(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp file")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	// sha256sum of "hello"
+	const expected = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if hash, err := getSourceFileHash(file.Name()); err != nil || hash != expected {
+		t.Fatalf("Expected hash: %s, got: %s, %v", expected, hash, err)
+	}
+	// The hash is cached, so it's not affected by changes made afterwards
+	SaveDataToFile(file.Name(), []byte("changed"))
+	if hash, _ := getSourceFileHash(file.Name()); hash != expected {
+		t.Fatalf("Expected cached hash: %s, got: %s", expected, hash)
+	}
+	if _, err := getSourceFileHash(file.Name() + ".missing"); err == nil {
+		t.Fatal("Hashing a missing file should fail")
+	}
+}
+
+func TestUpgradeConfig_GetGroupMaxParallel(t *testing.T) {
+	var config UpgradeConfig
+	data := []byte(`{"common": {"group_settings": {"group1": {"max_parallel": 4}}}}`)
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	if result := config.GetGroupMaxParallel("group1", 2); result != 4 {
+		t.Fatalf("Expected max_parallel of group1: 4, got: %d", result)
+	}
+	if result := config.GetGroupMaxParallel("group2", 2); result != 2 {
+		t.Fatalf("Expected the default of 2 for group2, got: %d", result)
+	}
+	if result := config.GetGroupMaxParallel("group2", 0); result != 1 {
+		t.Fatalf("Expected at least 1 node at a time, got: %d", result)
+	}
+}
+
+func TestUpgradeConfig_GetOnFailure(t *testing.T) {
+	var config UpgradeConfig
+	data := []byte(`{
+		"common": {"on_failure": "halt"},
+		"software": {"quorum": {"on_failure": "Rollback"}, "vault": {}},
+		"nodes": {"node2": {"on_failure": "continue"}}
+	}`)
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	if err := config.VerifySettings(); err != nil {
+		t.Fatalf("VerifySettings failed: %v", err)
+	}
+	if result := config.GetNodeUpgradeInfo("node1", "quorum").OnFailure; result != CFailureRollback {
+		t.Fatalf("Expected on_failure of quorum: %s, got: %s", CFailureRollback, result)
+	}
+	if result := config.GetNodeUpgradeInfo("node1", "vault").OnFailure; result != CFailureHalt {
+		t.Fatalf("Expected the common on_failure: %s, got: %s", CFailureHalt, result)
+	}
+	if result := config.GetNodeUpgradeInfo("node2", "quorum").OnFailure; result != CFailureContinue {
+		t.Fatalf("Expected on_failure of node2: %s, got: %s", CFailureContinue, result)
+	}
+	config.Common.OnFailure = ""
+	if result := config.GetOnFailure("vault"); result != CFailureContinue {
+		t.Fatalf("Expected on_failure to default to: %s, got: %s", CFailureContinue, result)
+	}
+	config.Common.OnFailure = "retry"
+	if err := config.VerifySettings(); err == nil {
+		t.Fatal("VerifySettings should reject an invalid on_failure")
+	}
+}
+
+func TestUpgradeConfig_GetGroupCanaries(t *testing.T) {
+	var config UpgradeConfig
+	data := []byte(`{
+		"common": {"group_settings": {
+			"group1": {"canary_nodes": ["node3", "node1"], "canary_soak": "10m"},
+			"group2": {"canary_count": 2}
+		}},
+		"groupnodes": {
+			"group1": ["node1", "node2", "node3", "node4"],
+			"group2": ["node5", "node6", "node7"],
+			"group3": ["node8"]
+		}
+	}`)
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	if err := config.VerifySettings(); err != nil {
+		t.Fatalf("VerifySettings failed: %v", err)
+	}
+	tests := []struct {
+		group     string
+		canaries  []string
+		remaining []string
+	}{
+		{"group1", []string{"node1", "node3"}, []string{"node2", "node4"}},
+		{"group2", []string{"node5", "node6"}, []string{"node7"}},
+		{"group3", nil, []string{"node8"}},
+	}
+	for _, test := range tests {
+		canaries, remaining := config.GetGroupCanaries(test.group)
+		if !reflect.DeepEqual(canaries, test.canaries) || !reflect.DeepEqual(remaining, test.remaining) {
+			t.Fatalf("%s: expected canaries: %v, remaining: %v, got: %v, %v", test.group, test.canaries, test.remaining, canaries, remaining)
+		}
+	}
+
+	settings := config.Common.GroupSettings["group2"]
+	settings.CanaryNodes = []string{"node1"}
+	config.Common.GroupSettings["group2"] = settings
+	if err := config.VerifySettings(); err == nil {
+		t.Fatal("VerifySettings should reject a canary node that isn't in the group")
+	}
+}
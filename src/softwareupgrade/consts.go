@@ -1,5 +1,7 @@
 package softwareupgrade
 
+import "time"
+
 // exported constants
 const (
 	CGeth   string = "geth"
@@ -16,4 +18,51 @@ const (
 
 	CEximchainUpgradeTitle string = "Eximchain Blockchain Software Upgrade v0.4"
 	CGetCountShouldReturn  string = "GetCount() should return"
+
+	CHostKeyCheckStrict string = "strict"
+	CHostKeyCheckTOFU   string = "tofu"
+	CHostKeyCheckOff    string = "off"
+	CDefaultKnownHosts  string = "~/.ssh/known_hosts"
+	CDefaultSSHPort     int    = 22
+
+	CTransferSCP  string = "scp"
+	CTransferSFTP string = "sftp"
+
+	CDefaultChunkSize int64 = 4 * 1024 * 1024
+
+	CBackupCopy   string = "copy"
+	CBackupMove   string = "move"
+	CVerifyMD5    string = "md5"
+	CVerifySHA256 string = "sha256"
+
+	CHealthCheckCommand         string        = "command"
+	CHealthCheckTCP             string        = "tcp"
+	CHealthCheckHTTP            string        = "http"
+	CHealthCheckProcess         string        = "process"
+	CHealthCheckGeth            string        = "geth"
+	CDefaultHealthCheckTimeout  time.Duration = 10 * time.Second
+	CDefaultHealthCheckInterval time.Duration = 5 * time.Second
+	CDefaultBlockWait           time.Duration = 5 * time.Second
+	CDefaultRPCURL              string        = "http://127.0.0.1:8545"
+	CTimeoutExitStatus          int           = 124 // the exit status of a command stopped by timeout
+
+	CFailureRollback string = "rollback"
+	CFailureHalt     string = "halt"
+	CFailureContinue string = "continue"
+
+	CDefaultCanaryCheckInterval time.Duration = 30 * time.Second
+
+	CDefaultRemoteLockFile string        = "/var/lock/eximchain-upgrade.lock"
+	CDefaultLockStaleAfter time.Duration = time.Hour
+
+	CStepStopped       string = "stopped"
+	CStepCopied        string = "copied"
+	CStepVerified      string = "verified"
+	CStepBackedUp      string = "backed-up"
+	CStepReplaced      string = "replaced"
+	CStepUpgraded      string = "upgraded"
+	CStepStarted       string = "started"
+	CStepHealthChecked string = "health-checked"
+	CStepCompleted     string = "completed"
+	CStepRolledBack    string = "rolled-back"
 )
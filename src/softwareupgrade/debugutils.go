@@ -14,6 +14,7 @@ type (
 	TDebugLog struct {
 		printDebug   bool
 		printConsole bool
+		console      io.Writer // where the console output goes, stdout if nil
 		file         *os.File
 	}
 )
@@ -55,6 +56,13 @@ func (d *TDebugLog) EnablePrintConsole() {
 	}
 }
 
+// SetConsole changes where the console output goes, eg, to stderr, so that stdout only contains the output of a command
+func (d *TDebugLog) SetConsole(w io.Writer) {
+	if d != nil {
+		d.console = w
+	}
+}
+
 // EnableDebug sets the printDebug flag
 func (d *TDebugLog) EnableDebug() {
 	if d != nil {
@@ -73,7 +81,11 @@ func (d *TDebugLog) GetFilename() (result string) {
 // Print decides whether the debug log is sent to the console, or not, and also logs it to the debug log
 func (d *TDebugLog) Print(format string, args ...interface{}) {
 	if d != nil && d.printConsole {
-		fmt.Printf(format, args...)
+		if d.console != nil {
+			fmt.Fprintf(d.console, format, args...)
+		} else {
+			fmt.Printf(format, args...)
+		}
 	}
 	log.Printf(format, args...)
 }
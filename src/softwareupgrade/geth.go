@@ -0,0 +1,227 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// gethStatus contains the liveness information reported by geth
+	gethStatus struct {
+		BlockNumber  uint64
+		PeerCount    uint64
+		Syncing      bool
+		CurrentBlock uint64 // only when syncing
+		HighestBlock uint64 // only when syncing
+	}
+
+	rpcResponse struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+const (
+	rpcBlockNumber = iota + 1 // JSON-RPC request ids
+	rpcPeerCount
+	rpcSyncing
+)
+
+// gethIPCQuery is run by geth attach, and prints the same information as the JSON-RPC requests
+const gethIPCQuery = `JSON.stringify({blockNumber: eth.blockNumber, peerCount: net.peerCount, syncing: eth.syncing})`
+
+// probeGeth passes if the peer count meets min_peers, and the block height moves forward
+// within block_wait. While geth is syncing, the height is the current block of the sync.
+func (check *HealthCheck) probeGeth(runner Runner, timeoutSeconds int) error {
+	first, err := check.queryGeth(runner, timeoutSeconds)
+	if err != nil {
+		return err
+	}
+	if first.PeerCount < uint64(check.MinPeers) {
+		return fmt.Errorf("peer count: %d is below the minimum: %d", first.PeerCount, check.MinPeers)
+	}
+	time.Sleep(check.getBlockWait())
+	second, err := check.queryGeth(runner, timeoutSeconds)
+	if err != nil {
+		return err
+	}
+	if second.PeerCount < uint64(check.MinPeers) {
+		return fmt.Errorf("peer count: %d is below the minimum: %d", second.PeerCount, check.MinPeers)
+	}
+	if second.height() <= first.height() {
+		return fmt.Errorf("block height: %d didn't move forward within %s", second.height(), check.getBlockWait())
+	}
+	DebugLog.Debugln("geth block height: %d -> %d, peers: %d, syncing: %v", first.height(), second.height(), second.PeerCount, second.Syncing)
+	return nil
+}
+
+// queryGeth gets the block number, peer count and sync status, either over IPC, using geth attach,
+// or with a JSON-RPC batch request to the RPC port, using curl. Both are run on the node.
+func (check *HealthCheck) queryGeth(runner Runner, timeoutSeconds int) (result gethStatus, err error) {
+	if check.IPC != "" {
+		gethBinary := check.GethBinary
+		if gethBinary == "" {
+			gethBinary = CGeth
+		}
+		cmd := fmt.Sprintf("timeout %d %s attach --exec %s %s", timeoutSeconds, gethBinary,
+			ShellQuote(gethIPCQuery), ShellQuote("ipc:"+check.IPC))
+		output, err := runner.Run(cmd)
+		if err != nil {
+			return result, fmt.Errorf("unable to attach to %s: %v %s", check.IPC, err, strings.TrimSpace(output))
+		}
+		return parseGethIPCOutput(output)
+	}
+
+	request := fmt.Sprintf(`[{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":%d},`+
+		`{"jsonrpc":"2.0","method":"net_peerCount","params":[],"id":%d},`+
+		`{"jsonrpc":"2.0","method":"eth_syncing","params":[],"id":%d}]`, rpcBlockNumber, rpcPeerCount, rpcSyncing)
+	cmd := fmt.Sprintf("curl -s --max-time %d -H 'Content-Type: application/json' --data %s %s",
+		timeoutSeconds, ShellQuote(request), ShellQuote(check.getRPCURL()))
+	output, err := runner.Run(cmd)
+	if err != nil {
+		return result, fmt.Errorf("unable to query %s: %v", check.getRPCURL(), err)
+	}
+	return parseGethRPCOutput(output)
+}
+
+// GetGethPeers returns the output of admin.peers, run by geth attach on the node, attached to the given
+// IPC socket, or if it's empty, to the default IPC socket of the SSH user.
+func GetGethPeers(runner Runner, gethBinary, ipc string, timeoutSeconds int) (output string, err error) {
+	if gethBinary == "" {
+		gethBinary = CGeth
+	}
+	if timeoutSeconds < 1 {
+		timeoutSeconds = 1 // a timeout of 0 disables the timeout
+	}
+	cmd := fmt.Sprintf("timeout %d %s attach --exec admin.peers", timeoutSeconds, gethBinary)
+	if ipc != "" {
+		cmd = fmt.Sprintf("%s %s", cmd, ShellQuote("ipc:"+ipc))
+	}
+	if output, err = runner.Run(cmd); err != nil {
+		return output, fmt.Errorf("unable to get the peers of geth: %v %s", err, strings.TrimSpace(output))
+	}
+	return
+}
+
+func parseGethRPCOutput(output string) (result gethStatus, err error) {
+	var responses []rpcResponse
+	if err = json.Unmarshal([]byte(output), &responses); err != nil {
+		return result, fmt.Errorf("invalid JSON-RPC response: %q", strings.TrimSpace(output))
+	}
+	found := make(map[int]bool)
+	for _, response := range responses {
+		if response.Error != nil {
+			return result, fmt.Errorf("JSON-RPC error: %s", response.Error.Message)
+		}
+		found[response.ID] = true
+		switch response.ID {
+		case rpcBlockNumber:
+			{
+				result.BlockNumber, err = parseHexQuantity(response.Result)
+			}
+		case rpcPeerCount:
+			{
+				result.PeerCount, err = parseHexQuantity(response.Result)
+			}
+		case rpcSyncing:
+			{
+				err = result.parseSyncing(response.Result, parseHexQuantity)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !found[rpcBlockNumber] || !found[rpcPeerCount] || !found[rpcSyncing] {
+		err = fmt.Errorf("incomplete JSON-RPC response: %q", strings.TrimSpace(output))
+	}
+	return
+}
+
+func parseGethIPCOutput(output string) (result gethStatus, err error) {
+	// the console prints the string returned by JSON.stringify as a quoted string
+	output = strings.TrimSpace(output)
+	if strings.HasPrefix(output, `"`) {
+		if err = json.Unmarshal([]byte(output), &output); err != nil {
+			return result, fmt.Errorf("invalid geth attach output: %q", output)
+		}
+	}
+	var status struct {
+		BlockNumber uint64          `json:"blockNumber"`
+		PeerCount   uint64          `json:"peerCount"`
+		Syncing     json.RawMessage `json:"syncing"`
+	}
+	if err = json.Unmarshal([]byte(output), &status); err != nil {
+		return result, fmt.Errorf("invalid geth attach output: %q", output)
+	}
+	result.BlockNumber = status.BlockNumber
+	result.PeerCount = status.PeerCount
+	err = result.parseSyncing(status.Syncing, parseNumber)
+	return
+}
+
+// parseSyncing parses the result of eth_syncing, which is either false, or the sync progress
+func (status *gethStatus) parseSyncing(data json.RawMessage, parse func(json.RawMessage) (uint64, error)) (err error) {
+	if string(data) == "false" {
+		return nil
+	}
+	var progress struct {
+		CurrentBlock json.RawMessage `json:"currentBlock"`
+		HighestBlock json.RawMessage `json:"highestBlock"`
+	}
+	if err = json.Unmarshal(data, &progress); err != nil {
+		return fmt.Errorf("invalid syncing status: %s", string(data))
+	}
+	status.Syncing = true
+	if status.CurrentBlock, err = parse(progress.CurrentBlock); err != nil {
+		return
+	}
+	status.HighestBlock, err = parse(progress.HighestBlock)
+	return
+}
+
+// height returns the block the node is at, which is the current block of the sync, while syncing
+func (status *gethStatus) height() uint64 {
+	if status.Syncing {
+		return status.CurrentBlock
+	}
+	return status.BlockNumber
+}
+
+// parseHexQuantity parses a JSON-RPC quantity, eg, "0x1b4"
+func parseHexQuantity(data json.RawMessage) (result uint64, err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil || !strings.HasPrefix(s, "0x") {
+		return 0, fmt.Errorf("invalid quantity: %s", string(data))
+	}
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+// parseNumber parses a number printed by the geth console
+func parseNumber(data json.RawMessage) (result uint64, err error) {
+	if len(data) == 0 {
+		return 0, errors.New("missing number")
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+func (check *HealthCheck) getRPCURL() string {
+	if check.RPCURL == "" {
+		return CDefaultRPCURL
+	}
+	return check.RPCURL
+}
+
+func (check *HealthCheck) getBlockWait() time.Duration {
+	if check.BlockWait.Duration <= 0 {
+		return CDefaultBlockWait
+	}
+	return check.BlockWait.Duration
+}
@@ -0,0 +1,157 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// localRunner runs commands on the local host, in place of a node
+	localRunner struct{}
+
+	// fakeRPC is a JSON-RPC endpoint that reports a block height that moves forward
+	// by blockStep for every request
+	fakeRPC struct {
+		mutex     sync.Mutex
+		block     uint64
+		blockStep uint64
+		peers     uint64
+		syncing   bool
+	}
+)
+
+func (runner *localRunner) Run(cmd string) (string, error) {
+	output, err := exec.Command("sh", "-c", cmd).Output()
+	return string(output), err
+}
+
+func (rpc *fakeRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var requests []struct {
+		ID     int    `json:"id"`
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &requests); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	rpc.mutex.Lock()
+	defer rpc.mutex.Unlock()
+	rpc.block += rpc.blockStep
+	var responses []string
+	for _, request := range requests {
+		var result string
+		switch request.Method {
+		case "eth_blockNumber":
+			result = fmt.Sprintf(`"0x%x"`, rpc.block)
+		case "net_peerCount":
+			result = fmt.Sprintf(`"0x%x"`, rpc.peers)
+		case "eth_syncing":
+			result = "false"
+			if rpc.syncing {
+				result = fmt.Sprintf(`{"startingBlock":"0x0","currentBlock":"0x%x","highestBlock":"0x%x"}`, rpc.block, rpc.block+1000)
+			}
+		}
+		responses = append(responses, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":%s}`, request.ID, result))
+	}
+	fmt.Fprintf(w, "[%s]", strings.Join(responses, ","))
+}
+
+func TestHealthCheck_Geth(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is required to query the fake RPC endpoint")
+	}
+	tests := []struct {
+		name      string
+		rpc       *fakeRPC
+		minPeers  int
+		expectErr string
+	}{
+		{"healthy", &fakeRPC{block: 100, blockStep: 1, peers: 3}, 2, ""},
+		{"syncing", &fakeRPC{block: 100, blockStep: 50, peers: 1, syncing: true}, 1, ""},
+		{"too few peers", &fakeRPC{block: 100, blockStep: 1, peers: 1}, 2, "peer count"},
+		{"stalled", &fakeRPC{block: 100, blockStep: 0, peers: 3}, 2, "didn't move forward"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(test.rpc)
+		check := HealthCheck{Type: CHealthCheckGeth, RPCURL: server.URL, MinPeers: test.minPeers,
+			BlockWait: Duration{10 * time.Millisecond}}
+		err := check.Run(&localRunner{})
+		server.Close()
+		if test.expectErr == "" && err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.expectErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+			t.Fatalf("%s: expected error containing %q, got: %v", test.name, test.expectErr, err)
+		}
+	}
+
+	check := HealthCheck{Type: CHealthCheckGeth, RPCURL: "http://127.0.0.1:1", Timeout: Duration{2 * time.Second}}
+	if err := check.Run(&localRunner{}); err == nil {
+		t.Fatal("The check should fail when the RPC endpoint isn't reachable")
+	}
+}
+
+func TestHealthCheck_GethIPC(t *testing.T) {
+	runner := &fakeRunner{
+		outputs: []string{
+			`"{\"blockNumber\":100,\"peerCount\":3,\"syncing\":false}"` + "\n",
+			`"{\"blockNumber\":101,\"peerCount\":3,\"syncing\":false}"` + "\n",
+		},
+		errs: []error{nil, nil},
+	}
+	check := HealthCheck{Type: CHealthCheckGeth, IPC: "/home/ubuntu/.ethereum/geth.ipc", MinPeers: 1,
+		BlockWait: Duration{time.Millisecond}}
+	if err := check.Run(runner); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(runner.commands[0], "geth attach") || !strings.Contains(runner.commands[0], "ipc:/home/ubuntu/.ethereum/geth.ipc") {
+		t.Fatalf("Expected geth attach to the IPC socket, got: %s", runner.commands[0])
+	}
+
+	status, err := parseGethIPCOutput(`"{\"blockNumber\":7,\"peerCount\":2,\"syncing\":{\"currentBlock\":5,\"highestBlock\":9}}"`)
+	if err != nil || !status.Syncing || status.height() != 5 || status.HighestBlock != 9 || status.PeerCount != 2 {
+		t.Fatalf("Unexpected status: %+v, %v", status, err)
+	}
+	if _, err := parseGethIPCOutput("Fatal: Unable to attach to remote geth"); err == nil {
+		t.Fatal("Invalid output should be rejected")
+	}
+}
+
+func TestGetGethPeers(t *testing.T) {
+	peers := `[{
+    network: {
+      localAddress: "10.0.9.238:33980",
+      remoteAddress: "54.197.13.5:21000"
+    }
+}]`
+	runner := &fakeRunner{outputs: []string{peers, "Fatal: Unable to attach to remote geth"}, errs: []error{nil, errors.New("exit status 1")}}
+	if output, err := GetGethPeers(runner, "", "", 10); err != nil || output != peers {
+		t.Fatalf("Unexpected output: %s, error: %v", output, err)
+	}
+	if runner.commands[0] != "timeout 10 geth attach --exec admin.peers" {
+		t.Fatalf("Expected geth attach to the default IPC socket, got: %s", runner.commands[0])
+	}
+	if _, err := GetGethPeers(runner, "/usr/local/bin/geth", "/home/ubuntu/.ethereum/geth.ipc", 10); err == nil ||
+		!strings.Contains(err.Error(), "Unable to attach") {
+		t.Fatalf("Expected the output of geth in the error, got: %v", err)
+	}
+	if runner.commands[1] != "timeout 10 /usr/local/bin/geth attach --exec admin.peers ipc:/home/ubuntu/.ethereum/geth.ipc" {
+		t.Fatalf("Expected geth attach to the IPC socket, got: %s", runner.commands[1])
+	}
+
+	// a timeout under 1s isn't truncated to 0, which would disable the timeout
+	GetGethPeers(runner, "", "", 0)
+	if runner.commands[2] != "timeout 1 geth attach --exec admin.peers" {
+		t.Fatalf("Expected a timeout of at least 1s, got: %s", runner.commands[2])
+	}
+}
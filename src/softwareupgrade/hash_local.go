@@ -2,8 +2,8 @@ package softwareupgrade
 
 import (
 	"crypto/md5"
+	"encoding/hex"
 	"io"
-	"log"
 	"os"
 )
 
@@ -34,12 +34,12 @@ func (hasher *LocalHostHasher) Sha256sum(path string) (result string, err error)
 func (hasher *LocalHostHasher) Md5sum(path string) (result string, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 	defer f.Close()
 
 	h := md5.New()
 	_, err = io.Copy(h, f)
-	result = string(h.Sum(nil))
+	result = hex.EncodeToString(h.Sum(nil)) // same format as md5sum
 	return
 }
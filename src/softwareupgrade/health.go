@@ -0,0 +1,236 @@
+package softwareupgrade
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Runner runs a command on a node, and returns its output. It's implemented by SSHConfig.
+	Runner interface {
+		Run(cmd string) (string, error)
+	}
+
+	// HealthCheck specifies a check that's run on a node after a software is started,
+	// to verify that the software is running correctly.
+	HealthCheck struct {
+		Name           string   `json:"name"`
+		Type           string   `json:"type"`            // command, tcp, http or process
+		Command        string   `json:"command"`         // command: the command to run
+		ExpectedOutput string   `json:"expected_output"` // command, http: text that the output must contain
+		Host           string   `json:"host"`            // tcp: the host to connect to from the node, defaults to 127.0.0.1
+		Port           int      `json:"port"`            // tcp: the port to connect to
+		URL            string   `json:"url"`             // http: the URL requested from the node
+		ExpectedStatus int      `json:"expected_status"` // http: the expected status code, defaults to 200
+		Process        string   `json:"process"`         // process: the name of the process that must be running
+		Timeout        Duration `json:"timeout"`         // the time allowed for each attempt, defaults to 10s
+		Retries        int      `json:"retries"`         // the number of times a failed check is retried
+		Interval       Duration `json:"interval"`        // the time between attempts, defaults to 5s
+		HaltOnFailure  bool     `json:"halt_on_failure"` // stops the rollout of all remaining nodes if the check fails
+
+		IPC        string   `json:"ipc"`         // geth: the IPC socket queried using geth attach, instead of rpc_url
+		RPCURL     string   `json:"rpc_url"`     // geth: the JSON-RPC URL queried from the node, defaults to http://127.0.0.1:8545
+		GethBinary string   `json:"geth_binary"` // geth: the geth used to attach to the IPC socket, defaults to geth
+		MinPeers   int      `json:"min_peers"`   // geth: the minimum number of peers
+		BlockWait  Duration `json:"block_wait"`  // geth: the time the block height must move forward within, defaults to 5s
+	}
+
+	// HealthCheckError is returned when a health check fails after all its attempts
+	HealthCheckError struct {
+		Check  string
+		Reason error
+		Halt   bool
+	}
+)
+
+// Error implements the error interface
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("health check %s failed: %v", e.Check, e.Reason)
+}
+
+// IsHaltingHealthCheckError returns true if the given error is due to a failed
+// health check that requires the rollout to be halted
+func IsHaltingHealthCheckError(err error) bool {
+	healthCheckErr, ok := err.(*HealthCheckError)
+	return ok && healthCheckErr.Halt
+}
+
+// RunHealthChecks runs the health checks of the software, in order, and returns
+// a HealthCheckError for the first check that fails.
+func (nodeInfo *NodeInfoContainer) RunHealthChecks(runner Runner) (err error) {
+	for _, check := range nodeInfo.HealthChecks {
+		if err = check.Run(runner); err != nil {
+			return &HealthCheckError{Check: check.String(), Reason: err, Halt: check.HaltOnFailure}
+		}
+		DebugLog.Println("Health check %s passed", check.String())
+	}
+	return nil
+}
+
+// String returns the name of the check, or a description of it, if it isn't named
+func (check *HealthCheck) String() string {
+	if check.Name != "" {
+		return check.Name
+	}
+	switch check.Type {
+	case CHealthCheckCommand:
+		{
+			return fmt.Sprintf("%s %q", check.Type, check.Command)
+		}
+	case CHealthCheckTCP:
+		{
+			return fmt.Sprintf("%s %s", check.Type, JoinHostPort(check.getHost(), check.Port))
+		}
+	case CHealthCheckHTTP:
+		{
+			return fmt.Sprintf("%s %s", check.Type, check.URL)
+		}
+	case CHealthCheckProcess:
+		{
+			return fmt.Sprintf("%s %s", check.Type, check.Process)
+		}
+	case CHealthCheckGeth:
+		{
+			if check.IPC != "" {
+				return fmt.Sprintf("%s %s", check.Type, check.IPC)
+			}
+			return fmt.Sprintf("%s %s", check.Type, check.getRPCURL())
+		}
+	}
+	return check.Type
+}
+
+// Run runs the check until it passes, or until it has failed Retries+1 times
+func (check *HealthCheck) Run(runner Runner) (err error) {
+	interval := check.Interval.Duration
+	if interval <= 0 {
+		interval = CDefaultHealthCheckInterval
+	}
+	for attempt := 0; attempt <= check.Retries; attempt++ {
+		if attempt > 0 {
+			DebugLog.Debugln("Health check %s failed: %v, retrying in %s", check.String(), err, interval)
+			time.Sleep(interval)
+		}
+		if err = check.probe(runner); err == nil {
+			return nil
+		}
+	}
+	return
+}
+
+// probe runs a single attempt of the check. The commands run on the node are limited to the timeout
+// of the check on the node itself, so that an attempt that times out doesn't leave a command running,
+// and the next attempt isn't run until the previous one has completed.
+func (check *HealthCheck) probe(runner Runner) error {
+	timeoutSeconds := int(check.getTimeout().Seconds())
+	if timeoutSeconds < 1 {
+		timeoutSeconds = 1
+	}
+	switch check.Type {
+	case CHealthCheckCommand:
+		{
+			if check.Command == "" {
+				return errors.New("no command specified")
+			}
+			cmd := fmt.Sprintf("timeout %d bash -c %s", timeoutSeconds, ShellQuote(check.Command))
+			output, err := runner.Run(cmd)
+			if isTimeoutExit(err) {
+				return fmt.Errorf("timed out after %ds", timeoutSeconds)
+			}
+			if err != nil {
+				return fmt.Errorf("%v %s", err, strings.TrimSpace(output))
+			}
+			return check.verifyOutput(output)
+		}
+	case CHealthCheckTCP:
+		{
+			if check.Port <= 0 {
+				return errors.New("no port specified")
+			}
+			// bash opens the connection itself, so no additional tools are needed on the node
+			probe := fmt.Sprintf("exec 3<>/dev/tcp/%s/%d", check.getHost(), check.Port)
+			cmd := fmt.Sprintf("timeout %d bash -c %s", timeoutSeconds, ShellQuote(probe))
+			if _, err := runner.Run(cmd); isTimeoutExit(err) {
+				return fmt.Errorf("unable to connect to %s: timed out after %ds", JoinHostPort(check.getHost(), check.Port), timeoutSeconds)
+			} else if err != nil {
+				return fmt.Errorf("unable to connect to %s: %v", JoinHostPort(check.getHost(), check.Port), err)
+			}
+			return nil
+		}
+	case CHealthCheckHTTP:
+		{
+			if check.URL == "" {
+				return errors.New("no url specified")
+			}
+			// the status code is written on a line of its own after the body
+			cmd := fmt.Sprintf(`curl -s --max-time %d -w '\n%%{http_code}' %s`, timeoutSeconds, ShellQuote(check.URL))
+			output, err := runner.Run(cmd)
+			if err != nil {
+				return fmt.Errorf("unable to request %s: %v", check.URL, err)
+			}
+			body, statusCode := output, ""
+			if i := strings.LastIndex(output, "\n"); i >= 0 {
+				body, statusCode = output[:i], strings.TrimSpace(output[i+1:])
+			}
+			expectedStatus := check.ExpectedStatus
+			if expectedStatus == 0 {
+				expectedStatus = 200
+			}
+			if status, err := strconv.Atoi(statusCode); err != nil || status != expectedStatus {
+				return fmt.Errorf("expected status %d from %s, got: %s", expectedStatus, check.URL, statusCode)
+			}
+			return check.verifyOutput(body)
+		}
+	case CHealthCheckProcess:
+		{
+			if check.Process == "" {
+				return errors.New("no process specified")
+			}
+			status := getProcessStatus(runner, check.Process)
+			if !status.Exists {
+				return fmt.Errorf("process %s is not running", check.Process)
+			}
+			return nil
+		}
+	case CHealthCheckGeth:
+		{
+			return check.probeGeth(runner, timeoutSeconds)
+		}
+	}
+	return fmt.Errorf("unknown health check type: %s", check.Type)
+}
+
+// isTimeoutExit returns true if the error is due to a command that was stopped by timeout
+func isTimeoutExit(err error) bool {
+	exitErr, ok := err.(interface {
+		ExitStatus() int
+	})
+	return ok && exitErr.ExitStatus() == CTimeoutExitStatus
+}
+
+func (check *HealthCheck) verifyOutput(output string) error {
+	if check.ExpectedOutput != "" && !strings.Contains(output, check.ExpectedOutput) {
+		return fmt.Errorf("expected output containing %q, got: %q", check.ExpectedOutput, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+func (check *HealthCheck) getHost() string {
+	if check.Host == "" {
+		return "127.0.0.1"
+	}
+	return check.Host
+}
+
+func (check *HealthCheck) getTimeout() time.Duration {
+	if check.Timeout.Duration <= 0 {
+		if check.Type == CHealthCheckGeth { // allow for the wait between the two samples of the block height
+			return CDefaultHealthCheckTimeout + check.getBlockWait()
+		}
+		return CDefaultHealthCheckTimeout
+	}
+	return check.Timeout.Duration
+}
@@ -0,0 +1,153 @@
+package softwareupgrade
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// fakeRunner returns the results for the commands it's given, in order,
+	// after the results are used up, the last result is repeated.
+	fakeRunner struct {
+		mutex      sync.Mutex
+		commands   []string
+		outputs    []string
+		errs       []error
+		delay      time.Duration
+		running    int
+		overlapped bool // a command was run while another was still running
+	}
+
+	// exitStatusError is returned by a command that exits with the given status
+	exitStatusError int
+)
+
+func (err exitStatusError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", int(err))
+}
+
+func (err exitStatusError) ExitStatus() int {
+	return int(err)
+}
+
+func (runner *fakeRunner) Run(cmd string) (string, error) {
+	runner.mutex.Lock()
+	i := len(runner.commands)
+	runner.commands = append(runner.commands, cmd)
+	runner.running++
+	runner.overlapped = runner.overlapped || runner.running > 1
+	runner.mutex.Unlock()
+	time.Sleep(runner.delay)
+	runner.mutex.Lock()
+	runner.running--
+	runner.mutex.Unlock()
+	if i >= len(runner.outputs) {
+		i = len(runner.outputs) - 1
+	}
+	return runner.outputs[i], runner.errs[i]
+}
+
+func (runner *fakeRunner) count() int {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	return len(runner.commands)
+}
+
+func TestHealthCheck_Run(t *testing.T) {
+	fail := errors.New("Process exited with status 1")
+	interval := Duration{time.Millisecond}
+	tests := []struct {
+		name      string
+		check     HealthCheck
+		outputs   []string
+		errs      []error
+		expectErr bool
+		attempts  int
+		command   string
+	}{
+		{"command passes", HealthCheck{Type: CHealthCheckCommand, Command: "vault status", ExpectedOutput: "Sealed: false"},
+			[]string{"Sealed: false\n"}, []error{nil}, false, 1, "vault status"},
+		{"command unexpected output", HealthCheck{Type: CHealthCheckCommand, Command: "vault status", ExpectedOutput: "Sealed: false", Interval: interval},
+			[]string{"Sealed: true\n"}, []error{nil}, true, 1, "vault status"},
+		{"command passes after retry", HealthCheck{Type: CHealthCheckCommand, Command: "true", Retries: 2, Interval: interval},
+			[]string{"", ""}, []error{fail, nil}, false, 2, "true"},
+		{"command fails after retries", HealthCheck{Type: CHealthCheckCommand, Command: "false", Retries: 2, Interval: interval},
+			[]string{""}, []error{fail}, true, 3, "false"},
+		{"tcp", HealthCheck{Type: CHealthCheckTCP, Port: 8545},
+			[]string{""}, []error{nil}, false, 1, "/dev/tcp/127.0.0.1/8545"},
+		{"tcp refused", HealthCheck{Type: CHealthCheckTCP, Host: "10.0.0.1", Port: 8545},
+			[]string{""}, []error{fail}, true, 1, "/dev/tcp/10.0.0.1/8545"},
+		{"http", HealthCheck{Type: CHealthCheckHTTP, URL: "http://localhost:8200/v1/sys/health", ExpectedOutput: `"sealed":false`},
+			[]string{"{\"sealed\":false}\n200"}, []error{nil}, false, 1, "curl"},
+		{"http status", HealthCheck{Type: CHealthCheckHTTP, URL: "http://localhost:8200/v1/sys/health"},
+			[]string{"{\"sealed\":true}\n503"}, []error{nil}, true, 1, "curl"},
+		{"http expected status", HealthCheck{Type: CHealthCheckHTTP, URL: "http://localhost:8200/v1/sys/health", ExpectedStatus: 503},
+			[]string{"\n503"}, []error{nil}, false, 1, "curl"},
+		{"process", HealthCheck{Type: CHealthCheckProcess, Process: "geth"},
+			[]string{"1234 geth\n"}, []error{nil}, false, 1, "pgrep -l geth"},
+		{"process not running", HealthCheck{Type: CHealthCheckProcess, Process: "geth"},
+			[]string{""}, []error{fail}, true, 1, "pgrep -l geth"},
+		{"unknown type", HealthCheck{Type: "ping"},
+			[]string{""}, []error{nil}, true, 0, ""},
+	}
+	for _, test := range tests {
+		runner := &fakeRunner{outputs: test.outputs, errs: test.errs}
+		err := test.check.Run(runner)
+		if (err != nil) != test.expectErr {
+			t.Fatalf("%s: unexpected result: %v", test.name, err)
+		}
+		if runner.count() != test.attempts {
+			t.Fatalf("%s: expected %d attempts, got: %d", test.name, test.attempts, runner.count())
+		}
+		if test.attempts > 0 && !strings.Contains(runner.commands[0], test.command) {
+			t.Fatalf("%s: expected command containing %q, got: %q", test.name, test.command, runner.commands[0])
+		}
+	}
+}
+
+func TestHealthCheck_Timeout(t *testing.T) {
+	// the command is stopped by timeout on the node, once the timeout of the check expires
+	runner := &fakeRunner{outputs: []string{""}, errs: []error{exitStatusError(CTimeoutExitStatus)}, delay: 10 * time.Millisecond}
+	check := HealthCheck{Type: CHealthCheckCommand, Command: "sleep 60", Timeout: Duration{10 * time.Millisecond}, Retries: 2, Interval: Duration{time.Millisecond}}
+	if err := check.Run(runner); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected the check to time out, got: %v", err)
+	}
+	if runner.count() != 3 || runner.commands[0] != "timeout 1 bash -c 'sleep 60'" {
+		t.Fatalf("Expected the command to be run with timeout, 3 times, got: %v", runner.commands)
+	}
+	if runner.overlapped {
+		t.Fatal("An attempt shouldn't start until the previous attempt has completed")
+	}
+
+	runner = &fakeRunner{outputs: []string{""}, errs: []error{exitStatusError(CTimeoutExitStatus)}}
+	check = HealthCheck{Type: CHealthCheckTCP, Port: 8545, Timeout: Duration{3 * time.Second}}
+	if err := check.Run(runner); err == nil || !strings.Contains(err.Error(), "timed out after 3s") {
+		t.Fatalf("Expected the connection to time out, got: %v", err)
+	}
+}
+
+func TestNodeInfoContainer_RunHealthChecks(t *testing.T) {
+	nodeInfo := &NodeInfoContainer{}
+	nodeInfo.HealthChecks = []HealthCheck{
+		{Type: CHealthCheckProcess, Process: "geth"},
+		{Name: "rpc", Type: CHealthCheckTCP, Port: 8545, HaltOnFailure: true},
+	}
+	runner := &fakeRunner{outputs: []string{"1234 geth\n", ""}, errs: []error{nil, errors.New("refused")}}
+	err := nodeInfo.RunHealthChecks(runner)
+	if err == nil || !strings.Contains(err.Error(), "rpc") {
+		t.Fatalf("Expected the rpc check to fail, got: %v", err)
+	}
+	if !IsHaltingHealthCheckError(err) {
+		t.Fatal("The failed check should halt the rollout")
+	}
+
+	nodeInfo.HealthChecks[1].HaltOnFailure = false
+	runner = &fakeRunner{outputs: []string{"1234 geth\n", ""}, errs: []error{nil, errors.New("refused")}}
+	if err := nodeInfo.RunHealthChecks(runner); err == nil || IsHaltingHealthCheckError(err) {
+		t.Fatalf("Expected a failure that doesn't halt the rollout, got: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package softwareupgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type (
+	// HostKeyError is returned when the host key presented by a node cannot be verified,
+	// either because it's unknown, or because it doesn't match the recorded/pinned key.
+	HostKeyError struct {
+		Host        string
+		Fingerprint string
+		Reason      string
+	}
+)
+
+var (
+	knownHostsMutex sync.Mutex // serializes trust-on-first-use writes to the known_hosts file
+)
+
+// Error implements the error interface
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (%s): %s", e.Host, e.Fingerprint, e.Reason)
+}
+
+// IsHostKeyError returns true if the given error is due to a failed host key verification,
+// including the verification of a jump host the node is connected through
+func IsHostKeyError(err error) bool {
+	var hostKeyErr *HostKeyError
+	return errors.As(err, &hostKeyErr)
+}
+
+// SetHostKeyCheck configures how the host key presented by the node is verified.
+// mode is one of strict (default), tofu or off. knownHostsFile defaults to ~/.ssh/known_hosts.
+// If fingerprints is not empty, the host key must match one of the given fingerprints,
+// specified either as SHA256:... or as MD5:xx:xx:...
+func (sshConfig *SSHConfig) SetHostKeyCheck(mode, knownHostsFile string, fingerprints []string) {
+	if mode == "" {
+		mode = CHostKeyCheckStrict
+	}
+	if knownHostsFile == "" {
+		knownHostsFile = CDefaultKnownHosts
+	}
+	if expandedFilename, err := Expand(knownHostsFile); err == nil {
+		knownHostsFile = expandedFilename
+	}
+	sshConfig.hostKeyCheck = strings.ToLower(mode)
+	sshConfig.knownHostsFile = knownHostsFile
+	sshConfig.hostKeyFingerprints = fingerprints
+}
+
+func (sshConfig *SSHConfig) getHostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := sshConfig.verifyHostKey(hostname, remote, key)
+		if err != nil {
+			// remember the failure, as the ssh package doesn't preserve the error type
+			sshConfig.hostKeyErr = err
+		}
+		return err
+	}
+}
+
+func (sshConfig *SSHConfig) verifyHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(sshConfig.hostKeyFingerprints) > 0 {
+		legacyFingerprint := "MD5:" + ssh.FingerprintLegacyMD5(key)
+		for _, pinned := range sshConfig.hostKeyFingerprints {
+			if pinned == fingerprint || strings.EqualFold(pinned, legacyFingerprint) {
+				return nil
+			}
+		}
+		return &HostKeyError{hostname, fingerprint, "host key does not match any pinned fingerprint"}
+	}
+
+	switch sshConfig.hostKeyCheck {
+	case CHostKeyCheckOff:
+		{
+			return nil
+		}
+	case CHostKeyCheckStrict, CHostKeyCheckTOFU:
+		{
+		}
+	default:
+		{
+			return &HostKeyError{hostname, fingerprint, fmt.Sprintf("unknown host key check mode: %s", sshConfig.hostKeyCheck)}
+		}
+	}
+
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	if !FileExists(sshConfig.knownHostsFile) {
+		if sshConfig.hostKeyCheck != CHostKeyCheckTOFU {
+			return &HostKeyError{hostname, fingerprint, fmt.Sprintf("%s does not exist", sshConfig.knownHostsFile)}
+		}
+		return sshConfig.addKnownHost(hostname, remote, key)
+	}
+
+	callback, err := knownhosts.New(sshConfig.knownHostsFile)
+	if err != nil {
+		return err
+	}
+	err = callback(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		return &HostKeyError{hostname, fingerprint,
+			fmt.Sprintf("host key mismatch, possible man-in-the-middle attack, recorded in %s:%d",
+				keyErr.Want[0].Filename, keyErr.Want[0].Line)}
+	}
+	if sshConfig.hostKeyCheck == CHostKeyCheckTOFU {
+		return sshConfig.addKnownHost(hostname, remote, key)
+	}
+	return &HostKeyError{hostname, fingerprint, fmt.Sprintf("host is not in %s", sshConfig.knownHostsFile)}
+}
+
+// addKnownHost records the given key in the known_hosts file. Caller must hold knownHostsMutex.
+func (sshConfig *SSHConfig) addKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(sshConfig.knownHostsFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sshConfig.knownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if remoteAddr := knownhosts.Normalize(remote.String()); remoteAddr != addresses[0] {
+			addresses = append(addresses, remoteAddr)
+		}
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line(addresses, key))
+	if err == nil {
+		DebugLog.Debugln("Trusting new host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+	}
+	return err
+}
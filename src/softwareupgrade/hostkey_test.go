@@ -0,0 +1,85 @@
+package softwareupgrade
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Unable to convert key: %v", err)
+	}
+	return key
+}
+
+func TestSSHConfig_verifyHostKey(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	knownHosts := filepath.Join(tempdir, "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	key, otherKey := newTestHostKey(t), newTestHostKey(t)
+
+	sshConfig := &SSHConfig{}
+	sshConfig.SetHostKeyCheck(CHostKeyCheckStrict, knownHosts, nil)
+	if err := sshConfig.verifyHostKey("node1:22", remote, key); !IsHostKeyError(err) {
+		t.Fatalf("Strict mode should reject a missing known_hosts, got: %v", err)
+	}
+
+	sshConfig.SetHostKeyCheck(CHostKeyCheckTOFU, knownHosts, nil)
+	if err := sshConfig.verifyHostKey("node1:22", remote, key); err != nil {
+		t.Fatalf("TOFU mode should accept an unknown host, got: %v", err)
+	}
+
+	sshConfig.SetHostKeyCheck(CHostKeyCheckStrict, knownHosts, nil)
+	if err := sshConfig.verifyHostKey("node1:22", remote, key); err != nil {
+		t.Fatalf("Strict mode should accept the key recorded by TOFU, got: %v", err)
+	}
+	if err := sshConfig.verifyHostKey("node1:22", remote, otherKey); !IsHostKeyError(err) {
+		t.Fatalf("Strict mode should reject a changed key, got: %v", err)
+	}
+	if err := sshConfig.verifyHostKey("node2:22", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 22}, key); !IsHostKeyError(err) {
+		t.Fatalf("Strict mode should reject an unknown host, got: %v", err)
+	}
+
+	sshConfig.SetHostKeyCheck(CHostKeyCheckTOFU, knownHosts, nil)
+	if err := sshConfig.verifyHostKey("node1:22", remote, otherKey); !IsHostKeyError(err) {
+		t.Fatalf("TOFU mode should reject a changed key, got: %v", err)
+	}
+}
+
+func TestSSHConfig_verifyHostKeyPinned(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	key, otherKey := newTestHostKey(t), newTestHostKey(t)
+
+	sshConfig := &SSHConfig{}
+	sshConfig.SetHostKeyCheck(CHostKeyCheckStrict, "/nonexistent/known_hosts", []string{ssh.FingerprintSHA256(key)})
+	if err := sshConfig.verifyHostKey("node1:22", remote, key); err != nil {
+		t.Fatalf("Pinned SHA256 fingerprint should be accepted, got: %v", err)
+	}
+	if err := sshConfig.verifyHostKey("node1:22", remote, otherKey); !IsHostKeyError(err) {
+		t.Fatalf("Key not matching the pinned fingerprint should be rejected, got: %v", err)
+	}
+
+	sshConfig.SetHostKeyCheck(CHostKeyCheckOff, "", []string{"MD5:" + ssh.FingerprintLegacyMD5(key)})
+	if err := sshConfig.verifyHostKey("node1:22", remote, key); err != nil {
+		t.Fatalf("Pinned MD5 fingerprint should be accepted, got: %v", err)
+	}
+	if err := sshConfig.verifyHostKey("node1:22", remote, otherKey); !IsHostKeyError(err) {
+		t.Fatalf("Pinned fingerprints should be enforced even when checking is off, got: %v", err)
+	}
+}
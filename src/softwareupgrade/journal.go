@@ -0,0 +1,206 @@
+package softwareupgrade
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// JournalEntry records a step of the upgrade of a software on a node,
+	// and for the steps of each file, the destination file.
+	JournalEntry struct {
+		Time     time.Time `json:"time"`
+		Session  string    `json:"session"` // the backup suffix of the session that performed the step
+		Node     string    `json:"node"`
+		Software string    `json:"software"`
+		Step     string    `json:"step"`
+		File     string    `json:"file,omitempty"`
+	}
+
+	// Journal is an append-only log of the steps performed by an upgrade, one JSON entry per line.
+	// Each entry is flushed to disk as the step is performed, so that an upgrade that's killed
+	// can be resumed from the last step performed.
+	Journal struct {
+		filename string
+		file     *os.File
+		session  string
+		steps    map[string]map[string]bool // steps performed, keyed by node and software, then by step and file
+		mutex    sync.Mutex                 // nodes are upgraded concurrently
+	}
+
+	// NodeJournal records the steps of the upgrade of a software on a node in a Journal.
+	// A nil NodeJournal records nothing, and reports no steps as performed.
+	NodeJournal struct {
+		journal        *Journal
+		node, software string
+	}
+)
+
+// OpenJournal opens the journal with the given filename, creating it if it doesn't exist,
+// and loads the steps recorded in it. The session of the journal is the session of its
+// first entry, or the given session if the journal is empty.
+func OpenJournal(filename, session string) (result *Journal, err error) {
+	if expandedFilename, err := Expand(filename); err == nil {
+		filename = expandedFilename
+	}
+	result = &Journal{filename: filename, session: session, steps: make(map[string]map[string]bool)}
+	if err = result.load(); err != nil {
+		return nil, err
+	}
+	if result.file, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return nil, fmt.Errorf("unable to open journal %s: %v", filename, err)
+	}
+	return
+}
+
+func (journal *Journal) load() error {
+	file, err := os.Open(journal.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read journal %s: %v", journal.filename, err)
+	}
+	defer file.Close()
+	first := true
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line might be incomplete, if the process was killed while writing it
+			DebugLog.Println("Ignoring invalid entry in journal %s: %s", journal.filename, scanner.Text())
+			continue
+		}
+		if first && entry.Session != "" {
+			journal.session = entry.Session
+			first = false
+		}
+		journal.apply(entry)
+	}
+	return scanner.Err()
+}
+
+// apply updates the steps performed with the given entry. Starting the software means it's
+// no longer stopped, stopping it means it's no longer started, and a rollback undoes all the steps,
+// or for a file, the steps of the file.
+func (journal *Journal) apply(entry JournalEntry) {
+	key := getJournalKey(entry.Node, entry.Software)
+	steps := journal.steps[key]
+	if steps == nil || (entry.Step == CStepRolledBack && entry.File == "") {
+		steps = make(map[string]bool)
+		journal.steps[key] = steps
+	}
+	switch entry.Step {
+	case CStepRolledBack:
+		{
+			if entry.File != "" {
+				for _, step := range []string{CStepCopied, CStepVerified, CStepBackedUp, CStepReplaced} {
+					delete(steps, getJournalKey(step, entry.File))
+				}
+				return
+			}
+		}
+	case CStepStarted:
+		{
+			delete(steps, getJournalKey(CStepStopped, ""))
+		}
+	case CStepStopped:
+		{
+			delete(steps, getJournalKey(CStepStarted, ""))
+			delete(steps, getJournalKey(CStepHealthChecked, ""))
+		}
+	}
+	steps[getJournalKey(entry.Step, entry.File)] = true
+}
+
+func getJournalKey(a, b string) string {
+	return fmt.Sprintf("%s\x00%s", a, b)
+}
+
+// Session returns the backup suffix of the session recorded in the journal
+func (journal *Journal) Session() string {
+	return journal.session
+}
+
+// Filename returns the filename of the journal
+func (journal *Journal) Filename() string {
+	return journal.filename
+}
+
+// Record appends the step to the journal, and flushes it to disk before returning
+func (journal *Journal) Record(node, software, step, file string) (err error) {
+	entry := JournalEntry{Time: time.Now().UTC(), Session: journal.session, Node: node, Software: software, Step: step, File: file}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if _, err = journal.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write to journal %s: %v", journal.filename, err)
+	}
+	if err = journal.file.Sync(); err != nil {
+		return fmt.Errorf("unable to fsync journal %s: %v", journal.filename, err)
+	}
+	journal.apply(entry)
+	return
+}
+
+// Done returns true if the step has been performed, for the given file, if it's a step of a file
+func (journal *Journal) Done(node, software, step, file string) bool {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return journal.steps[getJournalKey(node, software)][getJournalKey(step, file)]
+}
+
+// Started returns true if any step of the upgrade of the software on the node has been recorded
+func (journal *Journal) Started(node, software string) bool {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return len(journal.steps[getJournalKey(node, software)]) > 0
+}
+
+// Close closes the journal
+func (journal *Journal) Close() error {
+	return journal.file.Close()
+}
+
+// ForNode returns a NodeJournal that records the steps of the given node and software
+func (journal *Journal) ForNode(node, software string) *NodeJournal {
+	if journal == nil {
+		return nil
+	}
+	return &NodeJournal{journal: journal, node: node, software: software}
+}
+
+// Record records the step, for the given file, if it's a step of a file
+func (nodeJournal *NodeJournal) Record(step, file string) error {
+	if nodeJournal == nil {
+		return nil
+	}
+	err := nodeJournal.journal.Record(nodeJournal.node, nodeJournal.software, step, file)
+	if err != nil {
+		DebugLog.Println("%v", err)
+	}
+	return err
+}
+
+// Done returns true if the step has been recorded, for the given file, if it's a step of a file
+func (nodeJournal *NodeJournal) Done(step, file string) bool {
+	if nodeJournal == nil {
+		return false
+	}
+	return nodeJournal.journal.Done(nodeJournal.node, nodeJournal.software, step, file)
+}
+
+// Started returns true if any step has been recorded
+func (nodeJournal *NodeJournal) Started() bool {
+	if nodeJournal == nil {
+		return false
+	}
+	return nodeJournal.journal.Started(nodeJournal.node, nodeJournal.software)
+}
@@ -0,0 +1,94 @@
+package softwareupgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	filename := filepath.Join(tempdir, "journal")
+
+	journal, err := OpenJournal(filename, "session1")
+	if err != nil {
+		t.Fatalf("Unable to open journal: %v", err)
+	}
+	nodeJournal := journal.ForNode("node1", "quorum")
+	if nodeJournal.Started() {
+		t.Fatal("An empty journal shouldn't have any steps")
+	}
+	for _, step := range []struct{ step, file string }{
+		{CStepStopped, ""},
+		{CStepCopied, "/usr/local/bin/geth"},
+		{CStepVerified, "/usr/local/bin/geth"},
+		{CStepBackedUp, "/usr/local/bin/geth"},
+		{CStepCopied, "/usr/local/bin/bootnode"},
+	} {
+		if err := nodeJournal.Record(step.step, step.file); err != nil {
+			t.Fatalf("Unable to record %s: %v", step.step, err)
+		}
+	}
+	journal.Close()
+
+	// simulate a process killed while writing an entry
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"time":"2020-01-01T00:00:00Z","node":"node1","software":"quorum","step":"rep`)
+	f.Close()
+
+	journal, err = OpenJournal(filename, "session2")
+	if err != nil {
+		t.Fatalf("Unable to reopen journal: %v", err)
+	}
+	defer journal.Close()
+	if journal.Session() != "session1" {
+		t.Fatalf("Expected the session of the resumed journal: session1, got: %s", journal.Session())
+	}
+	nodeJournal = journal.ForNode("node1", "quorum")
+	if !nodeJournal.Started() || !nodeJournal.Done(CStepStopped, "") || !nodeJournal.Done(CStepBackedUp, "/usr/local/bin/geth") {
+		t.Fatal("The recorded steps should be loaded")
+	}
+	if nodeJournal.Done(CStepReplaced, "/usr/local/bin/geth") || nodeJournal.Done(CStepBackedUp, "/usr/local/bin/bootnode") {
+		t.Fatal("Steps that weren't recorded shouldn't be done")
+	}
+	if journal.ForNode("node2", "quorum").Started() {
+		t.Fatal("The steps of node1 shouldn't apply to node2")
+	}
+
+	// a file that's rolled back is copied again, without affecting the other files
+	nodeJournal.Record(CStepRolledBack, "/usr/local/bin/bootnode")
+	if nodeJournal.Done(CStepCopied, "/usr/local/bin/bootnode") || !nodeJournal.Done(CStepCopied, "/usr/local/bin/geth") {
+		t.Fatal("Only the steps of the rolled back file should be undone")
+	}
+
+	nodeJournal.Record(CStepUpgraded, "")
+	nodeJournal.Record(CStepStarted, "")
+	if nodeJournal.Done(CStepStopped, "") || !nodeJournal.Done(CStepStarted, "") {
+		t.Fatal("A started software shouldn't be stopped")
+	}
+	nodeJournal.Record(CStepStopped, "")
+	if nodeJournal.Done(CStepStarted, "") {
+		t.Fatal("A stopped software shouldn't be started")
+	}
+
+	nodeJournal.Record(CStepRolledBack, "")
+	if nodeJournal.Done(CStepUpgraded, "") || nodeJournal.Done(CStepCopied, "/usr/local/bin/geth") {
+		t.Fatal("A rollback should undo all the steps")
+	}
+}
+
+func TestNodeJournal_Nil(t *testing.T) {
+	var journal *Journal
+	nodeJournal := journal.ForNode("node1", "quorum")
+	if err := nodeJournal.Record(CStepStopped, ""); err != nil {
+		t.Fatalf("A nil journal shouldn't fail to record: %v", err)
+	}
+	if nodeJournal.Done(CStepStopped, "") || nodeJournal.Started() {
+		t.Fatal("A nil journal shouldn't record any steps")
+	}
+}
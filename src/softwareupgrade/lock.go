@@ -0,0 +1,241 @@
+package softwareupgrade
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type (
+	// LockInfo records the session holding a lock
+	LockInfo struct {
+		ID       string    `json:"id"` // identifies the session, so that a lock is only released by its holder
+		Owner    string    `json:"owner"`
+		PID      int       `json:"pid"`
+		Hostname string    `json:"hostname"`
+		Time     time.Time `json:"time"`
+	}
+
+	// LocalLock is held on the local host, so that only one session runs with a configuration at a time
+	LocalLock struct {
+		filename string
+		info     LockInfo
+	}
+
+	// RemoteLock is held on a node, so that only one session stops and upgrades its software at a time
+	RemoteLock struct {
+		runner   Runner
+		filename string
+		info     LockInfo
+	}
+
+	// LockedError is returned when a lock is held by another session
+	LockedError struct {
+		Filename string
+		Holder   LockInfo
+	}
+)
+
+var (
+	lockInfo     LockInfo // identifies this session in the locks it holds
+	lockInfoOnce sync.Once
+)
+
+func (err *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", err.Filename, err.Holder)
+}
+
+func (info LockInfo) String() string {
+	if info.ID == "" {
+		return "an unknown session"
+	}
+	return fmt.Sprintf("%s@%s (PID: %d) since %s", info.Owner, info.Hostname, info.PID, info.Time.Format(time.RFC3339))
+}
+
+// getLockInfo returns the information recorded in the locks held by this session
+func getLockInfo() (result LockInfo) {
+	lockInfoOnce.Do(func() {
+		id := make([]byte, 8)
+		rand.Read(id)
+		lockInfo.ID = hex.EncodeToString(id)
+		if usr, err := user.Current(); err == nil {
+			lockInfo.Owner = usr.Username
+		}
+		lockInfo.PID = os.Getpid()
+		lockInfo.Hostname, _ = os.Hostname()
+	})
+	result = lockInfo
+	result.Time = time.Now().UTC()
+	return
+}
+
+// isStale returns true if the session holding the lock no longer exists, ie, it was held by
+// a process on this host that's no longer running, or it's older than staleAfter, if it's specified.
+// A lock that doesn't record its holder, eg, as its holder was killed while creating it, is stale.
+func (info LockInfo) isStale(staleAfter time.Duration) bool {
+	if info.ID == "" {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname == info.Hostname && !processExists(info.PID) {
+		return true
+	}
+	return staleAfter > 0 && time.Since(info.Time) > staleAfter
+}
+
+// processExists returns true if a process with the given PID is running on this host
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func parseLockInfo(data []byte) (result LockInfo) {
+	json.Unmarshal(data, &result)
+	return
+}
+
+// GetLocalLockFilename returns the name of the local lock file for the given configuration file.
+// The lock file is named after the hash of the absolute path of the configuration file, so that
+// sessions started from different directories with the same configuration exclude each other.
+func GetLocalLockFilename(configFilename string) string {
+	if absFilename, err := filepath.Abs(configFilename); err == nil {
+		configFilename = absFilename
+	}
+	hash := sha256.Sum256([]byte(configFilename))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("Upgrade-%s.lock", hex.EncodeToString(hash[:8])))
+}
+
+// AcquireLocalLock acquires the local lock for the given configuration file. A LockedError is returned
+// if another session holds the lock, unless the lock is stale, or force is specified.
+// The lock is written to a temporary file, which is then linked to the lock file, so that
+// the lock file never exists without recording its holder.
+func AcquireLocalLock(configFilename string, force bool) (result *LocalLock, err error) {
+	filename := GetLocalLockFilename(configFilename)
+	info := getLockInfo()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	tempFilename := fmt.Sprintf("%s.%d", filename, info.PID)
+	if err = ioutil.WriteFile(tempFilename, data, 0644); err != nil {
+		return nil, fmt.Errorf("unable to write lock %s: %v", tempFilename, err)
+	}
+	defer os.Remove(tempFilename)
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = os.Link(tempFilename, filename); err == nil {
+			return &LocalLock{filename: filename, info: info}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("unable to create lock %s: %v", filename, err)
+		}
+		holderData, _ := ioutil.ReadFile(filename)
+		holder := parseLockInfo(holderData)
+		if !force && !holder.isStale(0) {
+			return nil, &LockedError{Filename: filename, Holder: holder}
+		}
+		DebugLog.Println("Removing lock: %s held by %s", filename, holder)
+		if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to remove lock %s: %v", filename, err)
+		}
+	}
+	return nil, fmt.Errorf("unable to acquire lock %s", filename)
+}
+
+// Filename returns the filename of the lock
+func (lock *LocalLock) Filename() string {
+	return lock.filename
+}
+
+// Release releases the lock, unless it's been taken over by another session
+func (lock *LocalLock) Release() error {
+	data, err := ioutil.ReadFile(lock.filename)
+	if err != nil {
+		return err
+	}
+	if holder := parseLockInfo(data); holder.ID != lock.info.ID {
+		return &LockedError{Filename: lock.filename, Holder: holder}
+	}
+	return os.Remove(lock.filename)
+}
+
+// AcquireRemoteLock creates the given lock file on the node that runner runs commands on.
+// The lock file is created with the shell's noclobber option, so that creating it fails if it
+// already exists. A LockedError is returned if another session holds the lock, unless the lock
+// is stale, ie, it hasn't been refreshed for staleAfter, or force is specified.
+func AcquireRemoteLock(runner Runner, filename string, staleAfter time.Duration, force bool) (result *RemoteLock, err error) {
+	info := getLockInfo()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	createCmd := fmt.Sprintf("sudo sh -c %s", ShellQuote(fmt.Sprintf("set -C; echo %s > %s", ShellQuote(string(data)), ShellQuote(filename))))
+	for attempt := 0; attempt < 2; attempt++ {
+		var output string
+		if _, err = runner.Run(createCmd); err == nil {
+			return &RemoteLock{runner: runner, filename: filename, info: info}, nil
+		}
+		if IsHostKeyError(err) {
+			return nil, err
+		}
+		if output, err = runner.Run(fmt.Sprintf("sudo cat %s", ShellQuote(filename))); err != nil {
+			return nil, fmt.Errorf("unable to create lock %s: %v", filename, err)
+		}
+		holder := parseLockInfo([]byte(strings.TrimSpace(output)))
+		if !force && !holder.isStale(staleAfter) {
+			return nil, &LockedError{Filename: filename, Holder: holder}
+		}
+		DebugLog.Println("Removing lock: %s held by %s", filename, holder)
+		if _, err = runner.Run(fmt.Sprintf("sudo rm -f %s", ShellQuote(filename))); err != nil {
+			return nil, fmt.Errorf("unable to remove lock %s: %v", filename, err)
+		}
+	}
+	return nil, fmt.Errorf("unable to acquire lock %s", filename)
+}
+
+// Refresh rewrites the lock file on the node with the current time, so that the lock isn't considered
+// stale while it's held for longer than staleAfter. A LockedError is returned if the lock has been
+// taken over by another session, and the lock file isn't changed.
+func (lock *RemoteLock) Refresh() (err error) {
+	output, err := lock.runner.Run(fmt.Sprintf("sudo cat %s", ShellQuote(lock.filename)))
+	if err != nil {
+		return fmt.Errorf("unable to refresh lock %s: %v", lock.filename, err)
+	}
+	if holder := parseLockInfo([]byte(strings.TrimSpace(output))); holder.ID != lock.info.ID {
+		return &LockedError{Filename: lock.filename, Holder: holder}
+	}
+	lock.info.Time = time.Now().UTC()
+	data, err := json.Marshal(lock.info)
+	if err != nil {
+		return err
+	}
+	// the lock is replaced by a rename, so that it always records its holder
+	tempFilename := fmt.Sprintf("%s.%s", lock.filename, lock.info.ID)
+	cmd := fmt.Sprintf("sudo sh -c %s", ShellQuote(fmt.Sprintf("grep -qF %s %s && echo %s > %s && mv -f %[4]s %[2]s",
+		ShellQuote(lock.info.ID), ShellQuote(lock.filename), ShellQuote(string(data)), ShellQuote(tempFilename))))
+	if _, err = lock.runner.Run(cmd); err != nil {
+		err = fmt.Errorf("unable to refresh lock %s: %v", lock.filename, err)
+	}
+	return
+}
+
+// Release removes the lock file from the node, unless the lock has been taken over by another session
+func (lock *RemoteLock) Release() (err error) {
+	cmd := fmt.Sprintf("sudo sh -c %s", ShellQuote(fmt.Sprintf("grep -qF %s %[2]s && rm -f %[2]s",
+		ShellQuote(lock.info.ID), ShellQuote(lock.filename))))
+	if _, err = lock.runner.Run(cmd); err != nil {
+		err = fmt.Errorf("unable to release lock %s: %v", lock.filename, err)
+	}
+	return
+}
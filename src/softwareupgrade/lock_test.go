@@ -0,0 +1,172 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type (
+	// sudoRunner runs commands on the local host without sudo, in place of a node
+	sudoRunner struct {
+		localRunner
+	}
+)
+
+func (runner *sudoRunner) Run(cmd string) (string, error) {
+	return runner.localRunner.Run(strings.Replace(cmd, "sudo ", "", -1))
+}
+
+func writeLockInfo(t *testing.T, filename string, info LockInfo) {
+	data, _ := json.Marshal(info)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Unable to write lock: %v", err)
+	}
+}
+
+func TestAcquireLocalLock(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	configFilename := filepath.Join(tempdir, "upgrade.json")
+
+	lock, err := AcquireLocalLock(configFilename, false)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %v", err)
+	}
+	if _, err := AcquireLocalLock(configFilename, false); err == nil {
+		t.Fatal("The lock shouldn't be acquired while it's held")
+	} else if lockedErr, ok := err.(*LockedError); !ok || lockedErr.Holder.PID != os.Getpid() {
+		t.Fatalf("Expected a LockedError with the holder, got: %v", err)
+	}
+	if _, err := AcquireLocalLock(filepath.Join(tempdir, "other.json"), false); err != nil {
+		t.Fatalf("The lock of another configuration should be acquired: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Unable to release lock: %v", err)
+	}
+	if FileExists(lock.Filename()) {
+		t.Fatal("The released lock should be removed")
+	}
+	os.Remove(GetLocalLockFilename(filepath.Join(tempdir, "other.json")))
+
+	// a lock held by a process that no longer exists is stale
+	holder := getLockInfo()
+	holder.ID, holder.PID = "dead", 1<<22+1
+	writeLockInfo(t, lock.Filename(), holder)
+	if lock, err = AcquireLocalLock(configFilename, false); err != nil {
+		t.Fatalf("A stale lock should be taken over: %v", err)
+	}
+
+	// the lock is only taken over from a running session with force
+	holder.ID, holder.PID = "other", os.Getppid()
+	writeLockInfo(t, lock.Filename(), holder)
+	if err := lock.Release(); err == nil {
+		t.Fatal("A lock that's been taken over shouldn't be released")
+	}
+	if _, err := AcquireLocalLock(configFilename, false); err == nil {
+		t.Fatal("The lock shouldn't be acquired while it's held")
+	}
+	if lock, err = AcquireLocalLock(configFilename, true); err != nil {
+		t.Fatalf("The lock should be acquired with force: %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireRemoteLock(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	filename := filepath.Join(tempdir, "upgrade's.lock")
+	runner := &sudoRunner{}
+
+	lock, err := AcquireRemoteLock(runner, filename, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if info := parseLockInfo(data); info.ID != getLockInfo().ID || info.PID != os.Getpid() || info.Hostname == "" {
+		t.Fatalf("The lock should record its holder, got: %s", data)
+	}
+	if _, err := AcquireRemoteLock(runner, filename, time.Hour, false); err == nil {
+		t.Fatal("The lock shouldn't be acquired while it's held")
+	}
+	if err := lock.Release(); err != nil || FileExists(filename) {
+		t.Fatalf("The lock should be released, error: %v", err)
+	}
+
+	// a lock held by another host is stale once it's older than staleAfter
+	holder := LockInfo{ID: "other", Owner: "ubuntu", PID: 1, Hostname: "other-host", Time: time.Now().Add(-2 * time.Hour)}
+	writeLockInfo(t, filename, holder)
+	if _, err := AcquireRemoteLock(runner, filename, 3*time.Hour, false); err == nil {
+		t.Fatal("The lock shouldn't be acquired before it's stale")
+	} else if !strings.Contains(err.Error(), "ubuntu@other-host") {
+		t.Fatalf("The error should report the holder, got: %v", err)
+	}
+	if lock, err = AcquireRemoteLock(runner, filename, time.Hour, false); err != nil {
+		t.Fatalf("A stale lock should be taken over: %v", err)
+	}
+
+	// a lock taken over by another session isn't released
+	writeLockInfo(t, filename, holder)
+	if err := lock.Release(); err == nil || !FileExists(filename) {
+		t.Fatal("A lock that's been taken over shouldn't be released")
+	}
+	if _, err := AcquireRemoteLock(runner, filename, 0, true); err != nil {
+		t.Fatalf("The lock should be acquired with force: %v", err)
+	}
+}
+
+func TestRemoteLock_Refresh(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	filename := filepath.Join(tempdir, "upgrade.lock")
+	runner := &sudoRunner{}
+
+	lock, err := AcquireRemoteLock(runner, filename, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %v", err)
+	}
+
+	// a lock that's held for longer than staleAfter isn't stale once it's refreshed
+	held := getLockInfo()
+	held.Time = time.Now().Add(-2 * time.Hour)
+	writeLockInfo(t, filename, held)
+	if err := lock.Refresh(); err != nil {
+		t.Fatalf("Unable to refresh lock: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if info := parseLockInfo(data); info.ID != held.ID || time.Since(info.Time) > time.Minute {
+		t.Fatalf("The lock should record the time it's refreshed, got: %s", data)
+	}
+	if info := parseLockInfo(data); info.isStale(time.Hour) {
+		t.Fatalf("A refreshed lock shouldn't be stale, got: %s", data)
+	}
+
+	// a lock taken over by another session isn't refreshed
+	holder := LockInfo{ID: "other", Owner: "ubuntu", PID: 1, Hostname: "other-host", Time: time.Now()}
+	writeLockInfo(t, filename, holder)
+	if err := lock.Refresh(); err == nil {
+		t.Fatal("A lock that's been taken over shouldn't be refreshed")
+	} else if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("Expected a LockedError, got: %v", err)
+	}
+	data, _ = ioutil.ReadFile(filename)
+	if info := parseLockInfo(data); info.ID != holder.ID {
+		t.Fatalf("The lock of the other session shouldn't be changed, got: %s", data)
+	}
+	if err := lock.Release(); err == nil {
+		t.Fatal("A lock that's been taken over shouldn't be released")
+	}
+}
@@ -0,0 +1,157 @@
+package softwareupgrade
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderByDependencies orders the items so that each item comes after the items it depends on.
+// Items that don't depend on each other keep the order they're given in, so the result is
+// the same on every run. Dependencies on items that aren't in items are ignored.
+// An error is returned if the dependencies contain a cycle.
+func orderByDependencies(items []string, dependsOn map[string][]string) (result []string, err error) {
+	position := make(map[string]int)
+	for i, item := range items {
+		if _, exists := position[item]; !exists {
+			position[item] = i
+		}
+	}
+
+	pending := make(map[string]int) // number of dependencies not yet in result
+	dependents := make(map[string][]string)
+	for item := range position {
+		for _, dependency := range dependsOn[item] {
+			if _, exists := position[dependency]; !exists {
+				continue
+			}
+			pending[item]++
+			dependents[dependency] = append(dependents[dependency], item)
+		}
+	}
+
+	done := make(map[string]bool)
+	for len(result) < len(position) {
+		// pick the earliest item whose dependencies are all done
+		next := ""
+		for _, item := range items {
+			if !done[item] && pending[item] == 0 {
+				next = item
+				break
+			}
+		}
+		if next == "" {
+			var cycle []string
+			for _, item := range items {
+				if !done[item] {
+					cycle = append(cycle, item)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between: %s", strings.Join(cycle, ", "))
+		}
+		done[next] = true
+		result = append(result, next)
+		for _, dependent := range dependents[next] {
+			pending[dependent]--
+		}
+	}
+	return
+}
+
+// orderGroupNames returns the software groups in the order they're upgraded in.
+// The groups listed in group_order come first, in that order, followed by the remaining groups,
+// sorted by name, and each group comes after the groups it depends on.
+func (config *UpgradeConfig) orderGroupNames() (result []string, err error) {
+	var groups []string
+	for groupName := range config.SoftwareGroupNodes {
+		groups = append(groups, groupName)
+	}
+	sort.Strings(groups)
+
+	var msg string
+	dependsOn := make(map[string][]string)
+	listed := make(map[string]bool)
+	var ordered []string
+	for i, groupName := range config.Common.GroupOrder {
+		if _, exists := config.SoftwareGroupNodes[groupName]; !exists {
+			msg = fmt.Sprintf("%sgroup_order contains unknown group: %s\n", msg, groupName)
+			continue
+		}
+		if listed[groupName] {
+			msg = fmt.Sprintf("%sgroup_order contains %s more than once\n", msg, groupName)
+			continue
+		}
+		listed[groupName] = true
+		ordered = append(ordered, groupName)
+		if i > 0 { // each group in group_order comes after the one before it
+			dependsOn[groupName] = append(dependsOn[groupName], config.Common.GroupOrder[i-1])
+		}
+	}
+	for _, groupName := range groups {
+		if !listed[groupName] {
+			ordered = append(ordered, groupName)
+		}
+		for _, dependency := range config.Common.GroupSettings[groupName].DependsOn {
+			if _, exists := config.SoftwareGroupNodes[dependency]; !exists {
+				msg = fmt.Sprintf("%sGroup %s depends on unknown group: %s\n", msg, groupName, dependency)
+				continue
+			}
+			dependsOn[groupName] = append(dependsOn[groupName], dependency)
+		}
+	}
+	if msg != "" {
+		return ordered, errors.New(strings.TrimSuffix(msg, "\n"))
+	}
+
+	if result, err = orderByDependencies(ordered, dependsOn); err != nil {
+		return ordered, fmt.Errorf("Unable to order software groups, %v", err)
+	}
+	return
+}
+
+// orderGroupSoftware returns the software of the group in the order they're upgraded in.
+// The software keep the order they're listed in software_group, except that each software
+// comes after the software in the same group it depends on.
+func (config *UpgradeConfig) orderGroupSoftware(groupName string) (result []string, err error) {
+	software := config.Common.SoftwareGroup[groupName]
+	dependsOn := make(map[string][]string)
+	var msg string
+	for _, softwareName := range software {
+		for _, dependency := range config.Software[softwareName].DependsOn {
+			if _, exists := config.Software[dependency]; !exists {
+				msg = fmt.Sprintf("%sSoftware %s depends on unknown software: %s\n", msg, softwareName, dependency)
+				continue
+			}
+			dependsOn[softwareName] = append(dependsOn[softwareName], dependency)
+		}
+	}
+	if msg != "" {
+		return software, errors.New(strings.TrimSuffix(msg, "\n"))
+	}
+	if result, err = orderByDependencies(software, dependsOn); err != nil {
+		return software, fmt.Errorf("Unable to order software in group %s, %v", groupName, err)
+	}
+	return
+}
+
+// VerifyOrder verifies that the software groups, and the software within each group, can be
+// ordered as specified by group_order and depends_on. If this is true, error is nil.
+func (config *UpgradeConfig) VerifyOrder() (err error) {
+	var msg string
+	groupNames, err := config.orderGroupNames()
+	if err != nil {
+		msg = fmt.Sprintf("%s%v\n", msg, err)
+	}
+	for _, groupName := range groupNames {
+		if _, err := config.orderGroupSoftware(groupName); err != nil {
+			msg = fmt.Sprintf("%s%v\n", msg, err)
+		}
+	}
+	if msg != "" {
+		err = errors.New(strings.TrimSuffix(msg, "\n"))
+	} else {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestOrderByDependencies(t *testing.T) {
+	tests := []struct {
+		name      string
+		items     []string
+		dependsOn map[string][]string
+		expected  []string
+		expectErr bool
+	}{
+		{"no dependencies", []string{"c", "a", "b"}, nil, []string{"c", "a", "b"}, false},
+		{"dependency moves item", []string{"quorum", "constellation"},
+			map[string][]string{"quorum": {"constellation"}}, []string{"constellation", "quorum"}, false},
+		{"stable", []string{"a", "b", "c", "d"},
+			map[string][]string{"b": {"d"}}, []string{"a", "c", "d", "b"}, false},
+		{"unknown dependency ignored", []string{"vault"},
+			map[string][]string{"vault": {"consul"}}, []string{"vault"}, false},
+		{"cycle", []string{"a", "b", "c"},
+			map[string][]string{"a": {"c"}, "c": {"b"}, "b": {"a"}}, nil, true},
+		{"self dependency", []string{"a"}, map[string][]string{"a": {"a"}}, nil, true},
+	}
+	for _, test := range tests {
+		result, err := orderByDependencies(test.items, test.dependsOn)
+		if (err != nil) != test.expectErr {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.expectErr && !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("%s: expected %v, got: %v", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestUpgradeConfig_GetGroupNames(t *testing.T) {
+	var config UpgradeConfig
+	data := []byte(`{
+		"common": {
+			"software_group": {
+				"VaultServers": ["vault", "consul"],
+				"Bootnodes": ["bootnode"],
+				"Quorum-Makers": ["quorum", "constellation"],
+				"Observers": ["quorum"]
+			},
+			"group_order": ["Bootnodes", "VaultServers"],
+			"group_settings": {"Observers": {"depends_on": ["Quorum-Makers"]}}
+		},
+		"software": {
+			"vault": {"depends_on": ["consul"]},
+			"consul": {},
+			"bootnode": {},
+			"quorum": {"depends_on": ["constellation"]},
+			"constellation": {}
+		},
+		"groupnodes": {
+			"VaultServers": ["node1"],
+			"Bootnodes": ["node2"],
+			"Quorum-Makers": ["node3"],
+			"Observers": ["node4"]
+		}
+	}`)
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+	if err := config.VerifyOrder(); err != nil {
+		t.Fatalf("VerifyOrder failed: %v", err)
+	}
+	expected := []string{"Bootnodes", "VaultServers", "Quorum-Makers", "Observers"}
+	for i := 0; i < 10; i++ { // map iteration order must not affect the result
+		if result := config.GetGroupNames(); !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected groups: %v, got: %v", expected, result)
+		}
+	}
+	if result := config.GetGroupSoftware("VaultServers"); !reflect.DeepEqual(result, []string{"consul", "vault"}) {
+		t.Fatalf("Expected consul before vault, got: %v", result)
+	}
+	// quorum depends on constellation, which isn't part of the Observers group
+	if result := config.GetGroupSoftware("Observers"); !reflect.DeepEqual(result, []string{"quorum"}) {
+		t.Fatalf("Expected quorum, got: %v", result)
+	}
+
+	config.Common.GroupSettings["Bootnodes"] = GroupSettings{DependsOn: []string{"VaultServers"}}
+	if err := config.VerifyOrder(); err == nil {
+		t.Fatal("VerifyOrder should reject depends_on contradicting group_order")
+	}
+	delete(config.Common.GroupSettings, "Bootnodes")
+
+	config.Common.GroupOrder = []string{"Bootnodes", "Unknown"}
+	if err := config.VerifyOrder(); err == nil {
+		t.Fatal("VerifyOrder should reject unknown groups in group_order")
+	}
+	config.Common.GroupOrder = nil
+
+	config.Software["consul"] = UpgradeInfo{DependsOn: []string{"vault"}}
+	if err := config.VerifyOrder(); err == nil {
+		t.Fatal("VerifyOrder should reject the cycle between vault and consul")
+	}
+}
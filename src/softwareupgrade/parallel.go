@@ -0,0 +1,27 @@
+package softwareupgrade
+
+import "sync"
+
+// ForEachParallel calls fn for each of the items, with at most maxParallel calls running at the same time.
+// The items are started in order, and ForEachParallel returns once all the calls have returned.
+func ForEachParallel(items []string, maxParallel int, fn func(item string)) {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < maxParallel && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				fn(item)
+			}
+		}()
+	}
+	for _, item := range items {
+		work <- item
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,58 @@
+package softwareupgrade
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachParallel(t *testing.T) {
+	items := []string{"node1", "node2", "node3", "node4", "node5", "node6", "node7"}
+	var running, maxRunning int32
+	var mutex sync.Mutex
+	seen := make(map[string]bool)
+	ForEachParallel(items, 3, func(item string) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mutex.Lock()
+		seen[item] = true
+		if current > maxRunning {
+			maxRunning = current
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	})
+	if len(seen) != len(items) {
+		t.Fatalf("Expected %d items to be processed, but got: %d", len(items), len(seen))
+	}
+	if maxRunning > 3 {
+		t.Fatalf("Expected at most 3 items to be processed at the same time, but got: %d", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Fatalf("Expected items to be processed concurrently, but at most %d ran at the same time", maxRunning)
+	}
+
+	ForEachParallel(nil, 3, func(item string) {
+		t.Fatal("No items should be processed")
+	})
+}
+
+func TestFailedUpgradeInfo_Concurrent(t *testing.T) {
+	info := NewFailedUpgradeInfo()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			info.AddNodeSoftware(node, "s1")
+			info.AddNodeSoftware(node, "s2")
+			info.RemoveNodeSoftware(node, "s1")
+			info.ExistsNodeSoftware(node, "s2")
+		}(IntToStr(i))
+	}
+	wg.Wait()
+	if count := info.GetCount(); count != 20 {
+		t.Fatalf("Expected 20 node software, but got: %d", count)
+	}
+}
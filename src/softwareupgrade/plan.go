@@ -0,0 +1,225 @@
+package softwareupgrade
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type (
+	// Plan contains the steps that an upgrade would run, without running them
+	Plan struct {
+		Groups []GroupPlan `json:"groups"`
+	}
+
+	// GroupPlan contains the steps for the nodes of a software group, in the order the nodes are processed
+	GroupPlan struct {
+		Name           string     `json:"name"`
+		Software       []string   `json:"software"`
+		MaxParallel    int        `json:"max_parallel"`
+		MaxUnavailable int        `json:"max_unavailable,omitempty"`
+		CanaryNodes    []string   `json:"canary_nodes,omitempty"`
+		Nodes          []NodePlan `json:"nodes"`
+	}
+
+	// NodePlan contains the steps for upgrading a software on a node
+	NodePlan struct {
+		Node      string     `json:"node"`
+		Software  string     `json:"software"`
+		OnFailure string     `json:"on_failure"`
+		Files     []FilePlan `json:"files"`
+		UpToDate  bool       `json:"up_to_date"`
+		Error     string     `json:"error,omitempty"` // why the remote files couldn't be compared
+		Steps     []PlanStep `json:"steps"`
+	}
+
+	// FilePlan compares a local file with the remote file it replaces
+	FilePlan struct {
+		Local      string `json:"local"`
+		Remote     string `json:"remote"`
+		LocalHash  string `json:"local_sha256"`
+		RemoteHash string `json:"remote_sha256,omitempty"`
+		Status     string `json:"status"` // changed, unchanged, missing, or unknown if the remote file wasn't read
+	}
+
+	// PlanStep is a single step, with the command it runs, if any
+	PlanStep struct {
+		Step    string `json:"step"`
+		Command string `json:"command"`
+	}
+)
+
+// file statuses in a plan
+const (
+	CPlanFileChanged   string = "changed"
+	CPlanFileUnchanged string = "unchanged"
+	CPlanFileMissing   string = "missing"
+	CPlanFileUnknown   string = "unknown"
+)
+
+// NewPlan returns the steps an upgrade would run, in the order they'd run.
+// If readRemote is true, the remote files are hashed, which connects to the nodes, but doesn't
+// modify them. Unknown host keys are not recorded, even if ssh_host_key_check is tofu.
+func (config *UpgradeConfig) NewPlan(defaultMaxParallel int, readRemote bool) (result *Plan) {
+	result = &Plan{}
+	for _, groupName := range config.GetGroupNames() {
+		canaries, remaining := config.GetGroupCanaries(groupName)
+		groupPlan := GroupPlan{
+			Name:           groupName,
+			Software:       config.GetGroupSoftware(groupName),
+			MaxParallel:    config.GetGroupMaxParallel(groupName, defaultMaxParallel),
+			MaxUnavailable: config.GetGroupMaxUnavailable(groupName),
+			CanaryNodes:    canaries,
+		}
+		for _, node := range append(canaries, remaining...) {
+			for _, software := range groupPlan.Software {
+				nodeInfo := config.GetNodeUpgradeInfo(node, software)
+				var sshConfig *SSHConfig
+				if readRemote {
+					sshConfig = nodeInfo.NewSSHConfig(node)
+					sshConfig.disableTrustOnFirstUse()
+				}
+				groupPlan.Nodes = append(groupPlan.Nodes, nodeInfo.newNodePlan(sshConfig, node, software))
+			}
+		}
+		result.Groups = append(result.Groups, groupPlan)
+	}
+	return
+}
+
+// newNodePlan compares the files, and renders the steps for the software on the node.
+// If sshConfig is nil, the remote files are not read.
+func (nodeInfo *NodeInfoContainer) newNodePlan(sshConfig *SSHConfig, node, software string) (result NodePlan) {
+	result = NodePlan{Node: node, Software: software, OnFailure: nodeInfo.OnFailure}
+	upToDate := sshConfig != nil
+	for _, upgradeStruct := range nodeInfo.getCopyEntries() {
+		filePlan := FilePlan{Local: upgradeStruct.SourceFilePath, Remote: upgradeStruct.DestFilePath, Status: CPlanFileUnknown}
+		var err error
+		if filePlan.LocalHash, err = getSourceFileHash(upgradeStruct.SourceFilePath); err != nil {
+			result.Error = fmt.Sprintf("unable to hash %s: %v", upgradeStruct.SourceFilePath, err)
+		}
+		if sshConfig != nil && result.Error == "" {
+			var exists bool
+			if exists, err = internalExists(sshConfig, "", "e", upgradeStruct.DestFilePath); err != nil {
+				result.Error = err.Error()
+			} else if !exists {
+				filePlan.Status = CPlanFileMissing
+			} else if filePlan.RemoteHash, err = hashRemoteFile(sshConfig, CVerifySHA256, upgradeStruct.DestFilePath); err != nil {
+				result.Error = fmt.Sprintf("unable to hash %s: %v", upgradeStruct.DestFilePath, err)
+			} else if filePlan.RemoteHash == filePlan.LocalHash {
+				filePlan.Status = CPlanFileUnchanged
+			} else {
+				filePlan.Status = CPlanFileChanged
+			}
+		}
+		upToDate = upToDate && filePlan.Status == CPlanFileUnchanged
+		result.Files = append(result.Files, filePlan)
+	}
+	// the same check as IsUpToDate, where the upgrade is skipped
+	result.UpToDate = upToDate && len(result.Files) > 0
+	if !result.UpToDate {
+		result.Steps = nodeInfo.getPlanSteps()
+	}
+	return
+}
+
+// getPlanSteps renders the steps run by the upgrade, in the same order as RunUpgrade
+func (nodeInfo *NodeInfoContainer) getPlanSteps() (result []PlanStep) {
+	add := func(step, command string) {
+		result = append(result, PlanStep{step, command})
+	}
+	add("stop", nodeInfo.StopCmd)
+	for _, upgradeStruct := range nodeInfo.getCopyEntries() {
+		for _, cmd := range nodeInfo.PreUpgrade {
+			add("pre-upgrade", cmd)
+		}
+		stagingPath := getStagingPath(upgradeStruct.DestFilePath)
+		add("copy", fmt.Sprintf("%s %s to %s", nodeInfo.getTransferDescription(), upgradeStruct.SourceFilePath, stagingPath))
+		add("verify", fmt.Sprintf("sudo %ssum %s", upgradeStruct.VerifyCopy, ShellQuote(stagingPath)))
+		owner := upgradeStruct.UserGroup
+		if owner == "" {
+			owner = fmt.Sprintf("<owner of %s>", upgradeStruct.DestFilePath)
+		}
+		add("chown", getChownCommand(stagingPath, owner))
+		if cmd, err := getBackupCommand(upgradeStruct, backupSuffix); err == nil {
+			add("backup", cmd+" # if "+upgradeStruct.DestFilePath+" exists")
+		} else {
+			add("backup", err.Error())
+		}
+		add("promote", getPromoteCommand(stagingPath, upgradeStruct.DestFilePath))
+		for _, cmd := range nodeInfo.PostUpgrade {
+			add("post-upgrade", cmd)
+		}
+	}
+	for _, cmd := range nodeInfo.Exec {
+		add("exec", cmd)
+	}
+	add("start", nodeInfo.StartCmd)
+	for _, check := range nodeInfo.HealthChecks {
+		add("health-check", check.String())
+	}
+	return
+}
+
+func (nodeInfo *NodeInfoContainer) getTransferDescription() string {
+	switch {
+	case nodeInfo.ResumableTransfer:
+		{
+			return "resumable transfer of"
+		}
+	case strings.ToLower(nodeInfo.TransferProtocol) == CTransferSFTP:
+		{
+			return "sftp"
+		}
+	}
+	return "scp"
+}
+
+// WriteText writes the plan in a human readable format
+func (plan *Plan) WriteText(w io.Writer) (err error) {
+	var b bytes.Buffer
+	for _, group := range plan.Groups {
+		fmt.Fprintf(&b, "Software group: %s (%s), %d node(s) at a time", group.Name, strings.Join(group.Software, ", "), group.MaxParallel)
+		if group.MaxUnavailable > 0 {
+			fmt.Fprintf(&b, ", at most %d unavailable", group.MaxUnavailable)
+		}
+		b.WriteString("\n")
+		if len(group.CanaryNodes) > 0 {
+			fmt.Fprintf(&b, "  Canary node(s): %s\n", strings.Join(group.CanaryNodes, ", "))
+		}
+		for _, nodePlan := range group.Nodes {
+			fmt.Fprintf(&b, "  Node: %s, software: %s, on failure: %s\n", nodePlan.Node, nodePlan.Software, nodePlan.OnFailure)
+			for _, file := range nodePlan.Files {
+				fmt.Fprintf(&b, "    %s -> %s: %s\n", file.Local, file.Remote, file.Status)
+				fmt.Fprintf(&b, "      local sha256:  %s\n", file.LocalHash)
+				if file.RemoteHash != "" {
+					fmt.Fprintf(&b, "      remote sha256: %s\n", file.RemoteHash)
+				}
+			}
+			if nodePlan.Error != "" {
+				fmt.Fprintf(&b, "    error: %s\n", nodePlan.Error)
+			}
+			if nodePlan.UpToDate {
+				b.WriteString("    already up to date, skipped\n")
+				continue
+			}
+			for i, step := range nodePlan.Steps {
+				fmt.Fprintf(&b, "    %2d. %-12s %s\n", i+1, step.Step, step.Command)
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err = b.WriteTo(w)
+	return
+}
+
+// disableTrustOnFirstUse verifies host keys strictly, instead of recording unknown host keys,
+// for this host, and the jump hosts it's reached through.
+func (sshConfig *SSHConfig) disableTrustOnFirstUse() {
+	for s := sshConfig; s != nil; s = s.jumpHost {
+		if s.hostKeyCheck == CHostKeyCheckTOFU {
+			s.hostKeyCheck = CHostKeyCheckStrict
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package softwareupgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeConfig_NewPlan(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	sourceFile := filepath.Join(tempdir, "geth")
+	SaveDataToFile(sourceFile, []byte("hello"))
+
+	var config UpgradeConfig
+	data := []byte(fmt.Sprintf(`{
+		"common": {
+			"software_group": {"makers": ["quorum"]},
+			"group_settings": {"makers": {"canary_nodes": ["node2"], "max_parallel": 2}}
+		},
+		"software": {
+			"quorum": {
+				"start": "sudo supervisorctl start quorum",
+				"stop": "sudo supervisorctl stop quorum",
+				"preupgrade": ["echo pre"],
+				"Copy": {"1": {"Local_Filename": %q, "Remote_Filename": "/usr/local/bin/geth", "UserGroup": "ubuntu:ubuntu", "BackupStrategy": "move"}},
+				"Exec": ["sudo systemctl daemon-reload"],
+				"health_checks": [{"type": "process", "process": "geth"}]
+			}
+		},
+		"groupnodes": {"makers": ["node1", "node2"]}
+	}`, sourceFile))
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	plan := config.NewPlan(1, false)
+	if len(plan.Groups) != 1 || plan.Groups[0].MaxParallel != 2 {
+		t.Fatalf("Unexpected groups: %+v", plan.Groups)
+	}
+	nodes := plan.Groups[0].Nodes
+	if len(nodes) != 2 || nodes[0].Node != "node2" || nodes[1].Node != "node1" {
+		t.Fatalf("Expected the canary node2 to be planned first, got: %+v", nodes)
+	}
+
+	nodePlan := nodes[0]
+	// sha256sum of "hello"
+	if file := nodePlan.Files[0]; file.LocalHash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" || file.Status != CPlanFileUnknown {
+		t.Fatalf("Unexpected file plan: %+v", file)
+	}
+	var steps []string
+	for _, step := range nodePlan.Steps {
+		steps = append(steps, step.Step)
+	}
+	expected := []string{"stop", "pre-upgrade", "copy", "verify", "chown", "backup", "promote", "exec", "start", "health-check"}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("Expected steps: %v, got: %v", expected, steps)
+	}
+	if cmd := nodePlan.Steps[4].Command; cmd != "sudo chown ubuntu:ubuntu /usr/local/bin/.geth.staging" {
+		t.Fatalf("Unexpected chown command: %s", cmd)
+	}
+	if cmd := nodePlan.Steps[6].Command; cmd != "sudo mv -f /usr/local/bin/.geth.staging /usr/local/bin/geth" {
+		t.Fatalf("Unexpected promote command: %s", cmd)
+	}
+
+	var b bytes.Buffer
+	if err := plan.WriteText(&b); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	for _, expected := range []string{"Software group: makers (quorum), 2 node(s) at a time", "Canary node(s): node2",
+		"1. stop         sudo supervisorctl stop quorum", "health-check process geth"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Fatalf("Expected the plan to contain %q, got:\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestNodeInfoContainer_newNodePlanUpToDate(t *testing.T) {
+	nodeInfo := &NodeInfoContainer{}
+	nodeInfo.StopCmd = "stop"
+	nodeInfo.Copy = map[string]UpgradeStruct{"0": {SourceFilePath: "/nonexistent/geth", DestFilePath: "/usr/local/bin/geth"}}
+	nodePlan := nodeInfo.newNodePlan(nil, "node1", "quorum")
+	if nodePlan.UpToDate || nodePlan.Error == "" || len(nodePlan.Steps) == 0 {
+		t.Fatalf("A missing source file should be reported, and the steps planned, got: %+v", nodePlan)
+	}
+}
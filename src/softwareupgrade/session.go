@@ -18,3 +18,9 @@ func init() {
 func GetBackupSuffix() string {
 	return backupSuffix
 }
+
+// SetBackupSuffix sets the backup suffix, eg, to continue backing up files
+// with the suffix of the session being resumed
+func SetBackupSuffix(suffix string) {
+	backupSuffix = suffix
+}
@@ -0,0 +1,222 @@
+package softwareupgrade
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type (
+	// SessionRecord records a session, so that past sessions can be listed, and rolled back by their ID
+	SessionRecord struct {
+		ID         string    `json:"id"` // the backup suffix of the session
+		Mode       string    `json:"mode"`
+		Config     string    `json:"config"`
+		ConfigHash string    `json:"config_hash"` // SHA256 hash of the configuration file
+		Start      time.Time `json:"start"`
+		End        time.Time `json:"end"`
+		Succeeded  int       `json:"succeeded"` // the number of nodes processed successfully
+		Failed     int       `json:"failed"`    // the number of nodes that failed
+
+		RollbackFilename    string `json:"rollback_filename"`
+		FailedNodesFilename string `json:"failed_nodes_filename"`
+		JournalFilename     string `json:"journal_filename"`
+
+		Touched         map[string][]string `json:"touched"`          // the files replaced on each node, keyed by node
+		TargetSession   string              `json:"target_session"`   // the session rolled back, by a rollback or delete-rollback
+		RolledBack      bool                `json:"rolled_back"`      // the files replaced by the session have been restored
+		RollbackDeleted bool                `json:"rollback_deleted"` // the backups of the session have been deleted
+
+		mutex sync.Mutex // nodes are processed concurrently
+	}
+
+	// SessionStore is a directory that contains the records and the files of past sessions
+	SessionStore struct {
+		dir string
+	}
+)
+
+// NewSessionStore returns the session store in the given directory, creating the directory if it doesn't exist
+func NewSessionStore(dir string) (result *SessionStore, err error) {
+	if expandedDir, err := Expand(dir); err == nil {
+		dir = expandedDir
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create session directory %s: %v", dir, err)
+	}
+	return &SessionStore{dir: dir}, nil
+}
+
+// NewSessionRecord creates the record of a session with the given ID, running in the given mode
+// with the given configuration
+func NewSessionRecord(id, mode, configFilename string, configContents []byte) *SessionRecord {
+	hash := sha256.Sum256(configContents)
+	return &SessionRecord{ID: id, Mode: mode, Config: configFilename, ConfigHash: hex.EncodeToString(hash[:]),
+		Start: time.Now().UTC(), Touched: make(map[string][]string)}
+}
+
+// Filename returns the path of the given file in the session store
+func (store *SessionStore) Filename(name string) string {
+	return filepath.Join(store.dir, name)
+}
+
+func (store *SessionStore) recordFilename(id string) string {
+	return store.Filename(fmt.Sprintf("%s.json", id))
+}
+
+// Load loads the record of the session with the given ID.
+// The error returned for a session without a record wraps os.ErrNotExist.
+func (store *SessionStore) Load(id string) (result *SessionRecord, err error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid session ID: %s", id)
+	}
+	data, err := ioutil.ReadFile(store.recordFilename(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("session %s doesn't exist: %w", id, err)
+		}
+		return nil, err
+	}
+	result = &SessionRecord{}
+	if err = json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("unable to parse session %s: %v", id, err)
+	}
+	return
+}
+
+// Save saves the record of the session. The record is written to a temporary file, which then
+// replaces the record, so that a session that's killed while saving its record doesn't corrupt it.
+func (store *SessionStore) Save(record *SessionRecord) (err error) {
+	record.mutex.Lock()
+	data, err := json.MarshalIndent(record, "", "  ")
+	record.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	filename := store.recordFilename(record.ID)
+	tempFilename := filename + ".tmp"
+	if err = ioutil.WriteFile(tempFilename, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFilename, filename)
+}
+
+// List returns the records of all the sessions in the store, the oldest first
+func (store *SessionStore) List() (result []*SessionRecord, err error) {
+	matches, err := filepath.Glob(store.recordFilename("*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		record, err := store.Load(strings.TrimSuffix(filepath.Base(match), ".json"))
+		if err != nil {
+			DebugLog.Println("Ignoring session record %s: %v", match, err)
+			continue
+		}
+		result = append(result, record)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return
+}
+
+// FindConflicts returns the sessions newer than the given session that replaced any of the files it
+// replaced, and haven't been rolled back. Rolling back the session would undo the changes of these sessions.
+func (store *SessionStore) FindConflicts(record *SessionRecord) (result []*SessionRecord, err error) {
+	records, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range records {
+		if other.ID == record.ID || !other.Start.After(record.Start) || other.RolledBack {
+			continue
+		}
+		if record.touchesSameFiles(other) {
+			result = append(result, other)
+		}
+	}
+	return
+}
+
+func (record *SessionRecord) touchesSameFiles(other *SessionRecord) bool {
+	for node, files := range record.Touched {
+		for _, file := range files {
+			for _, otherFile := range other.Touched[node] {
+				if file == otherFile {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// AddTouchedFiles records the files replaced on the node
+func (record *SessionRecord) AddTouchedFiles(node string, files []string) {
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+	if record.Touched == nil {
+		record.Touched = make(map[string][]string)
+	}
+	touched := make(map[string]bool)
+	for _, file := range record.Touched[node] {
+		touched[file] = true
+	}
+	for _, file := range files {
+		if !touched[file] {
+			touched[file] = true
+			record.Touched[node] = append(record.Touched[node], file)
+		}
+	}
+}
+
+// AddNodeResult counts a node processed by the session
+func (record *SessionRecord) AddNodeResult(failed bool) {
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+	if failed {
+		record.Failed++
+	} else {
+		record.Succeeded++
+	}
+}
+
+// WriteSessions writes the records of the sessions as a table
+func WriteSessions(w io.Writer, records []*SessionRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMODE\tCONFIG HASH\tSTART\tEND\tSUCCEEDED\tFAILED\tSTATUS")
+	for _, record := range records {
+		var end, status string
+		if !record.End.IsZero() {
+			end = record.End.Local().Format(time.RFC3339)
+		}
+		switch {
+		case record.RolledBack:
+			{
+				status = "rolled back"
+			}
+		case record.RollbackDeleted:
+			{
+				status = "rollback deleted"
+			}
+		case record.TargetSession != "":
+			{
+				status = fmt.Sprintf("of %s", record.TargetSession)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\t%s\t%d\t%d\t%s\n", record.ID, record.Mode, record.ConfigHash,
+			record.Start.Local().Format(time.RFC3339), end, record.Succeeded, record.Failed, status)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,84 @@
+package softwareupgrade
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStore(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	store, err := NewSessionStore(tempdir)
+	if err != nil {
+		t.Fatalf("Unable to create session store: %v", err)
+	}
+
+	config := []byte(`{"common": {}}`)
+	start := time.Now().UTC().Add(-time.Hour)
+	older := NewSessionRecord("2019-01-01T00-00-00Z", "upgrade", "/tmp/upgrade.json", config)
+	older.Start = start
+	older.AddTouchedFiles("node1", []string{"/usr/local/bin/geth", "/usr/local/bin/bootnode"})
+	older.AddTouchedFiles("node1", []string{"/usr/local/bin/geth"})
+	older.AddNodeResult(false)
+	older.AddNodeResult(true)
+
+	newer := NewSessionRecord("2019-01-02T00-00-00Z", "upgrade", "/tmp/upgrade.json", config)
+	newer.Start = start.Add(time.Minute)
+	newer.AddTouchedFiles("node2", []string{"/usr/local/bin/geth"})
+
+	for _, record := range []*SessionRecord{newer, older} {
+		if err := store.Save(record); err != nil {
+			t.Fatalf("Unable to save session: %v", err)
+		}
+	}
+
+	loaded, err := store.Load(older.ID)
+	if err != nil {
+		t.Fatalf("Unable to load session: %v", err)
+	}
+	if loaded.Succeeded != 1 || loaded.Failed != 1 || loaded.ConfigHash != newer.ConfigHash ||
+		!reflect.DeepEqual(loaded.Touched["node1"], []string{"/usr/local/bin/geth", "/usr/local/bin/bootnode"}) {
+		t.Fatalf("Unexpected session: %+v", loaded)
+	}
+	if _, err := store.Load("../" + older.ID); err == nil {
+		t.Fatal("A session ID with a path shouldn't be loaded")
+	}
+
+	records, err := store.List()
+	if err != nil || len(records) != 2 || records[0].ID != older.ID || records[1].ID != newer.ID {
+		t.Fatalf("Expected the sessions, oldest first, got: %v, error: %v", records, err)
+	}
+
+	// the newer session replaced a file on another node
+	if conflicts, _ := store.FindConflicts(older); len(conflicts) != 0 {
+		t.Fatalf("Expected no conflicts, got: %d", len(conflicts))
+	}
+	newer.AddTouchedFiles("node1", []string{"/usr/local/bin/bootnode"})
+	store.Save(newer)
+	if conflicts, _ := store.FindConflicts(older); len(conflicts) != 1 || conflicts[0].ID != newer.ID {
+		t.Fatalf("Expected the newer session to conflict, got: %v", conflicts)
+	}
+	if conflicts, _ := store.FindConflicts(newer); len(conflicts) != 0 {
+		t.Fatal("An older session shouldn't conflict")
+	}
+	newer.RolledBack = true
+	store.Save(newer)
+	if conflicts, _ := store.FindConflicts(older); len(conflicts) != 0 {
+		t.Fatal("A session that's been rolled back shouldn't conflict")
+	}
+
+	var b bytes.Buffer
+	WriteSessions(&b, records)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], older.ID) || !strings.Contains(lines[1], older.ConfigHash[:12]) {
+		t.Fatalf("Unexpected sessions table:\n%s", b.String())
+	}
+}
@@ -1,6 +1,7 @@
 package softwareupgrade
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -22,14 +24,41 @@ type (
 	// SSHConfig is used to carry the username, privatekey and the host to connect to.
 	SSHConfig struct {
 		user              string
-		privateKey        string
 		HostIPOrAddr      string
+		port              int
 		RemoteOS          string
 		session           *ssh.Session
 		client            *ssh.Client
 		autoOpenSession   bool
-		parsedKey         ssh.Signer
 		keepAliveDuration time.Duration
+		mutex             sync.Mutex // guards the client, as a jump host is shared by the nodes behind it
+
+		keyFilenames   []string
+		passphraseFile string
+		useAgent       bool
+		signers        []ssh.Signer
+
+		jumpHost         *SSHConfig
+		hopSettings      *jumpHostSettings // the settings the SSHConfig was configured with as a jump host
+		transferProtocol string
+		resumable        bool
+		chunkSize        int64
+
+		hostKeyCheck        string
+		knownHostsFile      string
+		hostKeyFingerprints []string
+		hostKeyErr          error
+	}
+
+	// jumpHostSettings are the SSH settings of a jump host, which are shared by all the nodes behind it
+	jumpHostSettings struct {
+		hostKeyCheck   string
+		knownHostsFile string
+		fingerprints   []string
+		keyFilename    string
+		passphraseFile string
+		useAgent       bool
+		jumpHost       *SSHConfig
 	}
 
 	// ResProcessStatus provides the status
@@ -40,12 +69,19 @@ type (
 )
 
 var (
-	sshConfigCache map[string]*SSHConfig
-	sshTimeout     time.Duration
+	sshConfigCache      map[string]*SSHConfig
+	sshConfigCacheMutex sync.Mutex
+	sshTimeout          time.Duration
 )
 
 // EnsureSSHConfigCache initializes the sshConfigCache so it can be used to cache SSHConfig
 func EnsureSSHConfigCache() {
+	sshConfigCacheMutex.Lock()
+	defer sshConfigCacheMutex.Unlock()
+	ensureSSHConfigCache()
+}
+
+func ensureSSHConfigCache() {
 	if sshConfigCache == nil {
 		sshConfigCache = make(map[string]*SSHConfig)
 	}
@@ -53,6 +89,8 @@ func EnsureSSHConfigCache() {
 
 // ClearSSHConfigCache closes the SSH session and client connection in the sshConfigCache
 func ClearSSHConfigCache() {
+	sshConfigCacheMutex.Lock()
+	defer sshConfigCacheMutex.Unlock()
 	if sshConfigCache != nil {
 		for k, v := range sshConfigCache {
 			v.Close()
@@ -69,35 +107,85 @@ func NewSSHConfig(user, KeyFilename, HostIPOrAddr string) (result *SSHConfig) {
 	}
 	mapName := HostIPOrAddr + user + KeyFilename
 
-	EnsureSSHConfigCache() // guard against forgetful devs!
+	sshConfigCacheMutex.Lock()
+	defer sshConfigCacheMutex.Unlock()
+	ensureSSHConfigCache() // guard against forgetful devs!
 	result = sshConfigCache[mapName]
 	if result != nil {
 		return
 	}
 
-	privateKey := []byte{}
-	var err error
-	privateKey, err = ReadDataFromFile(KeyFilename)
+	host, port, err := SplitNodeAddress(HostIPOrAddr, CDefaultSSHPort)
+	if err != nil {
+		DebugLog.Println("%v", err)
+		host, port = HostIPOrAddr, CDefaultSSHPort
+	}
 	result = &SSHConfig{
 		user:              user,
-		HostIPOrAddr:      HostIPOrAddr,
+		HostIPOrAddr:      host,
+		port:              port,
 		keepAliveDuration: 5 * time.Second,
 	}
-	if err == nil {
-		result.privateKey = string(privateKey)
-	}
+	result.SetAuth([]string{KeyFilename}, "", true)
+	result.SetHostKeyCheck(CHostKeyCheckStrict, CDefaultKnownHosts, nil)
 	result.EnableAutoOpen()
 	sshConfigCache[mapName] = result
 	return
 }
 
-// Clear clears the privateKey, user and host stored in the configuration.
+// Clear clears the keys, user and host stored in the configuration.
 func (sshConfig *SSHConfig) Clear() {
-	sshConfig.privateKey = ""
+	sshConfig.keyFilenames = nil
+	sshConfig.signers = nil
 	sshConfig.user = ""
 	sshConfig.HostIPOrAddr = ""
 }
 
+// SetTransferProtocol sets the protocol used to copy files to the host, either scp (default) or sftp
+func (sshConfig *SSHConfig) SetTransferProtocol(protocol string) {
+	sshConfig.transferProtocol = strings.ToLower(protocol)
+}
+
+// SetResumableTransfer enables transfers that are sent in chunks of chunkSize bytes,
+// and that continue from the partially transferred file left by a previous attempt.
+func (sshConfig *SSHConfig) SetResumableTransfer(enabled bool, chunkSize int64) {
+	if chunkSize <= 0 {
+		chunkSize = CDefaultChunkSize
+	}
+	sshConfig.resumable = enabled
+	sshConfig.chunkSize = chunkSize
+}
+
+// SetPort sets the port of the SSH server on the host
+func (sshConfig *SSHConfig) SetPort(port int) {
+	sshConfig.port = port
+}
+
+// SetProxyJump specifies the host to tunnel the connection through. If jumpHost is nil,
+// the host is connected to directly.
+func (sshConfig *SSHConfig) SetProxyJump(jumpHost *SSHConfig) {
+	sshConfig.jumpHost = jumpHost
+}
+
+// configureJumpHost configures the SSHConfig as a jump host with the given settings, the first time it's called.
+// As a jump host is shared by the nodes behind it, which are connected in parallel, it's configured once,
+// under the lock, and the settings of later calls are ignored, so it isn't reconfigured while other nodes
+// connect through it.
+func (sshConfig *SSHConfig) configureJumpHost(settings jumpHostSettings) {
+	sshConfig.mutex.Lock()
+	defer sshConfig.mutex.Unlock()
+	if sshConfig.hopSettings != nil {
+		if !reflect.DeepEqual(*sshConfig.hopSettings, settings) {
+			DebugLog.Println("Jump host %s: already configured with different SSH settings, which are kept", sshConfig.HostIPOrAddr)
+		}
+		return
+	}
+	sshConfig.SetHostKeyCheck(settings.hostKeyCheck, settings.knownHostsFile, settings.fingerprints)
+	sshConfig.SetAuth([]string{settings.keyFilename}, settings.passphraseFile, settings.useAgent)
+	sshConfig.SetProxyJump(settings.jumpHost)
+	sshConfig.hopSettings = &settings
+}
+
 // SetKeepAlive sets the duration to send a keep-alive message on a SSH connection
 func (sshConfig *SSHConfig) SetKeepAlive(t time.Duration) {
 	sshConfig.keepAliveDuration = t
@@ -111,6 +199,12 @@ func (sshConfig *SSHConfig) Close() {
 
 // CloseClient closes the client that was opened implicitly during OpenSession.
 func (sshConfig *SSHConfig) CloseClient() {
+	sshConfig.mutex.Lock()
+	defer sshConfig.mutex.Unlock()
+	sshConfig.closeClient()
+}
+
+func (sshConfig *SSHConfig) closeClient() {
 	if sshConfig.client != nil {
 		sshConfig.client.Close()
 		sshConfig.client = nil
@@ -127,42 +221,133 @@ func (sshConfig *SSHConfig) CloseSession() {
 
 // Connect connects to the given host specified in the configuration
 func (sshConfig *SSHConfig) Connect() error {
-	clientConfig, err := sshConfig.getClientConfig()
+	sshConfig.mutex.Lock()
+	defer sshConfig.mutex.Unlock()
+	sshConfig.CloseSession()
+
+	err := sshConfig.connect()
 	if err != nil {
 		return err
 	}
 
-	sshConfig.CloseSession()
+	sshConfig.session, err = sshConfig.client.NewSession()
+	return err
+}
 
-	if sshConfig.client == nil {
-		sshConfig.client, err = ssh.Dial("tcp", sshConfig.HostIPOrAddr+":22", clientConfig)
-		if err != nil {
-			return err
+// getClient connects to the host, through the jump host if one is specified,
+// unless a connection has already been established, and returns the client.
+// It's safe to call concurrently, eg, for a jump host shared by several nodes.
+func (sshConfig *SSHConfig) getClient() (*ssh.Client, error) {
+	sshConfig.mutex.Lock()
+	defer sshConfig.mutex.Unlock()
+	if err := sshConfig.connect(); err != nil {
+		return nil, err
+	}
+	return sshConfig.client, nil
+}
+
+// closeClientIfSame closes the client, if it's the given client, and not one that's since reconnected.
+func (sshConfig *SSHConfig) closeClientIfSame(client *ssh.Client) {
+	sshConfig.mutex.Lock()
+	defer sshConfig.mutex.Unlock()
+	if sshConfig.client == client {
+		sshConfig.closeClient()
+	}
+}
+
+func (sshConfig *SSHConfig) connect() error {
+	if sshConfig.client != nil {
+		return nil
+	}
+
+	clientConfig, err := sshConfig.getClientConfig()
+	if err != nil {
+		return err
+	}
+
+	sshConfig.hostKeyErr = nil
+	sshConfig.client, err = sshConfig.dial(clientConfig)
+	if err != nil {
+		if sshConfig.hostKeyErr != nil {
+			return sshConfig.hostKeyErr
 		}
+		return err
+	}
 
-		// this sends keepalive packets every 5 seconds(configurable) so that the client doesn't timeout
-		// there's no useful response from these, so abort if there's an error
-		go func(client *ssh.Client) {
-			t := time.NewTicker(sshConfig.keepAliveDuration)
-			defer t.Stop()
-			for {
-				<-t.C
-				_, _, err := client.Conn.SendRequest("keepalive@golang.org", true, nil)
-				if err != nil {
-					return
-				}
+	// this sends keepalive packets every 5 seconds(configurable) so that the client doesn't timeout
+	// there's no useful response from these, so abort if there's an error
+	go func(client *ssh.Client) {
+		t := time.NewTicker(sshConfig.keepAliveDuration)
+		defer t.Stop()
+		for {
+			<-t.C
+			_, _, err := client.Conn.SendRequest("keepalive@golang.org", true, nil)
+			if err != nil {
+				return
 			}
-		}(sshConfig.client)
+		}
+	}(sshConfig.client)
+	return nil
+}
+
+func (sshConfig *SSHConfig) dial(clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := JoinHostPort(sshConfig.HostIPOrAddr, sshConfig.port)
+	if sshConfig.jumpHost == nil {
+		return ssh.Dial("tcp", addr, clientConfig)
 	}
 
-	sshConfig.session, err = sshConfig.client.NewSession()
-	return err
+	jumpHost := sshConfig.jumpHost
+	jumpClient, err := jumpHost.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to jump host %s: %w", jumpHost.HostIPOrAddr, err)
+	}
+	conn, err := jumpClient.Dial("tcp", addr)
+	if err != nil {
+		// the connection to the jump host might have been dropped, so reconnect on the next attempt,
+		// unless another node has already reconnected
+		jumpHost.closeClientIfSame(jumpClient)
+		return nil, fmt.Errorf("unable to reach %s through jump host %s: %v", addr, jumpHost.HostIPOrAddr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 // Copy copies the contents of the specified io.Reader to the given remote location.
 // Requires a session to be opened already, unless autoOpenSession is set in the SSHConfig, in which case, Copy connects to the specified host given in the SSHConfig.
 // permissions is a string, like 0644, or 0700, etc.
+// The file is transferred using the protocol set by SetTransferProtocol, scp by default.
 func (sshConfig *SSHConfig) Copy(reader io.Reader, remotePath string, permissions string, size int64) (err error) {
+	if len(permissions) != 4 {
+		return errors.New("permissions need to be 4 characters")
+	}
+
+	filename := path.Base(remotePath)
+	if filename == "" {
+		return errors.New("Remote filename is empty")
+	}
+
+	switch sshConfig.transferProtocol {
+	case "", CTransferSCP:
+		{
+			return sshConfig.scpCopy(reader, remotePath, permissions, size)
+		}
+	case CTransferSFTP:
+		{
+			return sshConfig.sftpCopy(reader, remotePath, permissions, size)
+		}
+	default:
+		{
+			return fmt.Errorf("unknown transfer protocol: %s", sshConfig.transferProtocol)
+		}
+	}
+}
+
+// scpCopy copies the contents of the reader by running scp in sink mode on the host.
+func (sshConfig *SSHConfig) scpCopy(reader io.Reader, remotePath string, permissions string, size int64) (err error) {
 	if sshConfig.session == nil {
 		if !sshConfig.autoOpenSession {
 			panic("No SSH session opened.")
@@ -172,42 +357,69 @@ func (sshConfig *SSHConfig) Copy(reader io.Reader, remotePath string, permission
 			return err
 		}
 	}
-	if len(permissions) != 4 {
-		return errors.New("permissions need to be 4 characters")
-	}
+	session := sshConfig.session
+	defer sshConfig.CloseSession() // A session only accepts one call to Run/Shell, etc, so close the session
 
 	filename := path.Base(remotePath)
-	if filename == "" {
-		return errors.New("Remote filename is empty")
+	directory := path.Dir(remotePath)
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
 	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
 
-	directory := path.Dir(remotePath)
+	if err = session.Start("sudo /usr/bin/scp -t " + ShellQuote(directory)); err != nil {
+		return err
+	}
 
-	var (
-		wg           sync.WaitGroup
-		writtenCount int64
-	)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		w, _ := sshConfig.session.StdinPipe()
+	// Each message sent to scp is acknowledged with a 0 byte, or an error message
+	err = func() error {
 		defer w.Close()
-		fmt.Fprintln(w, "C"+permissions, size, filename)
-		writtenCount, err = io.Copy(w, reader)
+		if err := readSCPAck(r); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "C%s %d %s\n", permissions, size, filename)
+		if err := readSCPAck(r); err != nil {
+			return err
+		}
+		writtenCount, err := io.Copy(w, reader)
+		if err != nil {
+			return err
+		}
 		if writtenCount != size {
-			// some error here
-			msg := fmt.Sprintf("Copied size: %d not equal to file size: %d", writtenCount, size)
-			err = errors.New(msg)
+			return fmt.Errorf("Copied size: %d not equal to file size: %d", writtenCount, size)
 		}
-		fmt.Fprintln(w, "\x00")  // Send 0 byte to indicate EOF
-		sshConfig.CloseSession() // A session only accepts one call to Run/Shell, etc, so close the session
+		w.Write([]byte{0}) // Send 0 byte to indicate EOF
+		return readSCPAck(r)
 	}()
 
-	sshConfig.session.Run("sudo /usr/bin/scp -t " + directory)
-	wg.Wait() // waits for the coroutine to complete
+	waitErr := session.Wait()
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("scp to %s failed: %v %s", remotePath, waitErr, strings.TrimSpace(stderr.String()))
+	}
 	return err
 }
 
+// readSCPAck reads the response of scp to the last message sent to it
+func readSCPAck(r io.Reader) error {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("scp: no acknowledgement received: %v", err)
+	}
+	if buf[0] == 0 {
+		return nil
+	}
+	// 1 is a warning, 2 is a fatal error, both followed by a message terminated by a newline
+	msg, _ := bufio.NewReader(r).ReadString('\n')
+	return fmt.Errorf("scp: %s", strings.TrimSpace(msg))
+}
+
 // CopyFile copies the contents of an io.Reader to a remote location, the length is determined by reading the io.Reader until EOF is reached.
 // if the file length is known in advance, use "Copy" instead.
 func (sshConfig *SSHConfig) CopyFile(fileReader io.Reader, remotePath string, permissions string) error {
@@ -240,6 +452,9 @@ func (sshConfig *SSHConfig) CopyLocalFileToRemoteFile(localFilename, remoteFilen
 		return err
 	}
 	defer file.Close()
+	if sshConfig.resumable {
+		return sshConfig.resumableCopy(file, remoteFilename, permissions)
+	}
 	err = sshConfig.CopyFromFile(*file, remoteFilename, permissions)
 	return err
 }
@@ -251,7 +466,7 @@ func (sshConfig *SSHConfig) CreateDirectory(path string) (err error) {
 	return
 }
 
-// Destroy closes the connection to the client and clears the privatKey, user and host stored in the configuration.
+// Destroy closes the connection to the client and clears the keys, user and host stored in the configuration.
 func (sshConfig *SSHConfig) Destroy() {
 	sshConfig.Close()
 	sshConfig.Clear()
@@ -288,24 +503,15 @@ func (sshConfig *SSHConfig) FileExists(file string) (result bool, err error) {
 }
 
 func (sshConfig *SSHConfig) getClientConfig() (*ssh.ClientConfig, error) {
-	var key ssh.Signer
-	if sshConfig.parsedKey == nil {
-		var err error
-		key, err = ssh.ParsePrivateKey([]byte(sshConfig.privateKey))
-		if err != nil {
-			return nil, err
-		}
-		sshConfig.parsedKey = key
-	} else {
-		key = sshConfig.parsedKey
+	authMethods, err := sshConfig.getAuthMethods()
+	if err != nil {
+		return nil, err
 	}
 	// Authentication
 	config := &ssh.ClientConfig{
-		User: sshConfig.user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:            sshConfig.user,
+		Auth:            authMethods,
+		HostKeyCallback: sshConfig.getHostKeyCallback(),
 	}
 	if sshTimeout != 0 {
 		config.Timeout = sshTimeout
@@ -328,21 +534,21 @@ func (sshConfig *SSHConfig) GetOS() string {
 
 // getFileOwnership returns the user and group of the specified filename like so:
 // user:group
-func (sshConfig *SSHConfig) getFileOwnership(filename string) (owner string, err error) {
+func getFileOwnership(runner Runner, filename string) (owner string, err error) {
 	cmd := fmt.Sprintf("stat --printf=%%U:%%G %s", filename)
-	owner, err = sshConfig.Run(cmd)
+	owner, err = runner.Run(cmd)
 	return
 }
 
-func (sshConfig *SSHConfig) getFilePermissions(filename string) (permissions string, err error) {
+func getFilePermissions(runner Runner, filename string) (permissions string, err error) {
 	cmd := fmt.Sprintf("stat -c%%04a %s", filename)
-	permissions, err = sshConfig.Run(cmd)
+	permissions, err = runner.Run(cmd)
+	permissions = strings.TrimSpace(permissions)
 	return
 }
 
-func (sshConfig *SSHConfig) changeFileOwnership(filename, owner string) (err error) {
-	cmd := fmt.Sprintf("sudo chown %s %s", owner, filename)
-	_, err = sshConfig.Run(cmd)
+func changeFileOwnership(runner Runner, filename, owner string) (err error) {
+	_, err = runner.Run(getChownCommand(filename, owner))
 	return
 }
 
@@ -352,10 +558,10 @@ func (sshConfig *SSHConfig) InteractiveSession() {
 	sshConfig.OpenSession()
 }
 
-func (sshConfig *SSHConfig) internalExists(invert, funcName, path string) (result bool, err error) {
+func internalExists(runner Runner, invert, funcName, path string) (result bool, err error) {
 	const expectedResult string = "Yes"
 	pathExistsCmd := fmt.Sprintf(`[ %s -%s %s ] && echo -n "%s"`, invert, funcName, path, expectedResult)
-	runResult, err := sshConfig.Run(pathExistsCmd)
+	runResult, err := runner.Run(pathExistsCmd)
 	if err == nil {
 		result = strings.Contains(runResult, expectedResult)
 		return
@@ -364,9 +570,9 @@ func (sshConfig *SSHConfig) internalExists(invert, funcName, path string) (resul
 	return
 }
 
-func (sshConfig *SSHConfig) internalSum(app, path string) (result string, err error) {
+func internalSum(runner Runner, app, path string) (result string, err error) {
 	command := fmt.Sprintf("%s %s", app, path)
-	runResult, err := sshConfig.Run(command)
+	runResult, err := runner.Run(command)
 	if err != nil {
 		return
 	}
@@ -383,7 +589,7 @@ func (sshConfig *SSHConfig) Interrupt(processName string) (result string, err er
 
 // Md5sum calculates the MD5 for the given path on the host specified in the given SSHConfig
 func (sshConfig *SSHConfig) Md5sum(path string) (result string, err error) {
-	return sshConfig.internalSum("md5sum", path)
+	return internalSum(sshConfig, "md5sum", path)
 }
 
 // OpenSession opens a SSH session to the host specified in the given SSHConfig
@@ -397,8 +603,12 @@ func (sshConfig *SSHConfig) OpenSession() (*ssh.Session, *ssh.Client, error) {
 
 // ProcessStatus detects if a process is running in the environment specified in the SSHConfig.
 func (sshConfig *SSHConfig) ProcessStatus(processName string) *ResProcessStatus {
+	return getProcessStatus(sshConfig, processName)
+}
+
+func getProcessStatus(runner Runner, processName string) *ResProcessStatus {
 	cmd := fmt.Sprintf("pgrep -l %s", processName)
-	runResult, err := sshConfig.Run(cmd)
+	runResult, err := runner.Run(cmd)
 	Result := &ResProcessStatus{}
 	if err == nil {
 		Result.Exists = runResult != ""
@@ -428,9 +638,25 @@ func (sshConfig *SSHConfig) Run(cmd string) (string, error) {
 	return b.String(), err
 }
 
+// RunWithInput runs a command like Run, with the contents of the reader as the standard input of the command.
+func (sshConfig *SSHConfig) RunWithInput(cmd string, stdin io.Reader) (string, error) {
+	session, _, err := sshConfig.OpenSession()
+	if err != nil {
+		return "", err
+	}
+	sshConfig.session = nil // remove copy of the session
+	defer session.Close()
+
+	var b bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &b // get output
+	err = session.Run(cmd)
+	return b.String(), err
+}
+
 // Sha256sum calculates the SHA256 for the given path on the host specified in the given SSHConfig
 func (sshConfig *SSHConfig) Sha256sum(path string) (result string, err error) {
-	return sshConfig.internalSum("sha256sum", path)
+	return internalSum(sshConfig, "sha256sum", path)
 }
 
 // Signal sends the specified signal to the given processName…
@@ -442,7 +668,7 @@ func (sshConfig *SSHConfig) Signal(processName, signal string) (result string, e
 
 // Sum calculates the checksum of any given file on the host specified in the given SSHConfig
 func (sshConfig *SSHConfig) Sum(path string) (result string, err error) {
-	return sshConfig.internalSum("sum", path)
+	return internalSum(sshConfig, "sum", path)
 }
 
 // SetSSHTimeout sets the global SSH timeout, which will be picked up by when NewSSHConfig is called.
@@ -1,13 +1,23 @@
 package softwareupgrade
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 )
 
 func defaultSSHConfig() *SSHConfig {
@@ -175,3 +185,159 @@ func TestSSHConfig_GetOS(t *testing.T) {
 	}
 	sshConfig.Run("uname")
 }
+
+func Test_readSCPAck(t *testing.T) {
+	if err := readSCPAck(bytes.NewReader([]byte{0})); err != nil {
+		t.Fatalf("0 should be accepted as an acknowledgement, got: %v", err)
+	}
+	err := readSCPAck(bytes.NewReader([]byte("\x01scp: /usr/local/bin/geth: Permission denied\n")))
+	if err == nil || err.Error() != "scp: scp: /usr/local/bin/geth: Permission denied" {
+		t.Fatalf("Error reported by scp should be returned, got: %v", err)
+	}
+	if err := readSCPAck(bytes.NewReader(nil)); err == nil {
+		t.Fatal("Missing acknowledgement should be reported")
+	}
+}
+
+// newTestJumpHost starts a SSH server on localhost that accepts any key, and forwards direct-tcpip
+// channels, like a bastion, and returns its port
+func newTestJumpHost(t *testing.T) (port int, close func()) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Unable to convert key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestJumpHost(conn, config)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, func() { listener.Close() }
+}
+
+func serveTestJumpHost(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		targetConn, err := net.Dial("tcp", JoinHostPort(target.Host, int(target.Port)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			targetConn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelReqs)
+		go func() {
+			defer channel.Close()
+			defer targetConn.Close()
+			go io.Copy(targetConn, channel)
+			io.Copy(channel, targetConn)
+		}()
+	}
+}
+
+func TestSSHConfig_dialJumpHost(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+	keyFilename := filepath.Join(tempdir, "id_ed25519")
+	SaveDataToFile(keyFilename, pem.EncodeToMemory(block))
+
+	port, closeJumpHost := newTestJumpHost(t)
+	defer closeJumpHost()
+	newConfig := func(port int) *SSHConfig {
+		sshConfig := &SSHConfig{user: "ubuntu", HostIPOrAddr: "127.0.0.1", port: port, keepAliveDuration: time.Minute}
+		sshConfig.SetAuth([]string{keyFilename}, "", false)
+		sshConfig.SetHostKeyCheck(CHostKeyCheckOff, "", nil)
+		return sshConfig
+	}
+	jumpHost := newConfig(port)
+	defer jumpHost.Close()
+
+	// nothing listens on the nodes' port, so each dial through the jump host fails, and drops the
+	// connection to the jump host, while the other nodes are dialing through it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	unreachablePort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	nodes := []string{"node1", "node2", "node3", "node4", "node5", "node6", "node7", "node8"}
+	ForEachParallel(nodes, len(nodes), func(node string) {
+		sshConfig := newConfig(unreachablePort)
+		sshConfig.SetProxyJump(jumpHost)
+		clientConfig, err := sshConfig.getClientConfig()
+		if err != nil {
+			t.Errorf("Unable to get client config: %v", err)
+			return
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := sshConfig.dial(clientConfig); err == nil || !strings.Contains(err.Error(), "jump host") {
+				t.Errorf("Expected the node to be unreachable through the jump host, got: %v", err)
+			}
+		}
+	})
+
+	// the jump host is connected to again, once it's reachable
+	sshConfig := newConfig(port)
+	sshConfig.SetProxyJump(jumpHost)
+	defer sshConfig.Close()
+	if _, err := sshConfig.getClient(); err != nil {
+		t.Fatalf("Expected to connect through the jump host, got: %v", err)
+	}
+
+	// the node fails with a host key error, if the host key of the jump host can't be verified
+	unknownJumpHost := newConfig(port)
+	unknownJumpHost.SetHostKeyCheck(CHostKeyCheckStrict, filepath.Join(tempdir, "known_hosts"), nil)
+	defer unknownJumpHost.Close()
+	sshConfig = newConfig(port)
+	sshConfig.SetProxyJump(unknownJumpHost)
+	defer sshConfig.Close()
+	if _, err := sshConfig.getClient(); !IsHostKeyError(err) {
+		t.Fatalf("Expected the host key of the jump host to be rejected, got: %v", err)
+	}
+}
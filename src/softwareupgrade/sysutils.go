@@ -2,7 +2,9 @@ package softwareupgrade
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -80,3 +82,59 @@ func localSHA256(filename string) (result string, err error) {
 	result = runResult2[0]
 	return
 }
+
+// SplitNodeAddress splits a node entry into its host and port. The node can be specified
+// as host, host:port, an IPv6 address, or [IPv6]:port. If the port is not specified,
+// defaultPort is returned.
+func SplitNodeAddress(node string, defaultPort int) (host string, port int, err error) {
+	node = strings.TrimSpace(node)
+	if node == "" {
+		return "", 0, fmt.Errorf("empty node address")
+	}
+	port = defaultPort
+	switch {
+	case strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]"): // [IPv6]
+		{
+			host = node[1 : len(node)-1]
+		}
+	case strings.Count(node, ":") > 1 && !strings.HasPrefix(node, "["): // bare IPv6
+		{
+			host = node
+		}
+	case strings.Contains(node, ":"): // host:port or [IPv6]:port
+		{
+			var portStr string
+			if host, portStr, err = net.SplitHostPort(node); err != nil {
+				return "", 0, err
+			}
+			if port, err = strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+				return "", 0, fmt.Errorf("invalid port in node address: %s", node)
+			}
+		}
+	default:
+		{
+			host = node
+		}
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("empty host in node address: %s", node)
+	}
+	if (strings.HasPrefix(node, "[") || strings.Contains(host, ":")) && net.ParseIP(host) == nil {
+		return "", 0, fmt.Errorf("invalid IPv6 address in node address: %s", node)
+	}
+	return
+}
+
+// JoinHostPort combines the host and port into an address suitable for dialing,
+// enclosing IPv6 addresses in square brackets.
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ShellQuote quotes the given string so that it's passed as a single argument by the shell
+func ShellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@%+,") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -30,3 +30,50 @@ func TestSHA256(t *testing.T) {
 		t.Fatal("Unable to create temp dir")
 	}
 }
+
+func TestSplitNodeAddress(t *testing.T) {
+	tests := []struct {
+		node string
+		host string
+		port int
+	}{
+		{"ec2-54-164-95-40.compute-1.amazonaws.com", "ec2-54-164-95-40.compute-1.amazonaws.com", 22},
+		{"34.228.16.117", "34.228.16.117", 22},
+		{"34.228.16.117:2222", "34.228.16.117", 2222},
+		{"2001:db8::1", "2001:db8::1", 22},
+		{"[2001:db8::1]", "2001:db8::1", 22},
+		{"[2001:db8::1]:2222", "2001:db8::1", 2222},
+		{" node1:23 ", "node1", 23},
+	}
+	for _, test := range tests {
+		host, port, err := SplitNodeAddress(test.node, 22)
+		if err != nil || host != test.host || port != test.port {
+			t.Fatalf("SplitNodeAddress(%q) = %q, %d, %v, expected %q, %d", test.node, host, port, err, test.host, test.port)
+		}
+	}
+
+	for _, node := range []string{"", "node1:", "node1:abc", "node1:70000", "[2001:db8::1]:", "[node1]", "2001:db8::zz"} {
+		if _, _, err := SplitNodeAddress(node, 22); err == nil {
+			t.Fatalf("SplitNodeAddress(%q) should fail", node)
+		}
+	}
+
+	if addr := JoinHostPort("2001:db8::1", 22); addr != "[2001:db8::1]:22" {
+		t.Fatalf("JoinHostPort returned %s", addr)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/usr/local/bin/geth": "/usr/local/bin/geth",
+		"":                    "''",
+		"my file":             "'my file'",
+		"it's":                `'it'"'"'s'`,
+		"$(reboot)":           "'$(reboot)'",
+	}
+	for s, expected := range tests {
+		if quoted := ShellQuote(s); quoted != expected {
+			t.Fatalf("ShellQuote(%q) = %s, expected %s", s, quoted, expected)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package softwareupgrade
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpCopy uploads the contents of the reader to a temporary file in the home directory
+// of the SSH user, as the SSH user can't write to the destination directly. Once the upload
+// is flushed to disk, the file is copied next to remotePath using sudo, and then renamed
+// over remotePath, so that remotePath is either the previous or the new file, but never partial.
+func (sshConfig *SSHConfig) sftpCopy(reader io.Reader, remotePath string, permissions string, size int64) (err error) {
+	sshClient, err := sshConfig.getClient()
+	if err != nil {
+		return err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return fmt.Errorf("unable to start sftp: %v", err)
+	}
+	defer client.Close()
+
+	filename := path.Base(remotePath)
+	uploadPath := fmt.Sprintf(".%s.%s.upload", filename, backupSuffix) // relative to the home directory
+	defer client.Remove(uploadPath)
+
+	if err = sftpUpload(client, reader, uploadPath, size); err != nil {
+		return err
+	}
+
+	// the partial file is in the same directory as remotePath, so that mv is a rename
+	partialPath := path.Join(path.Dir(remotePath), fmt.Sprintf(".%s.partial", filename))
+	cmd := fmt.Sprintf("sudo cp %[1]s %[2]s && sudo chmod %[3]s %[2]s && sudo sync %[2]s && sudo mv -f %[2]s %[4]s",
+		ShellQuote(uploadPath), ShellQuote(partialPath), permissions, ShellQuote(remotePath))
+	if output, err := sshConfig.Run(cmd); err != nil {
+		sshConfig.Run(fmt.Sprintf("sudo rm -f %s", ShellQuote(partialPath)))
+		return fmt.Errorf("unable to move %s into place: %v %s", remotePath, err, output)
+	}
+	return nil
+}
+
+func sftpUpload(client *sftp.Client, reader io.Reader, uploadPath string, size int64) error {
+	f, err := client.Create(uploadPath)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", uploadPath, err)
+	}
+	defer f.Close()
+
+	writtenCount, err := io.Copy(f, reader)
+	if err != nil {
+		return fmt.Errorf("unable to write to %s: %v", uploadPath, err)
+	}
+	if writtenCount != size {
+		return fmt.Errorf("Copied size: %d not equal to file size: %d", writtenCount, size)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("unable to fsync %s: %v", uploadPath, err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	stat, err := client.Stat(uploadPath)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != size {
+		return fmt.Errorf("Uploaded size: %d not equal to file size: %d", stat.Size(), size)
+	}
+	return nil
+}
+
+// inputRunner runs a command on a node like Runner, and can also send the command its
+// standard input. It's implemented by SSHConfig.
+type inputRunner interface {
+	Runner
+	RunWithInput(cmd string, stdin io.Reader) (string, error)
+}
+
+// uploadRunner runs a command on a node like Runner, and can also copy a local file to the node.
+// It's implemented by SSHConfig.
+type uploadRunner interface {
+	Runner
+	CopyLocalFileToRemoteFile(localFilename, remoteFilename, permissions string) error
+	resumesTransfers() bool
+}
+
+// resumesTransfers returns true if an interrupted transfer continues from where it stopped
+func (sshConfig *SSHConfig) resumesTransfers() bool {
+	return sshConfig.resumable
+}
+
+// resumableCopy appends the local file to remotePath in chunks. If remotePath already contains
+// the beginning of the local file, eg, left over by an interrupted transfer, the transfer
+// continues from the end of remotePath, instead of from the beginning.
+func (sshConfig *SSHConfig) resumableCopy(file *os.File, remotePath string, permissions string) (err error) {
+	return chunkedCopy(sshConfig, sshConfig.HostIPOrAddr, file, remotePath, permissions, sshConfig.chunkSize)
+}
+
+// chunkedCopy implements resumableCopy with the given runner, sending at most chunkSize bytes per command.
+// host is only used in the messages logged.
+func chunkedCopy(runner inputRunner, host string, file *os.File, remotePath string, permissions string, chunkSize int64) (err error) {
+	if len(permissions) != 4 {
+		return fmt.Errorf("permissions need to be 4 characters")
+	}
+	if chunkSize <= 0 {
+		chunkSize = CDefaultChunkSize
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+
+	offset, err := getResumeOffset(runner, host, file, remotePath, size)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		if _, err = runner.Run(fmt.Sprintf("sudo sh -c %s", ShellQuote(": > "+ShellQuote(remotePath)))); err != nil {
+			return fmt.Errorf("unable to create %s: %v", remotePath, err)
+		}
+	} else {
+		DebugLog.Println("Resuming transfer of %s to %s:%s from byte %d", file.Name(), host, remotePath, offset)
+	}
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	appendCmd := fmt.Sprintf("sudo sh -c %s", ShellQuote("cat >> "+ShellQuote(remotePath)))
+	for offset < size {
+		chunk := chunkSize
+		if size-offset < chunk {
+			chunk = size - offset
+		}
+		if _, err = runner.RunWithInput(appendCmd, io.LimitReader(file, chunk)); err != nil {
+			return fmt.Errorf("transfer of %s interrupted at byte %d of %d: %v", remotePath, offset, size, err)
+		}
+		offset += chunk
+		DebugLog.Debugln("%s: uploaded %d of %d bytes (%d%%) to %s", host, offset, size, offset*100/size, remotePath)
+	}
+
+	if _, err = runner.Run(fmt.Sprintf("sudo chmod %s %s", permissions, ShellQuote(remotePath))); err != nil {
+		return err
+	}
+	remoteSize, err := getRemoteFileSize(runner, remotePath)
+	if err == nil && remoteSize != size {
+		err = fmt.Errorf("Uploaded size: %d not equal to file size: %d", remoteSize, size)
+	}
+	return err
+}
+
+// getResumeOffset returns the size of remotePath, if it's the beginning of the local file,
+// otherwise, 0 is returned, so that the transfer starts from the beginning.
+func getResumeOffset(runner Runner, host string, file *os.File, remotePath string, size int64) (offset int64, err error) {
+	remoteSize, err := getRemoteFileSize(runner, remotePath)
+	if err != nil || remoteSize <= 0 || remoteSize > size {
+		return 0, nil // missing, empty, or not a prefix of the local file
+	}
+	output, err := runner.Run(fmt.Sprintf("sudo sha256sum %s", ShellQuote(remotePath)))
+	if err != nil {
+		return 0, nil
+	}
+	remoteHash := strings.Split(output, " ")[0]
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	if _, err = io.CopyN(h, file, remoteSize); err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != remoteHash {
+		DebugLog.Println("%s:%s doesn't match the beginning of %s, restarting transfer", host, remotePath, file.Name())
+		return 0, nil
+	}
+	return remoteSize, nil
+}
+
+func getRemoteFileSize(runner Runner, remotePath string) (size int64, err error) {
+	output, err := runner.Run(fmt.Sprintf("sudo stat -c %%s %s", ShellQuote(remotePath)))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
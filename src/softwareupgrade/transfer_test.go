@@ -0,0 +1,189 @@
+package softwareupgrade
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFileRunner runs the commands of a chunked copy against a single remote file kept in memory
+type fakeFileRunner struct {
+	contents []byte
+	exists   bool
+	commands []string
+	chunks   []int // the size of each chunk appended
+	failAt   int   // the append that fails, counting from 1, 0 if none fail
+	dropByte bool  // each append loses its last byte
+}
+
+func (runner *fakeFileRunner) Run(cmd string) (string, error) {
+	runner.commands = append(runner.commands, cmd)
+	switch {
+	case strings.HasPrefix(cmd, "sudo stat -c %s "):
+		if !runner.exists {
+			return "stat: cannot stat: No such file or directory", exitStatusError(1)
+		}
+		return fmt.Sprintf("%d\n", len(runner.contents)), nil
+	case strings.HasPrefix(cmd, "sudo sha256sum "):
+		return fmt.Sprintf("%x  remote\n", sha256.Sum256(runner.contents)), nil
+	case strings.Contains(cmd, ": > "):
+		runner.contents, runner.exists = nil, true
+		return "", nil
+	case strings.HasPrefix(cmd, "sudo chmod "):
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command: %s", cmd)
+}
+
+func (runner *fakeFileRunner) RunWithInput(cmd string, stdin io.Reader) (string, error) {
+	runner.commands = append(runner.commands, cmd)
+	if !strings.Contains(cmd, "cat >> ") {
+		return "", fmt.Errorf("unexpected command: %s", cmd)
+	}
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return "", err
+	}
+	if runner.failAt == len(runner.chunks)+1 {
+		return "", errors.New("connection lost")
+	}
+	runner.chunks = append(runner.chunks, len(data))
+	if runner.dropByte && len(data) > 0 {
+		data = data[:len(data)-1]
+	}
+	runner.contents = append(runner.contents, data...)
+	runner.exists = true
+	return "", nil
+}
+
+func (runner *fakeFileRunner) truncated() bool {
+	for _, cmd := range runner.commands {
+		if strings.Contains(cmd, ": > ") {
+			return true
+		}
+	}
+	return false
+}
+
+// newTransferFile creates the local file of a transfer in a temp dir, which is removed by the returned func
+func newTransferFile(t *testing.T, contents string) (*os.File, func()) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	filename := filepath.Join(tempdir, "geth")
+	if err = ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		os.RemoveAll(tempdir)
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		t.Fatal(err)
+	}
+	return file, func() {
+		file.Close()
+		os.RemoveAll(tempdir)
+	}
+}
+
+func TestChunkedCopy(t *testing.T) {
+	const local = "hello, world!" // 13 bytes
+	tests := []struct {
+		name      string
+		exists    bool
+		remote    string
+		truncated bool
+		chunks    []int
+	}{
+		{"missing remote file", false, "", true, []int{4, 4, 4, 1}},
+		{"resumes from a matching prefix", true, "hello", false, []int{4, 4}},
+		{"restarts if the remote file isn't a prefix", true, "jello", true, []int{4, 4, 4, 1}},
+		{"restarts if the remote file is larger", true, local + "!!", true, []int{4, 4, 4, 1}},
+		{"restarts if the remote file is empty", true, "", true, []int{4, 4, 4, 1}},
+		{"already complete", true, local, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeFileRunner{contents: []byte(test.remote), exists: test.exists}
+			file, cleanup := newTransferFile(t, local)
+			defer cleanup()
+			if err := chunkedCopy(runner, "node1", file, "/usr/local/bin/geth", "0755", 4); err != nil {
+				t.Fatal(err)
+			}
+			if string(runner.contents) != local {
+				t.Fatalf("Expected the remote file to contain %q, got %q", local, runner.contents)
+			}
+			if runner.truncated() != test.truncated {
+				t.Fatalf("Expected the remote file to be truncated: %v, commands: %v", test.truncated, runner.commands)
+			}
+			if fmt.Sprint(runner.chunks) != fmt.Sprint(test.chunks) {
+				t.Fatalf("Expected chunks: %v, got: %v", test.chunks, runner.chunks)
+			}
+		})
+	}
+}
+
+func TestChunkedCopy_EmptyFile(t *testing.T) {
+	runner := &fakeFileRunner{}
+	file, cleanup := newTransferFile(t, "")
+	defer cleanup()
+	if err := chunkedCopy(runner, "node1", file, "/etc/empty", "0644", 4); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.exists || len(runner.contents) != 0 || len(runner.chunks) != 0 {
+		t.Fatalf("Expected an empty remote file without any chunks, got %q, chunks: %v", runner.contents, runner.chunks)
+	}
+}
+
+func TestChunkedCopy_Interrupted(t *testing.T) {
+	const local = "0123456789"
+	file, cleanup := newTransferFile(t, local)
+	defer cleanup()
+	runner := &fakeFileRunner{failAt: 2}
+	err := chunkedCopy(runner, "node1", file, "/usr/local/bin/geth", "0755", 4)
+	if err == nil || !strings.Contains(err.Error(), "interrupted at byte 4 of 10") {
+		t.Fatalf("Expected the transfer to be interrupted at byte 4, got: %v", err)
+	}
+
+	// the next attempt continues after the chunk that was transferred
+	runner.failAt, runner.chunks = 0, nil
+	if err = chunkedCopy(runner, "node1", file, "/usr/local/bin/geth", "0755", 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(runner.contents) != local || fmt.Sprint(runner.chunks) != "[4 2]" {
+		t.Fatalf("Expected the transfer to resume from byte 4, got %q, chunks: %v", runner.contents, runner.chunks)
+	}
+}
+
+func TestChunkedCopy_SizeMismatch(t *testing.T) {
+	runner := &fakeFileRunner{dropByte: true}
+	file, cleanup := newTransferFile(t, "0123456789")
+	defer cleanup()
+	err := chunkedCopy(runner, "node1", file, "/usr/local/bin/geth", "0755", 4)
+	if err == nil || !strings.Contains(err.Error(), "Uploaded size: 7 not equal to file size: 10") {
+		t.Fatalf("Expected the size of the remote file to be verified, got: %v", err)
+	}
+	if !bytes.Equal(runner.contents, []byte("0124568")) {
+		t.Fatalf("Unexpected remote contents: %q", runner.contents)
+	}
+}
+
+func TestChunkedCopy_Permissions(t *testing.T) {
+	runner := &fakeFileRunner{}
+	file, cleanup := newTransferFile(t, "data")
+	defer cleanup()
+	if err := chunkedCopy(runner, "node1", file, "/etc/data", "644", 4); err == nil {
+		t.Fatal("Expected permissions that aren't 4 characters to be rejected")
+	}
+	if len(runner.commands) != 0 {
+		t.Fatalf("Expected no commands to be run, got: %v", runner.commands)
+	}
+}
@@ -0,0 +1,114 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// CountOrPercent contains either a number of nodes, or a percentage of the nodes in a group,
+	// specified in JSON as either a number, or a string, eg, "25%"
+	CountOrPercent struct {
+		Value   int
+		Percent bool
+	}
+
+	// UnavailableGate limits the number of nodes of a group that are unavailable at the same time,
+	// counting both the nodes being upgraded, and the nodes that failed to upgrade.
+	UnavailableGate struct {
+		limit    int
+		inFlight int
+		failed   int
+		mutex    sync.Mutex
+		cond     *sync.Cond
+	}
+)
+
+// MarshalJSON marshals the count or percentage into JSON format
+func (c CountOrPercent) MarshalJSON() ([]byte, error) {
+	if c.Percent {
+		return json.Marshal(fmt.Sprintf("%d%%", c.Value))
+	}
+	return json.Marshal(c.Value)
+}
+
+// UnmarshalJSON unmarshals the JSON into native Go structure
+func (c *CountOrPercent) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		c.Value, c.Percent = int(value), false
+	case string:
+		value = strings.TrimSpace(value)
+		c.Percent = strings.HasSuffix(value, "%")
+		var err error
+		if c.Value, err = strconv.Atoi(strings.TrimSuffix(value, "%")); err != nil {
+			return fmt.Errorf("invalid count or percentage: %s", value)
+		}
+	default:
+		return errors.New("invalid count or percentage")
+	}
+	if c.Value < 0 || c.Percent && c.Value > 100 {
+		return fmt.Errorf("count or percentage out of range: %s", string(b))
+	}
+	return nil
+}
+
+// Resolve returns the number of nodes, out of total nodes. A percentage is rounded down,
+// but is at least 1, so that the nodes can still be upgraded one at a time.
+// 0 is returned if the count or percentage isn't specified.
+func (c CountOrPercent) Resolve(total int) (result int) {
+	if !c.Percent {
+		return c.Value
+	}
+	if c.Value == 0 {
+		return 0
+	}
+	result = total * c.Value / 100
+	if result < 1 {
+		result = 1
+	}
+	return
+}
+
+// NewUnavailableGate creates a gate that allows at most limit nodes to be unavailable at the same time.
+// If limit is 0, the number of unavailable nodes isn't limited.
+func NewUnavailableGate(limit int) (result *UnavailableGate) {
+	result = &UnavailableGate{limit: limit}
+	result.cond = sync.NewCond(&result.mutex)
+	return
+}
+
+// Acquire waits until another node can be taken down, and returns true, or returns false
+// if the nodes that failed already use up the limit, so that no more nodes can be taken down.
+func (gate *UnavailableGate) Acquire() bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	for gate.limit > 0 && gate.inFlight+gate.failed >= gate.limit {
+		if gate.failed >= gate.limit {
+			return false
+		}
+		gate.cond.Wait()
+	}
+	gate.inFlight++
+	return true
+}
+
+// Release records that a node acquired with Acquire has completed. If it failed, it remains
+// unavailable, and continues to count towards the limit.
+func (gate *UnavailableGate) Release(failed bool) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.inFlight--
+	if failed {
+		gate.failed++
+	}
+	gate.cond.Broadcast()
+}
@@ -0,0 +1,84 @@
+package softwareupgrade
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCountOrPercent(t *testing.T) {
+	tests := []struct {
+		json      string
+		total     int
+		expected  int
+		expectErr bool
+	}{
+		{`2`, 10, 2, false},
+		{`"3"`, 10, 3, false},
+		{`"25%"`, 10, 2, false},
+		{`"10%"`, 3, 1, false},
+		{`"0%"`, 10, 0, false},
+		{`"100%"`, 7, 7, false},
+		{`"150%"`, 10, 0, true},
+		{`-1`, 10, 0, true},
+		{`"many"`, 10, 0, true},
+		{`true`, 10, 0, true},
+	}
+	for _, test := range tests {
+		var c CountOrPercent
+		err := json.Unmarshal([]byte(test.json), &c)
+		if (err != nil) != test.expectErr {
+			t.Fatalf("%s: unexpected error: %v", test.json, err)
+		}
+		if err == nil {
+			if result := c.Resolve(test.total); result != test.expected {
+				t.Fatalf("%s of %d: expected %d, got: %d", test.json, test.total, test.expected, result)
+			}
+		}
+	}
+}
+
+func TestUnavailableGate(t *testing.T) {
+	gate := NewUnavailableGate(2)
+	var unavailable, maxUnavailable int32
+	var mutex sync.Mutex
+	ForEachParallel([]string{"node1", "node2", "node3", "node4", "node5"}, 5, func(node string) {
+		if !gate.Acquire() {
+			t.Errorf("%s should have been allowed to proceed", node)
+			return
+		}
+		current := atomic.AddInt32(&unavailable, 1)
+		mutex.Lock()
+		if current > maxUnavailable {
+			maxUnavailable = current
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&unavailable, -1)
+		gate.Release(false)
+	})
+	if maxUnavailable != 2 {
+		t.Fatalf("Expected at most 2 nodes to be unavailable, got: %d", maxUnavailable)
+	}
+
+	// A failed node remains unavailable
+	gate = NewUnavailableGate(2)
+	gate.Acquire()
+	gate.Release(true)
+	if !gate.Acquire() {
+		t.Fatal("A second node should be allowed while only 1 node failed")
+	}
+	gate.Release(true)
+	if gate.Acquire() {
+		t.Fatal("No more nodes should be allowed once 2 nodes failed")
+	}
+
+	gate = NewUnavailableGate(0)
+	for i := 0; i < 10; i++ {
+		if !gate.Acquire() {
+			t.Fatal("A gate without a limit should always allow nodes")
+		}
+	}
+}